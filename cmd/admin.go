@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//adminPageSource is the test email form served at /admin/
+//
+//go:embed admin.html
+var adminPageSource string
+
+var adminPage = htmltemplate.Must(htmltemplate.New("admin").Parse(adminPageSource))
+
+//newRequestID returns a random identifier for an EmailSendRequest
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//csrfTokenLifetime is how long the admin page may be left open before
+//what it sends is refused
+const csrfTokenLifetime = 12 * time.Hour
+
+//isAdmin reports whether r carries `Authorization: Bearer <AdminToken>`,
+//or basic auth with AdminToken as the password so browsers can log in.
+//Browsers send basic credentials along with requests any site makes, so
+//those changing anything also need the X-CSRF-Token of the admin page.
+func (s *server) isAdmin(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	_, password, basic := r.BasicAuth()
+	if basic {
+		token = password
+	}
+	if s.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return !basic || s.validCSRFToken(r.Header.Get("X-CSRF-Token"), time.Now())
+}
+
+//csrfToken returns the token the admin page issued at now sends along
+func (s *server) csrfToken(now time.Time) string {
+	issued := strconv.FormatInt(now.Unix(), 10)
+	return issued + "." + s.signCSRF(issued)
+}
+
+func (s *server) signCSRF(issued string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.AdminToken))
+	mac.Write([]byte("csrf\n" + issued))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//validCSRFToken reports whether token was issued by csrfToken less than
+//csrfTokenLifetime before now
+func (s *server) validCSRFToken(token string, now time.Time) bool {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	issued, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.signCSRF(issued))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	return age > -time.Minute && age < csrfTokenLifetime
+}
+
+//requireAdmin only lets admin requests through to h, see isAdmin
+func (s *server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+//adminPageData fills in the admin page
+type adminPageData struct {
+	BaseURL   string
+	CSRFToken string
+}
+
+//adminPageHandler serves a form for sending test emails to one recipient
+//through the regular handler
+func (s *server) adminPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	page := adminPageData{BaseURL: s.config.BaseURL, CSRFToken: s.csrfToken(time.Now())}
+	if err := adminPage.Execute(w, page); err != nil {
+		errorLogger.Printf("Rendering admin page: %v", err)
+	}
+}
+
+//adminRecipient is how the admin page lists a recipient
+type adminRecipient struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+//recipientsHandler lists the current recipients for the admin page
+func (s *server) recipientsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []adminRecipient{}
+	for key, rcpt := range s.config.EmailConfig.currentRecipients() {
+		list = append(list, adminRecipient{Key: key, Name: rcpt.Name, Address: rcpt.Address})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+//debugHeadersHandler shows the header block of a message to the recipient
+//in the `to` query parameter, built as the emailer would, without sending
+//anything. Only the Message-ID, of a "preview" request, and the Date
+//differ from what is sent.
+func (s *server) debugHeadersHandler(w http.ResponseWriter, r *http.Request) {
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "Missing to parameter", http.StatusBadRequest)
+		return
+	}
+	m := &s.config.EmailConfig
+	rcpt := Recipient{Address: to}
+	for _, candidate := range m.currentRecipients() {
+		if strings.EqualFold(candidate.Address, to) {
+			rcpt = candidate
+			break
+		}
+	}
+	req := EmailSendRequest{ID: "preview"}
+	header := m.messageHeader(&req, m.headerFor(rcpt), m.identityFor(&req, rcpt))
+	var html []byte
+	if m.templates != nil && m.templates.get().html != nil && !m.ForcePlainText {
+		html = []byte("<p>preview</p>")
+	}
+	text, html := rcpt.bodies([]byte("preview\n"), html)
+	msg, err := m.buildMessage(&header, rcpt.Address, text, html, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(msg[:bytes.Index(msg, []byte("\r\n\r\n"))+2])
+}
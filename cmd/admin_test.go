@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	config := ServerConfig{}
+	m := &config.EmailConfig
+	m.Sender.Address = "docs@example.com"
+	m.Header = *benchHeader()
+	m.Environment = "staging"
+	m.Recipients = map[string]Recipient{
+		"sales": {Address: "sales@example.com", Header: &HeaderOverride{Subject: "Lead for sales"}},
+	}
+	s := &server{config: config}
+
+	w := httptest.NewRecorder()
+	s.debugHeadersHandler(w, httptest.NewRequest("GET", "/debug/headers?to=sales@example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	header := w.Body.Bytes()
+	if !bytes.HasSuffix(header, []byte("\r\n")) || bytes.Contains(header, []byte("\r\n\r\n")) {
+		t.Fatalf("got more or less than the header block:\n%s", header)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header, "\r\n"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"To":            "sales@example.com",
+		"Subject":       "Lead for sales",
+		"X-Environment": "staging",
+		"Content-Type":  `text/plain; charset="utf-8"`,
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<preview.") {
+		t.Errorf("got Message-ID %q, want one of a preview request", id)
+	}
+	if date, err := msg.Header.Date(); err != nil || time.Since(date) > time.Minute {
+		t.Errorf("got Date %q (%v)", msg.Header.Get("Date"), err)
+	}
+}
+
+func TestAdminCSRF(t *testing.T) {
+	s := &server{config: ServerConfig{AdminToken: "secret"}}
+	now := time.Now()
+	page := httptest.NewRecorder()
+	s.adminPageHandler(page, httptest.NewRequest("GET", "/admin/", nil))
+	_, issued, _ := strings.Cut(page.Body.String(), `var csrfToken = "`)
+	issued, _, _ = strings.Cut(issued, `"`)
+	if !s.validCSRFToken(issued, now) {
+		t.Errorf("the admin page carries no valid CSRF token:\n%s", page.Body)
+	}
+	fresh := s.csrfToken(now)
+	forged := (&server{config: ServerConfig{AdminToken: "other"}}).csrfToken(now)
+	for _, c := range []struct {
+		name, method, auth, token string
+		want                      bool
+	}{
+		{"basic read", "GET", "basic", "", true},
+		{"basic write without a token", "POST", "basic", "", false},
+		{"basic write", "POST", "basic", fresh, true},
+		{"basic write with an expired token", "POST", "basic", s.csrfToken(now.Add(-csrfTokenLifetime)), false},
+		{"basic write with a forged token", "POST", "basic", forged, false},
+		{"basic write with a garbled token", "POST", "basic", "x" + fresh, false},
+		{"bearer write", "POST", "bearer", "", true},
+		{"wrong password", "GET", "wrong", "", false},
+	} {
+		r := httptest.NewRequest(c.method, "/admin/pause", nil)
+		switch c.auth {
+		case "basic":
+			r.SetBasicAuth("admin", "secret")
+		case "bearer":
+			r.Header.Set("Authorization", "Bearer secret")
+		case "wrong":
+			r.SetBasicAuth("admin", "guess")
+		}
+		if c.token != "" {
+			r.Header.Set("X-CSRF-Token", c.token)
+		}
+		if got := s.isAdmin(r); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
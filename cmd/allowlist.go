@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//recipientAllowlist holds the address patterns a template may be sent to,
+//lower case. They are matched with path.Match, e.g. "sales@example.com",
+//"*@example.com" or "*@*.example.com". An empty list allows everyone.
+type recipientAllowlist []string
+
+//RecipientNotAllowedError means a request resolved to a recipient its
+//template may not be sent to
+type RecipientNotAllowedError struct {
+	Template  string
+	Recipient string
+}
+
+func (e *RecipientNotAllowedError) Error() string {
+	return fmt.Sprintf("the %s template may not be sent to %s", e.Template, e.Recipient)
+}
+
+func parseAllowlist(patterns []string) (recipientAllowlist, error) {
+	var l recipientAllowlist
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return nil, fmt.Errorf("invalid recipient pattern %q", p)
+		}
+		l = append(l, p)
+	}
+	return l, nil
+}
+
+func (l recipientAllowlist) allows(addr string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	for _, p := range l {
+		if ok, _ := path.Match(p, addr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//check fails with a RecipientNotAllowedError if any of recipients isn't
+//allowed for template
+func (l recipientAllowlist) check(template string, recipients map[string]Recipient) error {
+	if len(l) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(recipients))
+	for key := range recipients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if addr := recipients[key].Address; !l.allows(addr) {
+			return &RecipientNotAllowedError{Template: template, Recipient: addr}
+		}
+	}
+	return nil
+}
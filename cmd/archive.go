@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//ArchiveConfig describes an independent SMTP system that receives a copy
+//of every message sent, e.g. a legal archive
+type ArchiveConfig struct {
+	Server SenderConfig `yaml:"Server"`
+	//Address is the archive mailbox the copy is submitted to
+	Address    string        `yaml:"ArchiveAddress"`
+	Retries    int           `yaml:"Retries"`
+	RetryDelay time.Duration `yaml:"RetryDelay"`
+	//Required makes an archiving failure fail the user-facing send.
+	//Otherwise the archive copy is submitted in the background.
+	Required bool `yaml:"Required"`
+}
+
+//archive submits a copy of the message sent to recipients to the archive
+//system, retrying up to a.Retries times
+func (a *ArchiveConfig) archive(ctx context.Context, m *MailConfig, text, html []byte, attachments []Attachment) error {
+	msg, err := m.buildMessage(&m.Header, strings.Join(m.recipientAddresses(), ", "), text, html, attachments)
+	if err != nil {
+		return err
+	}
+
+	sender := a.Server.newSender()
+	for attempt := 0; ; attempt++ {
+		_, err = sender.Send(ctx, &Message{To: []string{a.Address}, Data: msg})
+		if err == nil || attempt >= a.Retries {
+			break
+		}
+		errorLogger.Printf("Archiving attempt %d/%d failed: %v", attempt+1, a.Retries+1, err)
+		time.Sleep(a.RetryDelay)
+	}
+	if err != nil {
+		return fmt.Errorf("archiving message: %w", err)
+	}
+	return nil
+}
+
+//archiveCopy archives the message according to the Required setting and
+//returns an error only when archiving is required and failed. A required
+//copy is sent within ctx, otherwise ctx has ended by the time it's sent.
+func (m *MailConfig) archiveCopy(ctx context.Context, text, html []byte, attachments []Attachment) error {
+	a := m.Archive
+	if a == nil {
+		return nil
+	}
+	if a.Required {
+		return a.archive(ctx, m, text, html, attachments)
+	}
+	go func() {
+		if err := a.archive(context.Background(), m, text, html, attachments); err != nil {
+			errorLogger.Printf("Giving up on archive copy: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+)
+
+//The signatures http.DetectContentType looks for, followed by some content
+var (
+	testPNG = append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 64)...)
+	testPDF = []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n%%EOF\n")
+)
+
+func TestAttachmentContentType(t *testing.T) {
+	tests := []struct {
+		declared string
+		data     []byte
+		want     string
+	}{
+		{"", testPNG, "image/png"},
+		{"application/octet-stream", testPNG, "image/png"},
+		{"", testPDF, "application/pdf"},
+		{"Application/Octet-Stream", testPDF, "application/pdf"},
+		{"binary/octet-stream", testPDF, "application/pdf"},
+		{"not a media type", testPDF, "application/pdf"},
+		//a specific type is the client's to choose
+		{"image/x-icon", testPNG, "image/x-icon"},
+		{"application/x-pdf; version=1.4", testPDF, "application/x-pdf; version=1.4"},
+	}
+	for _, test := range tests {
+		if got := attachmentContentType(test.declared, test.data); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.declared, got, test.want)
+		}
+	}
+}
+
+//attachmentForm returns a multipart/form-data request uploading each of
+//files, named by filename, with the declared Content-Type if any
+func attachmentForm(t *testing.T, files ...Attachment) *http.Request {
+	t.Helper()
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	for _, f := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "attachments", "filename": f.Filename}))
+		if f.ContentType != "" {
+			h.Set("Content-Type", f.ContentType)
+		}
+		part, err := w.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(f.Data)
+	}
+	w.Close()
+	r, _ := http.NewRequest("POST", "/", body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestAttachmentSniffing(t *testing.T) {
+	s := &server{config: ServerConfig{MultipartMaxMemory: 1 << 20}}
+	r := attachmentForm(t,
+		Attachment{Filename: "logo.png", ContentType: "application/octet-stream", Data: testPNG},
+		Attachment{Filename: "datasheet.pdf", Data: testPDF},
+	)
+	var req EmailSendRequest
+	if err := s.readAttachments(r, &req); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ filename, contentType string }{{"logo.png", "image/png"}, {"datasheet.pdf", "application/pdf"}}
+	if len(req.Attachments) != len(want) {
+		t.Fatalf("got %d attachments, want %d", len(req.Attachments), len(want))
+	}
+	for i, a := range req.Attachments {
+		if a.Filename != want[i].filename || a.ContentType != want[i].contentType {
+			t.Errorf("attachment %d: got %s as %s, want %s as %s", i, a.Filename, a.ContentType, want[i].filename, want[i].contentType)
+		}
+	}
+
+	msg, err := (&MailConfig{}).buildMessage(benchHeader(), "sales@example.com", []byte("Attached.\n"), nil, req.Attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, parts, bodies := readMultipart(t, msg)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts, want the text and 2 attachments", len(parts))
+	}
+	for i, p := range parts[1:] {
+		if got := p.Header.Get("Content-Type"); got != want[i].contentType {
+			t.Errorf("part %d: Content-Type %q, want %q", i+1, got, want[i].contentType)
+		}
+		if got := p.FileName(); got != want[i].filename {
+			t.Errorf("part %d: filename %q, want %q", i+1, got, want[i].filename)
+		}
+		if got := p.Header.Get("Content-Transfer-Encoding"); got != "base64" {
+			t.Fatalf("part %d: Content-Transfer-Encoding %q", i+1, got)
+		}
+		data, err := base64.StdEncoding.DecodeString(string(bytes.Replace(bodies[i+1], []byte("\r\n"), nil, -1)))
+		if err != nil || !bytes.Equal(data, req.Attachments[i].Data) {
+			t.Errorf("part %d: the content changed", i+1)
+		}
+	}
+}
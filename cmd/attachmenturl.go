@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAttachmentURLTimeout  = 30 * time.Second
+	defaultAttachmentURLMaxBytes = 10 << 20
+	defaultAttachmentURLMax      = 5
+)
+
+//AttachmentURLConfig lets requests name documents to attach by URL in the
+//attachmentURL field, fetched before the request is accepted. Only the
+//hosts in AllowedHosts are fetched from, redirects included, so requests
+//can't point the server at internal services.
+type AttachmentURLConfig struct {
+	//AllowedHosts are host names or path.Match patterns such as
+	//"*.example.com", lower case
+	AllowedHosts []string `yaml:"AllowedHosts"`
+	//Schemes are the URL schemes allowed, only https by default
+	Schemes []string `yaml:"Schemes"`
+	//Timeout bounds each fetch, 30 seconds by default
+	Timeout time.Duration `yaml:"Timeout"`
+	//MaxBytes caps the size of each document, 10 MiB by default
+	MaxBytes int64 `yaml:"MaxBytes"`
+	//MaxURLs caps the URLs of a request, 5 by default
+	MaxURLs int `yaml:"MaxURLs"`
+}
+
+//AttachmentFetchError means a document to attach couldn't be fetched
+type AttachmentFetchError struct {
+	//URL leaves out the query, which may hold credentials
+	URL string
+	Err error
+}
+
+func (e *AttachmentFetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.URL, e.Err)
+}
+
+func (e *AttachmentFetchError) Unwrap() error {
+	return e.Err
+}
+
+func (c *AttachmentURLConfig) validate() error {
+	if len(c.AllowedHosts) == 0 {
+		return errors.New("attachment URLs need AllowedHosts")
+	}
+	for i, p := range c.AllowedHosts {
+		c.AllowedHosts[i] = strings.ToLower(p)
+		if _, err := path.Match(c.AllowedHosts[i], ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q", p)
+		}
+	}
+	if len(c.Schemes) == 0 {
+		c.Schemes = []string{"https"}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultAttachmentURLTimeout
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultAttachmentURLMaxBytes
+	}
+	if c.MaxURLs <= 0 {
+		c.MaxURLs = defaultAttachmentURLMax
+	}
+	return nil
+}
+
+//check fails unless u has an allowed scheme and host
+func (c *AttachmentURLConfig) check(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	allowed := false
+	for _, s := range c.Schemes {
+		allowed = allowed || strings.ToLower(s) == scheme
+	}
+	if !allowed {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, p := range c.AllowedHosts {
+		if ok, _ := path.Match(p, host); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not allowed", host)
+}
+
+//redactURL returns u without its query and user info
+func redactURL(u *url.URL) string {
+	r := *u
+	r.User, r.RawQuery, r.Fragment = nil, "", ""
+	return r.String()
+}
+
+//parse validates the URLs of a request
+func (c *AttachmentURLConfig) parse(raw []string) ([]*url.URL, error) {
+	if len(raw) > c.MaxURLs {
+		return nil, fmt.Errorf("more than %d attachment URLs", c.MaxURLs)
+	}
+	urls := make([]*url.URL, 0, len(raw))
+	for _, s := range raw {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil || !u.IsAbs() {
+			return nil, errors.New("attachmentURL must be an absolute URL")
+		}
+		if err = c.check(u); err != nil {
+			return nil, fmt.Errorf("attachment URL %s: %w", redactURL(u), err)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+//fetch downloads u as an attachment, named after its Content-Disposition
+//or else its path
+func (c *AttachmentURLConfig) fetch(ctx context.Context, u *url.URL) (Attachment, error) {
+	fail := func(err error) (Attachment, error) {
+		return Attachment{}, &AttachmentFetchError{URL: redactURL(u), Err: err}
+	}
+	client := http.Client{
+		Timeout: c.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			return c.check(req.URL)
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			//the URL, query included, is reported already
+			err = urlErr.Err
+		}
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("server answered %s", resp.Status))
+	}
+	if resp.ContentLength > c.MaxBytes {
+		return fail(fmt.Errorf("document is larger than %d bytes", c.MaxBytes))
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.MaxBytes+1))
+	if err != nil {
+		return fail(err)
+	}
+	if int64(len(content)) > c.MaxBytes {
+		return fail(fmt.Errorf("document is larger than %d bytes", c.MaxBytes))
+	}
+
+	filename := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		filename = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = path.Base(resp.Request.URL.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "attachment"
+	}
+	return Attachment{
+		Filename:    filename,
+		ContentType: attachmentContentType(resp.Header.Get("Content-Type"), content),
+		Data:        content,
+	}, nil
+}
+
+//fetchAll adds the documents at urls to data.Attachments
+func (c *AttachmentURLConfig) fetchAll(ctx context.Context, urls []*url.URL, data *EmailSendRequest) error {
+	for _, u := range urls {
+		a, err := c.fetch(ctx, u)
+		if err != nil {
+			return err
+		}
+		data.Attachments = append(data.Attachments, a)
+	}
+	return nil
+}
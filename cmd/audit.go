@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+//auditLogger receives one JSON object per audited event
+var auditLogger = log.New(os.Stdout, "AUDIT: ", 0)
+
+//openAuditLog directs audit records to filename, appending to it
+func openAuditLog(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	auditLogger = log.New(f, "", 0)
+	return nil
+}
+
+//audit records event for the request with the given id. details are
+//added to the record as they are.
+func audit(event, requestID string, details map[string]interface{}) {
+	record := map[string]interface{}{
+		"time":      time.Now().UTC().Format(time.RFC3339Nano),
+		"event":     event,
+		"requestId": requestID,
+	}
+	for k, v := range details {
+		record[k] = v
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		errorLogger.Printf("Encoding audit record %v: %v", record, err)
+		return
+	}
+	auditLogger.Println(string(line))
+}
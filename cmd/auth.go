@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+//SMTP AUTH mechanisms, see SenderConfig.AuthMechanism
+const (
+	AuthPlain = "PLAIN"
+	AuthLogin = "LOGIN"
+)
+
+func validateAuthMechanism(mechanism string) error {
+	switch strings.ToUpper(mechanism) {
+	case "", AuthPlain, AuthLogin:
+		return nil
+	}
+	return fmt.Errorf("unknown SMTP auth mechanism %q", mechanism)
+}
+
+//auth returns the smtp.Auth for the configured mechanism, or nil if a
+//client certificate stands in for the password
+func (s *SenderConfig) auth() smtp.Auth {
+	if s.Password == "" && s.clientCert != nil {
+		//the relay authenticates us by certificate
+		return nil
+	}
+	if strings.ToUpper(s.AuthMechanism) == AuthLogin {
+		return &loginAuth{s.Address, s.Password, s.Host, 0}
+	}
+	return smtp.PlainAuth("", s.Address, s.Password, s.Host)
+}
+
+//loginAuth implements the LOGIN mechanism, which net/smtp lacks but some
+//servers (notably older Exchange) only offer
+type loginAuth struct {
+	username, password string
+	host               string
+	step               int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	//like PlainAuth, never send credentials in the clear to a remote host
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	advertised := false
+	for _, mechanism := range server.Auth {
+		if strings.ToUpper(mechanism) == AuthLogin {
+			advertised = true
+		}
+	}
+	if !advertised {
+		return "", nil, fmt.Errorf("server does not advertise AUTH LOGIN (offers %s)", strings.Join(server.Auth, " "))
+	}
+	a.step = 0
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	a.step++
+	switch {
+	case strings.Contains(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "pass"):
+		return []byte(a.password), nil
+	case a.step == 1:
+		return []byte(a.username), nil
+	case a.step == 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected AUTH LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
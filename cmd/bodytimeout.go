@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+type connKey struct{}
+
+//withConn is the http.Server's ConnContext, keeping the connection of a
+//request where limitBodyRead finds it
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+//limitBodyRead gives the client BodyReadTimeout to send the body of r,
+//within ReadTimeout. The returned function puts back the deadline of
+//ReadTimeout once the body was read.
+func (s *server) limitBodyRead(r *http.Request) func() {
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+	if s.config.BodyReadTimeout <= 0 || conn == nil {
+		return func() {}
+	}
+	//about when the http.Server's deadline runs out, it started reading
+	//the request a little earlier
+	var readDeadline time.Time
+	if s.config.ReadTimeout > 0 {
+		readDeadline = time.Now().Add(s.config.ReadTimeout)
+	}
+	deadline := time.Now().Add(s.config.BodyReadTimeout)
+	if !readDeadline.IsZero() && readDeadline.Before(deadline) {
+		deadline = readDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	return func() {
+		conn.SetReadDeadline(readDeadline)
+	}
+}
+
+//isReadTimeout reports whether err comes from the client not sending the
+//body in time
+func isReadTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
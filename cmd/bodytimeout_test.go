@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//TestSlowBody sends half a request body and stalls, which must get a 408
+//once BodyReadTimeout is over rather than hold on to the handler
+func TestSlowBody(t *testing.T) {
+	ts := newTestServer(t, ServerConfig{BodyReadTimeout: 200 * time.Millisecond}, func(EmailSendRequest) EmailSendOutcome { return EmailSendOutcome{} })
+	returned := make(chan struct{}, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ts.clientHandler(w, r)
+			returned <- struct{}{}
+		}),
+		ConnContext: withConn,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := "firstName=Ada&email=ada%40example.com"
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\n\r\n%s", len(body)+100, body)
+
+	started := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no answer to the stalled request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	if !resp.Close {
+		t.Error("the connection of the stalled request is kept open")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("answered after %v, want about BodyReadTimeout", elapsed)
+	}
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("the handler didn't return")
+	}
+	if n := ts.sentCount(); n != 0 {
+		t.Errorf("the incomplete request was sent %d times", n)
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+)
+
+//Bounce classes, see BounceReport.Class
+const (
+	//BounceHard means the address doesn't exist or can't receive mail
+	BounceHard = "hard"
+	//BounceSoft is any other refusal, which says nothing about the address
+	BounceSoft = "soft"
+)
+
+func init() {
+	metrics.describe("bounces_total", counterMetric, "Recipients refused by their server, by bounce class")
+}
+
+//DomainPolicy overrides how sends to some recipient domains are handled,
+//e.g. to retry longer with a flaky domain
+type DomainPolicy struct {
+	//Domains are domain names or path.Match patterns such as
+	//"*.example.com"
+	Domains []string `yaml:"Domains"`
+	//Retry, if set, replaces MailConfig.Retry for messages to the domains
+	Retry *RetryConfig `yaml:"Retry"`
+	//SuppressHardBounces, if set, overrides SuppressionConfig.HardBounces
+	SuppressHardBounces *bool `yaml:"SuppressHardBounces"`
+}
+
+//BounceReport describes how a recipient's server refused a message
+type BounceReport struct {
+	Recipient string
+	//Class is "hard" or "soft"
+	Class string
+	//Code is the SMTP reply code, Status the enhanced status code if the
+	//server sent one
+	Code   int
+	Status string `json:",omitempty"`
+	//Suppressed is set if the recipient was added to the suppression list
+	Suppressed bool
+}
+
+//validateDomainPolicies lower-cases the domains of policies and checks
+//their patterns
+func validateDomainPolicies(policies []DomainPolicy) error {
+	for i := range policies {
+		p := &policies[i]
+		if len(p.Domains) == 0 {
+			return fmt.Errorf("domain policy %d has no Domains", i+1)
+		}
+		for j, domain := range p.Domains {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if _, err := path.Match(domain, ""); err != nil || domain == "" {
+				return fmt.Errorf("domain policy %d: invalid domain %q", i+1, p.Domains[j])
+			}
+			p.Domains[j] = domain
+		}
+	}
+	return nil
+}
+
+//domainPolicy returns the first policy matching the domain of addr, nil if
+//none does
+func (m *MailConfig) domainPolicy(addr string) *DomainPolicy {
+	domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+	for i := range m.DomainPolicies {
+		for _, pattern := range m.DomainPolicies[i].Domains {
+			if ok, _ := path.Match(pattern, domain); ok {
+				return &m.DomainPolicies[i]
+			}
+		}
+	}
+	return nil
+}
+
+//retryFor returns the retry policy of a message to recipients, that of
+//their domain policy if they all share one that sets it
+func (m *MailConfig) retryFor(recipients []string) *RetryConfig {
+	if len(recipients) == 0 {
+		return &m.Retry
+	}
+	p := m.domainPolicy(recipients[0])
+	if p == nil || p.Retry == nil {
+		return &m.Retry
+	}
+	for _, rcpt := range recipients[1:] {
+		if m.domainPolicy(rcpt) != p {
+			return &m.Retry
+		}
+	}
+	return p.Retry
+}
+
+//suppressesHardBounces reports whether addr is suppressed when it hard
+//bounces on send
+func (m *MailConfig) suppressesHardBounces(addr string) bool {
+	if m.suppressions == nil {
+		return false
+	}
+	if p := m.domainPolicy(addr); p != nil && p.SuppressHardBounces != nil {
+		return *p.SuppressHardBounces
+	}
+	return m.Suppression.HardBounces
+}
+
+//enhancedStatusPattern matches the RFC 3463 status code a reply may start
+//with
+var enhancedStatusPattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+//classifyReply returns the bounce class of an SMTP reply, "" if it isn't
+//a refusal. Only permanent replies about the address itself are hard:
+//5.1.x (bad mailbox or domain), 5.2.1 (mailbox disabled) or, without an
+//enhanced status, 550, 551 and 553. Policy, content and size rejections
+//are soft, they would hit any address.
+func classifyReply(code int, msg string) (class, status string) {
+	status = enhancedStatusPattern.FindString(msg)
+	switch {
+	case code < 400:
+		return "", status
+	case code < 500:
+		return BounceSoft, status
+	case status != "":
+		if strings.HasPrefix(status, "5.1.") || status == "5.2.1" {
+			return BounceHard, status
+		}
+	case code == 550 || code == 551 || code == 553:
+		return BounceHard, status
+	}
+	return BounceSoft, status
+}
+
+//bounceOf classifies the refusal of addr in err, the error of a send to
+//it. It returns nil if the server didn't refuse addr, e.g. as it couldn't
+//be reached.
+func bounceOf(addr string, err error) *BounceReport {
+	var rejErr *rejectedRecipientsError
+	if errors.As(err, &rejErr) {
+		if rcptErr, ok := rejErr.rejected[addr]; ok {
+			err = rcptErr
+		}
+	}
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return nil
+	}
+	class, status := classifyReply(tpErr.Code, tpErr.Msg)
+	if class == "" {
+		return nil
+	}
+	return &BounceReport{Recipient: addr, Class: class, Code: tpErr.Code, Status: status}
+}
+
+//recordBounce classifies the refusal of addr in err and suppresses addr
+//if it hard bounced and the policy says so. It returns nil if addr wasn't
+//refused.
+func (m *MailConfig) recordBounce(req *EmailSendRequest, addr string, err error) *BounceReport {
+	b := bounceOf(addr, err)
+	if b == nil {
+		return nil
+	}
+	metrics.inc("bounces_total", "class", b.Class)
+	if b.Class != BounceHard || !m.suppressesHardBounces(addr) {
+		return b
+	}
+	added, err := m.suppressions.add(addr)
+	if err != nil {
+		errorLogger.Printf("Suppressing %s: %v", addr, err)
+		return b
+	}
+	b.Suppressed = true
+	if added {
+		infoLogger.Printf("Suppressing %s after request %s hard bounced (%d %s)", addr, req.ID, b.Code, b.Status)
+		audit("address_suppressed", req.ID, map[string]interface{}{"address": addr, "code": b.Code, "status": b.Status})
+	}
+	return b
+}
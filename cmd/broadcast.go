@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//sharesContent reports whether every recipient would get the same message,
+//so it can be sent to all of them at once
+func sharesContent(recipients map[string]Recipient, tracking *TrackingConfig, html []byte) bool {
+	if html != nil && tracking != nil {
+		return false
+	}
+	for _, r := range recipients {
+		if r.Header != nil || (html != nil && r.singlePart()) {
+			return false
+		}
+	}
+	return true
+}
+
+//broadcast sends a single message addressed to all recipients, in as few
+//SMTP transactions as MaxRecipientsPerMessage allows. Recipients the server
+//refuses don't fail the others; greylisted ones are deferred.
+func (m *MailConfig) broadcast(ctx context.Context, req *EmailSendRequest, recipients map[string]Recipient, text, html []byte) ([]DeliveryReport, []string, []BounceReport, int, error) {
+	to := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		to = append(to, r.Address)
+	}
+	sort.Strings(to)
+
+	id := m.identities.brand(req.Brand)
+	if id == nil {
+		id = m.identities.pick(strings.Join(to, ","))
+	}
+	header := m.messageHeader(req, &m.Header, id)
+	msg, err := m.buildMessage(&header, strings.Join(to, ", "), text, html, req.Attachments)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	m.debugLog(req, &header, strings.Join(to, ", "), text, html)
+
+	limit := m.maxRecipients()
+	batches := (len(to) + limit - 1) / limit
+	status := make(map[string]string)
+	timings := make(map[string]DeliveryTimings)
+	failed := make(map[string]error)
+	//refused holds the recipients the server rejected on their own, as
+	//opposed to their whole batch failing
+	refused := make(map[string]bool)
+	for i := 0; i < batches; i++ {
+		end := (i + 1) * limit
+		if end > len(to) {
+			end = len(to)
+		}
+		batch := to[i*limit : end]
+		m.pace(i)
+		var t DeliveryTimings
+		started := time.Now()
+		sendCtx, deliverSpan := startSpan(withTimings(ctx, &t), "deliver")
+		tlsStatus, err := m.sendVia(sendCtx, id, "", batch, msg)
+		recordPhase(sendCtx, phaseTotal, started)
+		deliverSpan.finish(err)
+		var rejErr *rejectedRecipientsError
+		if errors.As(err, &rejErr) {
+			for addr, rcptErr := range rejErr.rejected {
+				failed[addr] = rcptErr
+				refused[addr] = true
+			}
+		} else if err != nil {
+			if batches > 1 {
+				err = fmt.Errorf("batch %d/%d: %w", i+1, batches, err)
+			}
+			for _, addr := range batch {
+				failed[addr] = err
+			}
+			continue
+		}
+		for _, addr := range batch {
+			if failed[addr] == nil {
+				status[addr] = tlsStatus
+				timings[addr] = t
+			}
+		}
+	}
+
+	var deliveries []DeliveryReport
+	var deferred []string
+	var bounces []BounceReport
+	var firstErr error
+	rejected := make(map[string]error)
+	for _, addr := range to {
+		err := failed[addr]
+		if err != nil && m.deferred != nil && isGreylisted(err) {
+			infoLogger.Printf("Request %s greylisted by %s, retrying later: %v", req.ID, addr, err)
+			err = m.deferred.schedule(&deferredDelivery{
+				RequestID: req.ID,
+				Recipient: addr,
+				Subject:   header.Subject,
+				MessageID: header.MessageID,
+				Message:   msg,
+				Sender:    id.address(),
+			})
+			if err == nil {
+				deferred = append(deferred, addr)
+				continue
+			}
+			refused[addr] = false
+		}
+		m.sentLog.record(req.ID, addr, header.Subject, header.MessageID, status[addr], err)
+		if b := m.recordBounce(req, addr, err); b != nil {
+			bounces = append(bounces, *b)
+		}
+		switch {
+		case err == nil:
+			deliveries = append(deliveries, DeliveryReport{Recipient: addr, TLS: status[addr], MessageID: header.MessageID, Sender: id.address(), Timings: timings[addr]})
+		case refused[addr]:
+			rejected[addr] = err
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil && len(rejected) > 0 {
+		firstErr = &rejectedRecipientsError{rejected}
+	}
+	return deliveries, deferred, bounces, batches, firstErr
+}
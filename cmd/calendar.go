@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCalendarMethod   = "REQUEST"
+	defaultCalendarFilename = "invite.ics"
+	//icsLineLength is the longest content line RFC 5545 allows, in octets
+	icsLineLength = 75
+	icsTimeLayout = "20060102T150405Z"
+)
+
+//CalendarConfig adds a calendar invite to messages, e.g. for a demo
+//request. Template renders the iCalendar object with the same data as the
+//body, the fields of the event usually coming from the request's data. A
+//template rendering to nothing but whitespace sends no invite, so it can
+//leave out requests without a date.
+type CalendarConfig struct {
+	Template string `yaml:"Template"`
+	//Method is the iTIP method, "REQUEST" by default, or "PUBLISH" or
+	//"CANCEL"
+	Method string `yaml:"Method"`
+	//Filename is the name of the attached invite, "invite.ics" by default
+	Filename string `yaml:"Filename"`
+}
+
+func (c *CalendarConfig) validate() error {
+	if strings.TrimSpace(c.Template) == "" {
+		return errors.New("the calendar invite needs a Template")
+	}
+	c.Method = strings.ToUpper(c.Method)
+	switch c.Method {
+	case "":
+		c.Method = defaultCalendarMethod
+	case "REQUEST", "PUBLISH", "CANCEL":
+	default:
+		return fmt.Errorf("unknown calendar method %q", c.Method)
+	}
+	if c.Filename == "" {
+		c.Filename = defaultCalendarFilename
+	}
+	return nil
+}
+
+//calendarFuncs help build the iCalendar object in Go templates:
+//
+//	icsTime    formats a time, or an RFC 3339 string, as a UTC date-time
+//	icsNow     is the current time as icsTime formats it, for DTSTAMP
+//	icsText    escapes a value for a TEXT property such as SUMMARY
+var calendarFuncs = template.FuncMap{
+	"icsTime": icsTime,
+	"icsNow":  func() string { return time.Now().UTC().Format(icsTimeLayout) },
+	"icsText": icsText,
+}
+
+func icsTime(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+		if err != nil {
+			return "", err
+		}
+		return t.UTC().Format(icsTimeLayout), nil
+	}
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(icsTimeLayout), nil
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func icsText(v interface{}) string {
+	return icsTextEscaper.Replace(toString(v))
+}
+
+//calendarTemplate is the compiled CalendarConfig
+type calendarTemplate struct {
+	template templateExecutor
+	method   string
+	filename string
+}
+
+//parseCalendar compiles the invite template into t
+func (t *templateSet) parseCalendar(calendar *CalendarConfig) error {
+	if calendar == nil {
+		return nil
+	}
+	if err := calendar.validate(); err != nil {
+		return err
+	}
+	funcs := template.FuncMap{}
+	for name, f := range t.funcs {
+		funcs[name] = f
+	}
+	for name, f := range calendarFuncs {
+		funcs[name] = f
+	}
+	executor, err := parseTemplate(t.engine, funcs, "Calendar", calendar.Template, false)
+	if err != nil {
+		return err
+	}
+	t.calendar = &calendarTemplate{template: executor, method: calendar.Method, filename: calendar.Filename}
+	return nil
+}
+
+//renderInvite renders the calendar invite of templates for req as an
+//attachment, nil if there is no invite to send
+func (m *MailConfig) renderInvite(templates *templateSet, req *EmailSendRequest) (*Attachment, error) {
+	if templates.calendar == nil {
+		return nil, nil
+	}
+	rendered, err := m.Limits.render("calendar invite", templates.calendar.template, req)
+	if err != nil || len(bytes.TrimSpace(rendered)) == 0 {
+		return nil, err
+	}
+	ics, err := formatICS(rendered, templates.calendar.method)
+	if err != nil {
+		return nil, renderError("calendar invite", err)
+	}
+	return &Attachment{
+		Filename:    templates.calendar.filename,
+		ContentType: mime.FormatMediaType("text/calendar", map[string]string{"charset": "utf-8", "method": templates.calendar.method}),
+		Data:        ics,
+	}, nil
+}
+
+//formatICS turns the rendered template into content lines as RFC 5545
+//has them: CRLF terminated, folded at 75 octets, without blank lines. The
+//METHOD property has to match the one in the Content-Type for clients to
+//take the object as an invite, it's added if the template left it out.
+func formatICS(rendered []byte, method string) ([]byte, error) {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(string(rendered), "\r\n", "\n", -1), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("the invite doesn't start with BEGIN:VCALENDAR")
+	}
+	hasMethod := false
+	for _, line := range lines {
+		if value := strings.TrimPrefix(strings.ToUpper(line), "METHOD:"); len(value) < len(line) {
+			if value != method {
+				return nil, fmt.Errorf("the invite has METHOD:%s, not %s", value, method)
+			}
+			hasMethod = true
+		}
+	}
+	if !hasMethod {
+		lines = append(lines[:1], append([]string{"METHOD:" + method}, lines[1:]...)...)
+	}
+	buf := new(bytes.Buffer)
+	for _, line := range lines {
+		foldICSLine(buf, line)
+	}
+	return buf.Bytes(), nil
+}
+
+//foldICSLine writes line to buf, folded by CRLF and a space wherever it
+//would run past icsLineLength octets, never inside a UTF-8 sequence
+func foldICSLine(buf *bytes.Buffer, line string) {
+	limit := icsLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		//the leading space counts towards the length
+		limit = icsLineLength - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+//inviteMethod returns the iTIP method of an attachment that is a calendar
+//invite, "" for any other attachment
+func inviteMethod(a Attachment) string {
+	mediaType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil || mediaType != "text/calendar" {
+		return ""
+	}
+	return params["method"]
+}
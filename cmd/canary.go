@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"time"
+)
+
+const (
+	defaultCanaryMinInterval = time.Hour
+	defaultCanaryTimeout     = time.Minute
+)
+
+//CanaryConfig sends a canary message at startup, rendered with the
+//templates and sent like any request but only to Address, proving the
+//whole pipeline works after a deploy
+type CanaryConfig struct {
+	Address string `yaml:"Address"`
+	//FailStartup refuses to start if the canary can't be sent, otherwise
+	//the failure is only logged
+	FailStartup bool `yaml:"FailStartup"`
+	//MinInterval skips the canary if the last one went out more recently,
+	//an hour by default, so restarts in a row don't flood Address
+	MinInterval time.Duration `yaml:"MinInterval"`
+	//StateFile keeps when the last canary was sent
+	StateFile string `yaml:"StateFile"`
+	//Timeout bounds the wait for the canary to be sent, a minute by
+	//default
+	Timeout time.Duration `yaml:"Timeout"`
+}
+
+//canaryState is the content of the state file
+type canaryState struct {
+	Sent time.Time `json:"sent"`
+}
+
+func (c *CanaryConfig) validate() error {
+	addr, err := mail.ParseAddress(c.Address)
+	if err == nil {
+		err = validateDomain(addr.Address)
+	}
+	if err != nil {
+		return fmt.Errorf("canary address: %w", err)
+	}
+	c.Address = addr.Address
+	if c.StateFile == "" {
+		return errors.New("the canary needs a StateFile")
+	}
+	if c.MinInterval <= 0 {
+		c.MinInterval = defaultCanaryMinInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultCanaryTimeout
+	}
+	return nil
+}
+
+//due reports whether MinInterval passed since the last canary
+func (c *CanaryConfig) due(now time.Time) (bool, error) {
+	content, err := ioutil.ReadFile(c.StateFile)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var state canaryState
+	if err = json.Unmarshal(content, &state); err != nil {
+		return false, fmt.Errorf("reading %s: %w", c.StateFile, err)
+	}
+	return now.Sub(state.Sent) >= c.MinInterval, nil
+}
+
+//send queues a canary request and waits for it to be delivered. The
+//attempt counts against MinInterval whether it succeeds or not.
+func (c *CanaryConfig) send(queue requestQueue) error {
+	now := time.Now()
+	due, err := c.due(now)
+	if err != nil {
+		return err
+	}
+	if !due {
+		infoLogger.Printf("Skipping the canary, the last one was sent less than %s ago", c.MinInterval)
+		return nil
+	}
+	content, err := json.Marshal(canaryState{Sent: now})
+	if err == nil {
+		err = ioutil.WriteFile(c.StateFile, content, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("saving canary state: %w", err)
+	}
+
+	req := healthCheckRequest
+	req.ID = newRequestID()
+	req.Description = "Canary message sent at startup"
+	req.Data = map[string]interface{}{"canary": true}
+	req.TokenRecipient = &Recipient{Name: "Canary", Address: c.Address}
+	result := make(chan EmailSendOutcome, 1)
+	req.Result = result
+	queue.enqueue(req)
+
+	var outcome EmailSendOutcome
+	select {
+	case outcome = <-result:
+	case <-time.After(c.Timeout):
+		return fmt.Errorf("the canary was not sent within %s", c.Timeout)
+	}
+	switch {
+	case outcome.Error != nil:
+		return outcome.Error
+	case outcome.Queued:
+		return errors.New("sending is paused")
+	case outcome.Suppressed:
+		return errors.New("the canary address is suppressed")
+	case len(outcome.Deliveries) == 0:
+		return errors.New("the canary was not delivered, its address is deferred")
+	}
+	infoLogger.Printf("Canary %s sent to %s in %s", req.ID, c.Address, outcome.Elapsed)
+	return nil
+}
+
+//run sends the canary, returning its error only with FailStartup. Without
+//it the canary is sent in the background.
+func (c *CanaryConfig) run(queue requestQueue) error {
+	if c.FailStartup {
+		return c.send(queue)
+	}
+	go func() {
+		if err := c.send(queue); err != nil {
+			errorLogger.Printf("Sending the canary: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamAVTimeout = 30 * time.Second
+	//clamAVChunkSize stays well below clamd's default StreamMaxLength
+	clamAVChunkSize = 64 << 10
+)
+
+//ClamAVConfig points to a clamd that scans every attachment before it is
+//sent. Address is host:port, or the path of a unix socket.
+type ClamAVConfig struct {
+	Address string        `yaml:"Address"`
+	Timeout time.Duration `yaml:"Timeout"`
+}
+
+func init() {
+	metrics.describe("attachment_scans_total", counterMetric, "Attachments scanned by result")
+}
+
+//ThreatError is returned for an attachment the scanner flagged
+type ThreatError struct {
+	Filename  string
+	Signature string
+}
+
+func (e *ThreatError) Error() string {
+	return fmt.Sprintf("attachment %q contains %s", e.Filename, e.Signature)
+}
+
+//scan streams data to clamd with INSTREAM and returns the signature it
+//found, or "" if the data is clean
+func (c *ClamAVConfig) scan(data []byte) (string, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultClamAVTimeout
+	}
+	network := "tcp"
+	if strings.HasPrefix(c.Address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > clamAVChunkSize {
+			chunk = chunk[:clamAVChunkSize]
+		}
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		w.Write(size)
+		w.Write(chunk)
+		data = data[len(chunk):]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	//"stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	result := string(bytes.TrimRight(reply, "\x00\n"))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", result)
+}
+
+//scanAttachments scans the attachments of req, returning a ThreatError
+//for the first infected one
+func (c *ClamAVConfig) scanAttachments(req *EmailSendRequest) error {
+	for _, a := range req.Attachments {
+		signature, err := c.scan(a.Data)
+		if err != nil {
+			metrics.inc("attachment_scans_total", "result", "error")
+			return fmt.Errorf("scanning attachment %q: %w", a.Filename, err)
+		}
+		if signature != "" {
+			metrics.inc("attachment_scans_total", "result", "infected")
+			audit("threat_detected", req.ID, map[string]interface{}{
+				"attachment": a.Filename,
+				"signature":  signature,
+				"ipAddress":  req.IPAddress,
+			})
+			return &ThreatError{a.Filename, signature}
+		}
+		metrics.inc("attachment_scans_total", "result", "clean")
+	}
+	return nil
+}
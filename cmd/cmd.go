@@ -1,18 +1,27 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
-	"net/smtp"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 
+	"golang.org/x/sync/semaphore"
 	"gopkg.in/yaml.v2"
 )
 
@@ -23,7 +32,24 @@ var (
 )
 
 const (
-	helpMsgConfigFile string = "config file path"
+	helpMsgConfigFile    string = "config file path, - for stdin or an http(s) URL"
+	helpMsgConfigTimeout string = "timeout for fetching a config URL"
+	helpMsgConfigHeader  string = "header sent when fetching a config URL, as \"Name: value\" (default $CONFIG_HEADER)"
+	helpMsgConfigCache   string = "file the config fetched from a URL is cached in, for when it can't be fetched"
+	helpMsgStrict        string = "refuse to start on config warnings, such as an empty Subject"
+
+	//defaultMultipartMaxMemory is used when ServerConfig.MultipartMaxMemory
+	//is unset
+	defaultMultipartMaxMemory int64 = 10 << 20
+	//defaultMaxRequestBytes is used when ServerConfig.MaxRequestBytes is unset
+	defaultMaxRequestBytes int64 = 32 << 20
+
+	//defaults of the http.Server settings in ServerConfig
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	//the default WriteTimeout is this much longer than RequestTimeout
+	defaultWriteTimeoutMargin = time.Minute
 )
 
 //Config unites all following configs into a single type
@@ -32,9 +58,132 @@ type MailConfig struct {
 	Recipients   map[string]Recipient `yaml:"Recipients"`
 	Header       Header               `yaml:"Header"`
 	TemplateText string               `yaml:"TemplateText"`
+	//HTMLTemplateText, if set, is sent as an HTML alternative to TemplateText
+	HTMLTemplateText string `yaml:"HTMLTemplateText"`
+	//AllowedRecipients, if set, are the only addresses the body templates
+	//may be sent to, as patterns like "*@example.com". Requests routed
+	//anywhere else fail. It's reloaded along with the templates.
+	AllowedRecipients []string `yaml:"AllowedRecipients"`
+	//TemplateEngine is "go" (default) for Go templates, or "mustache". It
+	//applies to all templates, which get the same data either way.
+	TemplateEngine string `yaml:"TemplateEngine"`
+	//TemplateFunctions, if set, gives Go templates string, math, date,
+	//list and dictionary functions, see templateFunctions
+	TemplateFunctions *TemplateFunctionsConfig `yaml:"TemplateFunctions"`
+	//Footer, if set, is added to every message body
+	Footer *FooterConfig `yaml:"Footer"`
+	//Calendar, if set, adds a calendar invite to every message
+	Calendar *CalendarConfig `yaml:"Calendar"`
+	//AttachSubmission attaches the submitted fields to every message, as
+	//submission-<id>.json
+	AttachSubmission bool `yaml:"AttachSubmission"`
+	//HTMLFailureMode is "fail" (default) to reject requests whose HTML body
+	//fails to render, or "degrade" to send them as plain text only
+	HTMLFailureMode string `yaml:"HTMLFailureMode"`
+	//ForcePlainText sends only the plain text body, even with HTMLTemplateText
+	ForcePlainText bool          `yaml:"ForcePlainText"`
+	Limits         MessageLimits `yaml:"Limits"`
+	Retry          RetryConfig   `yaml:"Retry"`
+	CircuitBreaker BreakerConfig `yaml:"CircuitBreaker"`
+	//ConnectRetry retries sends whose server can't be reached at all
+	//within a single Retry attempt. Connections are only made once there
+	//is something to send, so a relay starting after us is waited for;
+	//VerifyOnStartup is the explicit check for it being up.
+	ConnectRetry RetryConfig `yaml:"ConnectRetry"`
+	//Failover servers are tried in order when Sender is unavailable
+	Failover []SenderConfig `yaml:"Failover"`
+	//MaxRecipientsPerMessage caps RCPTs per SMTP transaction, larger
+	//recipient sets are split into several transactions. Defaults to 100.
+	MaxRecipientsPerMessage int `yaml:"MaxRecipientsPerMessage"`
+	//SingleTransaction sends one message addressed to all recipients when
+	//they would all get the same content. Recipients see each other in the
+	//To header.
+	SingleTransaction bool `yaml:"SingleTransaction"`
+	//RecipientDelay spaces out the messages of a request, or its
+	//transactions under SingleTransaction. Only the worker sending the
+	//request waits, so RequestTimeout should cover the whole drip.
+	RecipientDelay time.Duration `yaml:"RecipientDelay"`
+	//MaxConcurrentSends caps the sends in flight regardless of the number
+	//of workers, 0 means no cap. A transaction to several recipients
+	//counts as a send per recipient, up to the cap.
+	MaxConcurrentSends int `yaml:"MaxConcurrentSends"`
+	//SendTimeout bounds a whole send attempt, from connecting to the end
+	//of DATA, 0 means no limit
+	SendTimeout time.Duration `yaml:"SendTimeout"`
+	//VerifyOnStartup connects and authenticates to the SMTP servers at
+	//startup, refusing to start if that fails
+	VerifyOnStartup bool `yaml:"VerifyOnStartup"`
+	//Archive, if set, receives a copy of every message
+	Archive *ArchiveConfig `yaml:"Archive"`
+	//RecipientSource, if set, periodically replaces Recipients
+	RecipientSource *RecipientSourceConfig `yaml:"RecipientSource"`
+	//Tracking, if set, adds open and click tracking to HTML bodies
+	Tracking *TrackingConfig `yaml:"Tracking"`
+	//SMIME, if set, signs every message
+	SMIME *SMIMEConfig `yaml:"SMIME"`
+	//PGP, if set, encrypts the messages of recipients with a PGP key
+	PGP *PGPConfig `yaml:"PGP"`
+	//Warmup, if set, caps the messages sent per day on a ramp
+	Warmup *WarmupConfig `yaml:"Warmup"`
+	//Tagging, if set, forwards the category and tags of requests to the
+	//provider
+	Tagging *TaggingConfig `yaml:"Tagging"`
+	//Greylist, if set, retries greylisted recipients after a delay
+	Greylist *GreylistConfig `yaml:"Greylist"`
+	//ManagerLookup, if set, BCCs each submitter's manager
+	ManagerLookup *ManagerLookupConfig `yaml:"ManagerLookup"`
+	//DebugLog, if set, logs every rendered message. It may contain PII.
+	DebugLog *DebugLogConfig `yaml:"DebugLog"`
+	//Routing, if set, picks a single recipient for each request
+	Routing *RoutingConfig `yaml:"Routing"`
+	//RecipientSelection, if set, lets requests pick their recipients
+	RecipientSelection *RecipientSelectionConfig `yaml:"RecipientSelection"`
+	//VERP, if set, gives every recipient its own envelope sender
+	VERP *VERPConfig `yaml:"VERP"`
+	//Suppression, if set, skips recipients that hard bounced
+	Suppression *SuppressionConfig `yaml:"Suppression"`
+	//SubjectPrefix is put in front of every Subject and Environment, if
+	//set, is sent in an X-Environment header, e.g. "[STAGING] " and
+	//"staging" so test messages can't pass for production ones
+	SubjectPrefix string `yaml:"SubjectPrefix"`
+	Environment   string `yaml:"Environment"`
+	//AllowedFromDomains, if set, are the only domains messages may be sent
+	//from in the From header, as names or path.Match patterns such as
+	//"*.example.com". Config From addresses are checked at startup and
+	//every message before it's sent.
+	AllowedFromDomains []string `yaml:"AllowedFromDomains"`
+	//Notifiers are told of the outcome of every request, e.g. to page on
+	//failures
+	Notifiers []NotifierConfig `yaml:"Notifiers"`
+	//DomainPolicies override the retry and suppression of recipients by
+	//domain, the first matching one applies
+	DomainPolicies []DomainPolicy `yaml:"DomainPolicies"`
 
-	//template can contain whatever is in struct EmailSendRequest
-	template *template.Template
+	//templates can contain whatever is in struct EmailSendRequest
+	templates     *templateStore
+	templateFuncs template.FuncMap
+	recipients    *recipientStore
+	sentLog       *sentLog
+	signer        *smimeSigner
+	pgp           *pgpEncryptor
+	warmup        *warmupLimiter
+	relays        []*relay
+	deferred      *deferredQueue
+	managers      *managerDirectory
+	sendSlots     *semaphore.Weighted
+	//suppressions is the suppression list, if enabled
+	suppressions *suppressionList
+	//maxQueueAge and deadLetters are set from the server's QueueConfig
+	maxQueueAge time.Duration
+	deadLetters *deadLetterFile
+	//identities picks the sender identity of each message, if configured
+	identities *identityPicker
+	//fromDomains are the AllowedFromDomains
+	fromDomains recipientAllowlist
+	notifiers   *notifierChain
+	//sendsInFlight counts the sends in progress, see /stats. It's shared by
+	//the copies of the config the server and the workers hold.
+	sendsInFlight *int32
 }
 
 //SenderConfig describes from who and which host we should
@@ -45,6 +194,43 @@ type SenderConfig struct {
 	Address  string `yaml:"SenderAddress"`
 	Name     string `yaml:"SenderName"`
 	Password string `yaml:"SenderPassword"`
+	//DirectDelivery sends straight to the recipients' MX hosts instead of
+	//through the server above
+	DirectDelivery bool `yaml:"DirectDelivery"`
+	//TLSPolicy is one of "required", "opportunistic" (default) or "none".
+	//Opportunistic uses STARTTLS if the server offers it. If the handshake
+	//fails so does the send, except with DirectDelivery, which then sends
+	//in plaintext.
+	TLSPolicy string `yaml:"TLSPolicy"`
+	//ClientCertificateFile and ClientKeyFile are a PEM certificate and key
+	//presented to the server during STARTTLS. Without a password the
+	//certificate is the only authentication.
+	ClientCertificateFile string `yaml:"ClientCertificateFile"`
+	ClientKeyFile         string `yaml:"ClientKeyFile"`
+	//AuthMechanism is "PLAIN" (default) or "LOGIN"
+	AuthMechanism string `yaml:"AuthMechanism"`
+	//Backend is "smtp" (default), "ses" or "sendmail". The latter two send
+	//through the SES API or a local binary with the settings below instead
+	//of an SMTP server.
+	Backend  string         `yaml:"Backend"`
+	SES      *SESConfig     `yaml:"SES"`
+	Sendmail SendmailConfig `yaml:"Sendmail"`
+	//Identities, if set, are the addresses messages are sent from in
+	//turn, each setting the From header, envelope sender and credentials.
+	//IdentitySelection is "round-robin" (default) or "hash", which always
+	//sends a recipient's messages as the same identity.
+	Identities        []SenderIdentity `yaml:"Identities"`
+	IdentitySelection string           `yaml:"IdentitySelection"`
+	//Brands are identities a request picks by key with fromBrand, instead
+	//of one of the Identities
+	Brands map[string]SenderIdentity `yaml:"Brands"`
+	//DisablePipelining sends MAIL, RCPT and DATA one at a time even to
+	//servers offering PIPELINING, which otherwise get them all at once
+	DisablePipelining bool `yaml:"DisablePipelining"`
+
+	clientCert *tls.Certificate
+	//sessionCache lets connections to the server resume TLS sessions
+	sessionCache tls.ClientSessionCache
 }
 
 //Header is the email header.
@@ -54,6 +240,18 @@ type Header struct {
 	Subject       string `yaml:"Subject"`
 	MIME          string `yaml:"MIME"`
 	Miscellaneous string `yaml:"Miscellaneous"`
+	//ReplyTo, if set, is sent as the Reply-To header
+	ReplyTo string `yaml:"ReplyTo"`
+
+	//Date, MessageID, InReplyTo and References are set per message
+	Date       time.Time `yaml:"-"`
+	MessageID  string    `yaml:"-"`
+	InReplyTo  string    `yaml:"-"`
+	References []string  `yaml:"-"`
+	//Environment is sent as X-Environment, see MailConfig.Environment
+	Environment string `yaml:"-"`
+	//Tags are the provider tagging fields, see MailConfig.Tagging
+	Tags []tagHeader `yaml:"-"`
 }
 
 //Recipient is a person who receives an email. Parameters here
@@ -63,9 +261,18 @@ type Recipient struct {
 	Title         string      `yaml:"Title"`
 	Address       string      `yaml:"Address"`
 	Miscellaneous interface{} `yaml:"Miscellaneous"`
+	//ForcePlainText sends this recipient only the plain text body
+	ForcePlainText bool `yaml:"ForcePlainText"`
+	//ContentPreference is "both" (default) for a multipart/alternative
+	//message, or "text" or "html" to send only that body
+	ContentPreference string `yaml:"ContentPreference"`
+	//Header overrides the global header for this recipient
+	Header *HeaderOverride `yaml:"Header"`
 }
 
 type EmailSendRequest struct {
+	ID            string
+	Priority      Priority
 	IPAddress     string
 	FirstName     string
 	LastName      string
@@ -75,34 +282,248 @@ type EmailSendRequest struct {
 	CompanyName   string
 	EmailAddress  string
 	Description   string
-	Result        chan<- EmailSendOutcome
+	InReplyTo     string
+	References    []string
+	Data          map[string]interface{} //the JSON object of the "data" field
+	Attachments   []Attachment
+	Result        chan<- EmailSendOutcome `json:"-"`
+	//Done is closed once nobody waits on Result anymore
+	Done <-chan struct{} `json:"-"`
+	//Recipient, if set, is the key of the only recipient to send to. Only
+	//admins may set it, for test sends.
+	Recipient string
+	//EnqueuedAt is when the request was put in the queue
+	EnqueuedAt time.Time
+	//Brand, if set, is the key of the SenderConfig.Brands identity to send
+	//as
+	Brand string
+	//TokenRecipient, if set, is the only recipient to send to, from a
+	//verified recipientToken
+	TokenRecipient *Recipient `json:",omitempty"`
+	//Category and Tags are forwarded to the provider, see
+	//MailConfig.Tagging
+	Category string   `json:",omitempty"`
+	Tags     []string `json:",omitempty"`
+	//Recipients, if set, are the keys of the recipients the request picked,
+	//see MailConfig.RecipientSelection
+	Recipients []string `json:",omitempty"`
+	//TraceParent links the send into the trace of the request, see
+	//TracingConfig
+	TraceParent string `json:",omitempty"`
+	//ResultQueue is the Redis list its outcome goes back to, that of the
+	//instance that queued it, see RedisQueueConfig
+	ResultQueue string `json:",omitempty"`
+	//digest is set on a digest of other requests, see DigestConfig
+	digest *digestBatch
+	//span covers sending the request, it's finished with the reply
+	span *span
+}
+
+//abandoned reports whether the requester stopped waiting for the outcome
+func (r *EmailSendRequest) abandoned() bool {
+	select {
+	case <-r.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+//requestsSent and requestsFailed count outcomes since startup, see /stats
+var requestsSent, requestsFailed int64
+
+//reply hands the outcome to the requester, unless it stopped waiting, and
+//returns it as handed over
+func (r *EmailSendRequest) reply(outcome EmailSendOutcome) EmailSendOutcome {
+	if outcome.Error != nil {
+		sendErr := newSendError(outcome.Error)
+		metrics.inc("email_send_failures_total", "category", string(sendErr.Category))
+		outcome.Error = sendErr
+		atomic.AddInt64(&requestsFailed, 1)
+	} else {
+		atomic.AddInt64(&requestsSent, 1)
+	}
+	select {
+	case r.Result <- outcome:
+	case <-r.Done:
+		infoLogger.Printf("Request %s was abandoned before its outcome (error: %v) was ready", r.ID, outcome.Error)
+	}
+	return outcome
 }
 
 type EmailSendOutcome struct {
-	Error error
+	//Error, if sending failed, is a *SendError
+	Error      error
+	Deliveries []DeliveryReport
+	//Deferred lists recipients that greylisted the message, delivery to
+	//them is retried later
+	Deferred []string
+	//Batches is the number of SMTP transactions used
+	Batches int
+	//Queued is set if the request was only queued as sending is paused
+	Queued bool
+	//Degraded is set if the HTML body failed to render and the message was
+	//sent as plain text only, see MailConfig.HTMLFailureMode
+	Degraded bool
+	//Digest is set, along with Queued, if the request waits for the next
+	//digest
+	Digest bool
+	//Elapsed is how long sending to the recipients took
+	Elapsed time.Duration
+	//Bounces lists the recipients whose server refused the message
+	Bounces []BounceReport
+	//Suppressed is set if nothing was sent as every recipient is
+	//suppressed, see SuppressionConfig
+	Suppressed bool
+}
+
+//DeliveryReport describes how a message was handed over for one recipient
+type DeliveryReport struct {
+	Recipient string
+	//TLS is the negotiated TLS version, or "none" for plaintext
+	TLS string
+	//MessageID is the Message-ID the message was sent with, for replies
+	//to thread under it
+	MessageID string
+	//Sender is the address of the identity the message was sent as, if
+	//SenderConfig.Identities is set
+	Sender string
+	//Timings is how long sending took by phase. Recipients sharing a
+	//message share the timings of its transaction.
+	Timings DeliveryTimings
 }
 
 type ServerConfig struct {
 	Address string `yaml:"Address"`
 	BaseURL string `yaml:"BaseURL"`
+	//NotFoundMessage is the body of 404 responses to unknown paths, which
+	//are logged at debug level with LogNotFound
+	NotFoundMessage string `yaml:"NotFoundMessage"`
+	LogNotFound     bool   `yaml:"LogNotFound"`
+	//MetricsPath is where metrics are served, empty disables them
+	MetricsPath string `yaml:"MetricsPath"`
+	//AdminToken is the bearer token protecting the admin endpoints, which
+	//are disabled while it's empty
+	AdminToken string `yaml:"AdminToken"`
+	//SentLogSize is how many recent sends /sent keeps, 0 disables it
+	SentLogSize int `yaml:"SentLogSize"`
+	//AuditLogFile receives audit records, stdout is used if it's empty
+	AuditLogFile string `yaml:"AuditLogFile"`
+	//Workers is the number of concurrent emailer instances, 1 by default
+	Workers int         `yaml:"Workers"`
+	Queue   QueueConfig `yaml:"Queue"`
+	//Storage records every request and its outcome
+	Storage StorageConfig `yaml:"Storage"`
+	//MaxRequestBytes caps the size of a request body, attachments included
+	MaxRequestBytes int64 `yaml:"MaxRequestBytes"`
+	//MultipartMaxMemory is how much of a multipart form is kept in memory,
+	//the rest is stored in temporary files removed after the request
+	MultipartMaxMemory int64 `yaml:"MultipartMaxMemory"`
+	//RequestTimeout bounds how long a request waits for its email to be
+	//sent, 0 waits until the client goes away
+	RequestTimeout time.Duration `yaml:"RequestTimeout"`
+	//Dedup, if set, suppresses duplicate submissions
+	Dedup *DedupConfig `yaml:"Dedup"`
+	//VirusScan, if set, rejects requests with infected attachments
+	VirusScan *ClamAVConfig `yaml:"VirusScan"`
+	//DisposableDomains, if set, rejects throwaway email addresses
+	DisposableDomains *DisposableDomainsConfig `yaml:"DisposableDomains"`
+	//Systemd, if set, sends readiness and watchdog notifications
+	Systemd *SystemdConfig `yaml:"Systemd"`
+	//Status, if set, serves the outcome of requests at /status/{id}
+	Status *StatusConfig `yaml:"Status"`
+	//Digest, if set, sends matching requests in summary messages
+	Digest *DigestConfig `yaml:"Digest"`
+	//RecipientTokens, if set, lets requests carry their own recipient in a
+	//signed token
+	RecipientTokens *RecipientTokenConfig `yaml:"RecipientTokens"`
+	//Rejections, if set, customizes the responses to rejected requests
+	Rejections *RejectionConfig `yaml:"Rejections"`
+	//Canary, if set, sends a canary message at startup
+	Canary *CanaryConfig `yaml:"Canary"`
+	//AttachmentURLs, if set, lets requests attach documents by URL
+	AttachmentURLs *AttachmentURLConfig `yaml:"AttachmentURLs"`
+	//Tracing, if set, exports traces of the requests over OTLP
+	Tracing *TracingConfig `yaml:"Tracing"`
+
+	//ReadHeaderTimeout, ReadTimeout, WriteTimeout, IdleTimeout and
+	//MaxHeaderBytes are set on the http.Server. The server speaks plain
+	//HTTP/1.1, HTTP/2 is up to a TLS terminating proxy in front of it.
+	ReadHeaderTimeout time.Duration `yaml:"ReadHeaderTimeout"`
+	ReadTimeout       time.Duration `yaml:"ReadTimeout"`
+	WriteTimeout      time.Duration `yaml:"WriteTimeout"`
+	IdleTimeout       time.Duration `yaml:"IdleTimeout"`
+	MaxHeaderBytes    int           `yaml:"MaxHeaderBytes"`
+	//BodyReadTimeout, if set, is how long a client may take to send the
+	//body of a request, which is answered with 408 otherwise. Unlike
+	//ReadTimeout it applies to the body alone, so it can be short.
+	BodyReadTimeout time.Duration `yaml:"BodyReadTimeout"`
+
+	//RequestFields makes request fields required or caps their length,
+	//by form field name. /schema publishes them.
+	RequestFields map[string]FieldRule `yaml:"RequestFields"`
 
 	EmailConfig MailConfig `yaml:"EmailConfig"`
 }
 
 type server struct {
-	config      ServerConfig
-	emailSender chan<- EmailSendRequest
+	config ServerConfig
+	queue  requestQueue
+	store  RequestStore
+	dedup  *deduplicator
+	//disposable is the disposable email domain list, if enabled
+	disposable *disposableDomains
+	//configFile is where the config was read from
+	configFile string
+	//status tracks request outcomes, if enabled
+	status *statusTracker
+	//digest collects requests for the digest, if enabled
+	digest *digester
 }
 
+//ToString returns the header block of a message to `to`, followed by the
+//MIME and Miscellaneous lines as configured and the blank line ending it
 func (h *Header) ToString(to string) string {
-	return fmt.Sprintf(
-		"From: %s\nTo: %s\nSubject: %s\n%s\n%s\n",
-		h.From,
-		to,
-		h.Subject,
-		h.MIME,
-		h.Miscellaneous,
-	)
+	s := h.fields(to, "\n")
+	for _, block := range []string{h.MIME, h.Miscellaneous} {
+		if block != "" {
+			s += block + "\n"
+		}
+	}
+	return s + "\n"
+}
+
+//fields returns the From, To and Subject lines and those of the optional
+//fields that are set, each ended by eol
+func (h *Header) fields(to, eol string) string {
+	w := &headerWriter{eol: eol}
+	//enough for the fields of most messages in one allocation
+	w.b.Grow(512)
+	w.addresses("From", h.From)
+	w.addresses("To", to)
+	w.text("Subject", h.Subject)
+	if !h.Date.IsZero() {
+		w.raw("Date", h.Date.Format(time.RFC1123Z))
+	}
+	if h.ReplyTo != "" {
+		w.addresses("Reply-To", h.ReplyTo)
+	}
+	if h.MessageID != "" {
+		w.raw("Message-ID", h.MessageID)
+	}
+	if h.InReplyTo != "" {
+		w.raw("In-Reply-To", h.InReplyTo)
+	}
+	if len(h.References) > 0 {
+		w.raw("References", strings.Join(h.References, " "))
+	}
+	if h.Environment != "" {
+		w.raw("X-Environment", h.Environment)
+	}
+	for _, t := range h.Tags {
+		w.raw(t.Name, t.Value)
+	}
+	return w.b.String()
 }
 
 func checkFatalError(err error, stage string) {
@@ -114,51 +535,360 @@ func checkFatalError(err error, stage string) {
 func (c *ServerConfig) getConfig(filename string) error {
 	c.EmailConfig.Recipients = make(map[string]Recipient)
 
-	yamlFile, err := ioutil.ReadFile(filename)
+	yamlFile, err := readConfigFile(filename)
 	checkFatalError(err, "READING CONFIG FILE")
 
-	err = yaml.Unmarshal(yamlFile, c)
+	err = yaml.UnmarshalStrict(yamlFile, c)
 	checkFatalError(err, "PARSING CONFIG FILE")
 
-	c.EmailConfig.template, err = template.New("Body").Parse(c.EmailConfig.TemplateText)
-	checkFatalError(err, "PARSING EMAIL TEMPLATE")
+	err = validateTemplateEngine(c.EmailConfig.TemplateEngine)
+	checkFatalError(err, "VALIDATING TEMPLATE ENGINE")
+	c.EmailConfig.templateFuncs, err = c.EmailConfig.TemplateFunctions.funcMap(c.EmailConfig.TemplateEngine)
+	checkFatalError(err, "LOADING TEMPLATE FUNCTIONS")
+	set, err := parseTemplates(c.EmailConfig.TemplateEngine, c.EmailConfig.templateFuncs, c.EmailConfig.TemplateText, c.EmailConfig.HTMLTemplateText, c.EmailConfig.Footer, c.EmailConfig.Calendar)
+	checkFatalError(err, "PARSING EMAIL TEMPLATES")
+	set.allowed, err = parseAllowlist(c.EmailConfig.AllowedRecipients)
+	checkFatalError(err, "PARSING ALLOWED RECIPIENTS")
+	c.EmailConfig.templates = &templateStore{set: set}
+	err = validateHTMLFailureMode(c.EmailConfig.HTMLFailureMode)
+	checkFatalError(err, "VALIDATING HTML FAILURE MODE")
+	err = c.EmailConfig.validateEnvironment()
+	checkFatalError(err, "VALIDATING ENVIRONMENT TAG")
+	err = c.EmailConfig.Header.normalize()
+	checkFatalError(err, "VALIDATING HEADER")
+	err = validateFieldRules(c.RequestFields)
+	checkFatalError(err, "VALIDATING REQUEST FIELD RULES")
+	if c.Digest != nil {
+		err = c.Digest.load(c.EmailConfig.TemplateEngine, c.EmailConfig.templateFuncs)
+		checkFatalError(err, "PARSING DIGEST TEMPLATE")
+	}
+	if c.RecipientTokens != nil {
+		err = c.RecipientTokens.validate()
+		checkFatalError(err, "VALIDATING RECIPIENT TOKENS")
+	}
+	if c.Rejections != nil {
+		err = c.Rejections.validate()
+		checkFatalError(err, "VALIDATING REJECTION RESPONSES")
+	}
+	if c.Canary != nil {
+		err = c.Canary.validate()
+		checkFatalError(err, "VALIDATING CANARY")
+	}
+	if c.AttachmentURLs != nil {
+		err = c.AttachmentURLs.validate()
+		checkFatalError(err, "VALIDATING ATTACHMENT URLS")
+	}
+	if c.Tracing != nil {
+		err = c.Tracing.validate()
+		checkFatalError(err, "VALIDATING TRACING")
+	}
+
+	err = c.EmailConfig.Sender.validate()
+	checkFatalError(err, "VALIDATING SENDER CONFIG")
+	err = c.EmailConfig.Sender.loadClientCertificate()
+	checkFatalError(err, "LOADING CLIENT CERTIFICATE")
+	for i := range c.EmailConfig.Failover {
+		c.EmailConfig.Failover[i].inheritSender(&c.EmailConfig.Sender)
+		err = c.EmailConfig.Failover[i].validate()
+		checkFatalError(err, "VALIDATING FAILOVER CONFIG")
+		err = c.EmailConfig.Failover[i].loadClientCertificate()
+		checkFatalError(err, "LOADING CLIENT CERTIFICATE")
+	}
+	if c.EmailConfig.Archive != nil {
+		err = c.EmailConfig.Archive.Server.validate()
+		checkFatalError(err, "VALIDATING ARCHIVE CONFIG")
+		err = c.EmailConfig.Archive.Server.loadClientCertificate()
+		checkFatalError(err, "LOADING CLIENT CERTIFICATE")
+	}
+
+	if c.EmailConfig.Tracking != nil {
+		err = c.EmailConfig.Tracking.validate()
+		checkFatalError(err, "VALIDATING TRACKING CONFIG")
+	}
+
+	if c.EmailConfig.SMIME != nil {
+		c.EmailConfig.signer, err = c.EmailConfig.SMIME.load()
+		checkFatalError(err, "LOADING S/MIME CERTIFICATE")
+	}
+	if c.EmailConfig.PGP != nil {
+		c.EmailConfig.pgp, err = c.EmailConfig.PGP.load()
+		checkFatalError(err, "LOADING PGP KEYS")
+	}
+	if c.EmailConfig.Warmup != nil {
+		c.EmailConfig.warmup, err = c.EmailConfig.Warmup.load()
+		checkFatalError(err, "LOADING WARM-UP SCHEDULE")
+	}
+	if c.EmailConfig.Tagging != nil {
+		err = c.EmailConfig.Tagging.validate()
+		checkFatalError(err, "VALIDATING TAGGING")
+	}
+
+	err = validateHeaderOverrides(c.EmailConfig.Recipients)
+	checkFatalError(err, "VALIDATING RECIPIENT HEADERS")
+	c.EmailConfig.fromDomains, err = parseAllowlist(c.EmailConfig.AllowedFromDomains)
+	checkFatalError(err, "PARSING ALLOWED FROM DOMAINS")
+	err = c.EmailConfig.checkStaticFrom()
+	checkFatalError(err, "CHECKING FROM DOMAINS")
+	c.EmailConfig.notifiers, err = newNotifierChain(c.EmailConfig.Notifiers)
+	checkFatalError(err, "CONFIGURING NOTIFIERS")
+	err = reportLint(c.EmailConfig.lint())
+	checkFatalError(err, "LINTING CONFIG")
+	err = validateContentPreferences(c.EmailConfig.Recipients)
+	checkFatalError(err, "VALIDATING RECIPIENT CONTENT PREFERENCES")
+	c.EmailConfig.recipients = &recipientStore{recipients: c.EmailConfig.Recipients}
+	c.EmailConfig.sentLog = newSentLog(c.SentLogSize)
+
+	c.EmailConfig.identities = newIdentityPicker(&c.EmailConfig.Sender)
+	c.EmailConfig.relays = c.EmailConfig.newRelays()
+	c.EmailConfig.sendsInFlight = new(int32)
+	if c.EmailConfig.MaxConcurrentSends > 0 {
+		c.EmailConfig.sendSlots = semaphore.NewWeighted(int64(c.EmailConfig.MaxConcurrentSends))
+	}
+	if c.EmailConfig.Greylist != nil {
+		c.EmailConfig.deferred, err = openDeferredQueue(&c.EmailConfig, *c.EmailConfig.Greylist)
+		checkFatalError(err, "LOADING DEFERRED DELIVERIES")
+	}
+	if c.EmailConfig.ManagerLookup != nil {
+		c.EmailConfig.managers, err = newManagerDirectory(*c.EmailConfig.ManagerLookup)
+		checkFatalError(err, "CONFIGURING MANAGER LOOKUP")
+	}
+	if c.EmailConfig.DebugLog != nil {
+		c.EmailConfig.DebugLog.warn()
+	}
+	if c.EmailConfig.Routing != nil {
+		recipients := c.EmailConfig.Recipients
+		if c.EmailConfig.RecipientSource != nil {
+			recipients = nil
+		}
+		err = c.EmailConfig.Routing.compile(recipients)
+		checkFatalError(err, "VALIDATING ROUTING RULES")
+	}
+	if c.EmailConfig.VERP != nil {
+		err = c.EmailConfig.VERP.validate()
+		checkFatalError(err, "VALIDATING VERP CONFIG")
+	}
+	if c.EmailConfig.Suppression != nil {
+		c.EmailConfig.suppressions, err = openSuppressionList(*c.EmailConfig.Suppression)
+		checkFatalError(err, "LOADING SUPPRESSION LIST")
+	}
+	err = validateDomainPolicies(c.EmailConfig.DomainPolicies)
+	checkFatalError(err, "VALIDATING DOMAIN POLICIES")
+
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.MaxRequestBytes <= 0 {
+		c.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if c.MultipartMaxMemory <= 0 {
+		c.MultipartMaxMemory = defaultMultipartMaxMemory
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		c.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if c.ReadTimeout <= 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		//the response is only written once the email was sent
+		c.WriteTimeout = c.RequestTimeout + defaultWriteTimeoutMargin
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.MaxHeaderBytes <= 0 {
+		c.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	c.EmailConfig.maxQueueAge = c.Queue.MaxAge
+	if c.Queue.DeadLetterFile != "" {
+		c.EmailConfig.deadLetters, err = openDeadLetterFile(c.Queue.DeadLetterFile)
+		checkFatalError(err, "OPENING DEAD LETTER FILE")
+	}
 
 	return nil
 }
 
 func (m *MailConfig) EmailerInstance(ch <-chan EmailSendRequest) {
-	auth := smtp.PlainAuth(
-		"",
-		m.Sender.Address,
-		m.Sender.Password,
-		m.Sender.Host,
-	)
-	address := fmt.Sprintf("%s:%d", m.Sender.Host, m.Sender.Port)
 	var err error
 	for emailReq := range ch {
-		buf := new(bytes.Buffer)
-		err = m.template.Execute(buf, emailReq)
+		if emailReq.expired(m.maxQueueAge) {
+			m.expire(&emailReq)
+			continue
+		}
+		if emailReq.abandoned() {
+			infoLogger.Printf("Skipping request %s, it was abandoned while queued", emailReq.ID)
+			continue
+		}
+		traceCtx, span := startSpan(withTraceParent(context.Background(), emailReq.TraceParent), "send email")
+		span.set("request.id", emailReq.ID)
+		emailReq.span = span
+		var text []byte
+		templates := m.templates.get()
+		renderStarted := time.Now()
+		if emailReq.digest != nil {
+			text, err = m.Limits.render("digest", emailReq.digest.template, emailReq.digest)
+		} else {
+			text, err = m.Limits.render("body", templates.text, emailReq)
+		}
 		if err != nil {
-			emailReq.Result <- EmailSendOutcome{err}
+			m.reply(&emailReq, EmailSendOutcome{Error: err})
 			continue
 		}
-		for _, r := range m.Recipients {
-			err = smtp.SendMail(
-				address,
-				auth,
-				m.Sender.Address,
-				[]string{r.Address},
-				[]byte(m.Header.ToString(r.Address)+base64.StdEncoding.EncodeToString(buf.Bytes())+"\n"),
-			)
-			/*
-				infoLogger.Printf("Wanted to send message %s with header %s to address %s, recipient %s",
-					buf.String(), m.Header.ToString(r.Address), address, r.Name)
-			*/
+		var html []byte
+		degraded := false
+		if templates.html != nil && emailReq.digest == nil {
+			html, err = m.Limits.render("HTML body", templates.html, emailReq)
+			if err != nil && m.HTMLFailureMode == HTMLFailureDegrade {
+				errorLogger.Printf("Sending request %s as plain text only: %v", emailReq.ID, err)
+				metrics.inc("html_render_degraded_total")
+				html, err, degraded = nil, nil, true
+			}
 			if err != nil {
-				break
+				m.reply(&emailReq, EmailSendOutcome{Error: err})
+				continue
 			}
 		}
-		emailReq.Result <- EmailSendOutcome{err}
+		text, html, err = m.addFooter(templates, &emailReq, text, html)
+		if err != nil {
+			m.reply(&emailReq, EmailSendOutcome{Error: err})
+			continue
+		}
+		recordSpan(traceCtx, "render", renderStarted)
+		err = m.Limits.check(text, html, emailReq.Attachments)
+		if err != nil {
+			m.reply(&emailReq, EmailSendOutcome{Error: err})
+			continue
+		}
+		if m.AttachSubmission && emailReq.digest == nil {
+			var a Attachment
+			if a, err = submissionAttachment(&emailReq); err != nil {
+				m.reply(&emailReq, EmailSendOutcome{Error: err})
+				continue
+			}
+			//the handler still holds the submitted attachments
+			n := len(emailReq.Attachments)
+			emailReq.Attachments = append(emailReq.Attachments[:n:n], a)
+		}
+		if emailReq.digest == nil {
+			var invite *Attachment
+			if invite, err = m.renderInvite(templates, &emailReq); err != nil {
+				m.reply(&emailReq, EmailSendOutcome{Error: err})
+				continue
+			}
+			if invite != nil {
+				n := len(emailReq.Attachments)
+				emailReq.Attachments = append(emailReq.Attachments[:n:n], *invite)
+			}
+		}
+		if m.ForcePlainText {
+			html = nil
+		}
+		if err = m.Limits.checkSize(text, html, emailReq.Attachments); err != nil {
+			m.reply(&emailReq, EmailSendOutcome{Error: err})
+			continue
+		}
+		var deliveries []DeliveryReport
+		var deferred []string
+		var bounces []BounceReport
+		batches := 0
+		key := emailReq.Recipient
+		if key == "" && m.Routing != nil && len(emailReq.Recipients) == 0 {
+			key = m.Routing.route(&emailReq)
+		}
+		selected := m.selectRecipients(key)
+		switch {
+		case emailReq.TokenRecipient != nil:
+			selected = map[string]Recipient{tokenRecipientKey: *emailReq.TokenRecipient}
+		case len(emailReq.Recipients) > 0:
+			selected = m.pickRecipients(emailReq.Recipients)
+		}
+		recipients := m.deliverable(selected)
+		if len(recipients) == 0 && len(selected) > 0 {
+			infoLogger.Printf("Request %s was not sent, all %d of its recipients are suppressed", emailReq.ID, len(selected))
+			metrics.inc("requests_suppressed_total")
+			m.reply(&emailReq, EmailSendOutcome{Suppressed: true})
+			continue
+		}
+		allowed, template := templates.allowed, "body"
+		if emailReq.digest != nil {
+			allowed, template = emailReq.digest.allowed, "digest"
+		}
+		if err = allowed.check(template, recipients); err != nil {
+			m.reply(&emailReq, EmailSendOutcome{Error: err})
+			continue
+		}
+		//messages of the request share connections to each server
+		ctx, pool := withSessionPool(traceCtx)
+		started := time.Now()
+		if m.singleMessage(&emailReq) && m.VERP == nil && !m.pgp.encryptsAny(recipients) && sharesContent(recipients, m.Tracking, html) {
+			deliveries, deferred, bounces, batches, err = m.broadcast(ctx, &emailReq, recipients, text, html)
+		} else {
+			sends := 0
+			for key, r := range recipients {
+				recipientText, recipientHTML := r.bodies(text, html)
+				if m.Tracking != nil && recipientHTML != nil {
+					recipientHTML = m.Tracking.instrument(recipientHTML, emailReq.ID+"."+key)
+				}
+				var msg []byte
+				id := m.identityFor(&emailReq, r)
+				header := m.messageHeader(&emailReq, m.headerFor(r), id)
+				msg, err = m.buildMessage(&header, r.Address, recipientText, recipientHTML, emailReq.Attachments)
+				if err != nil {
+					break
+				}
+				m.debugLog(&emailReq, &header, r.Address, recipientText, recipientHTML)
+				var tlsStatus string
+				var n int
+				var timings DeliveryTimings
+				m.pace(sends)
+				sends++
+				sendStarted := time.Now()
+				sendCtx, deliverSpan := startSpan(withTimings(ctx, &timings), "deliver")
+				tlsStatus, n, err = m.sendBatched(sendCtx, id, m.envelopeFrom(r.Address), []string{r.Address}, msg)
+				recordPhase(sendCtx, phaseTotal, sendStarted)
+				deliverSpan.finish(err)
+				batches += n
+				if err != nil && m.deferred != nil && isGreylisted(err) {
+					infoLogger.Printf("Request %s greylisted by %s, retrying later: %v", emailReq.ID, r.Address, err)
+					err = m.deferred.schedule(&deferredDelivery{
+						RequestID: emailReq.ID,
+						Recipient: r.Address,
+						Subject:   header.Subject,
+						MessageID: header.MessageID,
+						Message:   msg,
+						Sender:    id.address(),
+					})
+					if err == nil {
+						deferred = append(deferred, r.Address)
+						continue
+					}
+				}
+				m.sentLog.record(emailReq.ID, r.Address, header.Subject, header.MessageID, tlsStatus, err)
+				if err == nil {
+					deliveries = append(deliveries, DeliveryReport{Recipient: r.Address, TLS: tlsStatus, MessageID: header.MessageID, Sender: id.address(), Timings: timings})
+				}
+				if err != nil {
+					if b := m.recordBounce(&emailReq, r.Address, err); b != nil {
+						bounces = append(bounces, *b)
+					}
+					break
+				}
+			}
+		}
+		if err == nil {
+			m.bccManager(ctx, &emailReq, text, html, emailReq.Attachments)
+			err = m.archiveCopy(ctx, text, html, emailReq.Attachments)
+		}
+		pool.close()
+		m.reply(&emailReq, EmailSendOutcome{Error: err, Deliveries: deliveries, Deferred: deferred, Batches: batches, Degraded: degraded, Elapsed: time.Since(started), Bounces: bounces})
+	}
+}
+
+//pace waits RecipientDelay before every send of a request after the first,
+//given the number of sends so far
+func (m *MailConfig) pace(sends int) {
+	if sends > 0 && m.RecipientDelay > 0 {
+		time.Sleep(m.RecipientDelay)
 	}
 }
 
@@ -166,7 +896,76 @@ func (s *server) clientHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		var data EmailSendRequest
+		started := time.Now()
+		if r.ContentLength > s.config.MaxRequestBytes {
+			s.reject(w, r, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxRequestBytes)
+		restoreDeadline := s.limitBodyRead(r)
+		err := s.readAttachments(r, &data)
+		restoreDeadline()
+		if err != nil {
+			errorLogger.Printf("Error reading request from %s: %v", r.RemoteAddr, err)
+			if isReadTimeout(err) {
+				w.Header().Set("Connection", "close")
+				s.reject(w, r, "Request Timeout", http.StatusRequestTimeout)
+				return
+			}
+			if isBodyTooLarge(err) {
+				s.reject(w, r, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			s.reject(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.checkFields(r); err != nil {
+			s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data.ID = newRequestID()
+		w.Header().Set("X-Request-ID", data.ID)
+		traceCtx, span := startSpanAt(withTraceParent(r.Context(), r.Header.Get("traceparent")), "POST "+r.URL.Path, spanKindServer, started)
+		defer span.finish(nil)
+		span.set("request.id", data.ID)
+		data.TraceParent = traceParentOf(traceCtx)
+		priority, err := parsePriority(r.FormValue("priority"))
+		if err != nil {
+			s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data.Priority = priority
 		data.IPAddress = r.RemoteAddr
+		if raw := r.Form["attachmentURL"]; len(raw) > 0 {
+			if s.config.AttachmentURLs == nil {
+				s.reject(w, r, "Invalid request: attachment URLs are not enabled", http.StatusBadRequest)
+				return
+			}
+			urls, err := s.config.AttachmentURLs.parse(raw)
+			if err != nil {
+				s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = s.config.AttachmentURLs.fetchAll(r.Context(), urls, &data); err != nil {
+				errorLogger.Printf("Rejecting request %s from %s: %v", data.ID, r.RemoteAddr, err)
+				s.reject(w, r, "Attachment could not be fetched: "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if s.config.VirusScan != nil {
+			err = s.config.VirusScan.scanAttachments(&data)
+			var threatErr *ThreatError
+			if errors.As(err, &threatErr) {
+				errorLogger.Printf("Rejecting request %s from %s: %v", data.ID, r.RemoteAddr, err)
+				s.reject(w, r, "Attachment rejected: "+threatErr.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				errorLogger.Printf("Error scanning request %s: %v", data.ID, err)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
 		data.FirstName = r.FormValue("firstName")
 		data.LastName = r.FormValue("lastName")
 		data.ProductSerial = r.FormValue("productSerial")
@@ -174,31 +973,311 @@ func (s *server) clientHandler(w http.ResponseWriter, r *http.Request) {
 		data.PhoneNumber = r.FormValue("phoneNumber")
 		data.CompanyName = r.FormValue("company")
 		data.EmailAddress = r.FormValue("email")
+		if s.disposable != nil {
+			if domain := s.disposable.match(data.EmailAddress); domain != "" {
+				metrics.inc("disposable_domain_rejections_total")
+				infoLogger.Printf("Rejecting request %s from %s: disposable email domain %s", data.ID, r.RemoteAddr, domain)
+				s.reject(w, r, "Disposable email addresses are not accepted", http.StatusUnprocessableEntity)
+				return
+			}
+		}
 		data.Description = r.FormValue("description")
-		result := make(chan EmailSendOutcome)
-		data.Result = result
-		s.emailSender <- data
-		outcome := <-result
+		if key := r.FormValue("recipient"); key != "" {
+			if !s.isAdmin(r) {
+				s.reject(w, r, "Only admins may pick a recipient", http.StatusForbidden)
+				return
+			}
+			if _, ok := s.config.EmailConfig.currentRecipients()[key]; !ok {
+				s.reject(w, r, "Invalid request: unknown recipient "+key, http.StatusBadRequest)
+				return
+			}
+			data.Recipient = key
+		}
+		if token := r.FormValue("recipientToken"); token != "" {
+			if s.config.RecipientTokens == nil {
+				s.reject(w, r, "Invalid request: recipient tokens are not enabled", http.StatusBadRequest)
+				return
+			}
+			if data.Recipient != "" {
+				s.reject(w, r, "Invalid request: recipient and recipientToken are exclusive", http.StatusBadRequest)
+				return
+			}
+			rcpt, err := s.config.RecipientTokens.verify(token, time.Now())
+			if err != nil {
+				infoLogger.Printf("Rejecting request %s from %s: recipient token: %v", data.ID, r.RemoteAddr, err)
+				s.reject(w, r, "Invalid recipient token: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			data.TokenRecipient = rcpt
+		}
+		if values := r.Form["recipients"]; len(values) > 0 {
+			if s.config.EmailConfig.RecipientSelection == nil {
+				s.reject(w, r, "Invalid request: picking recipients is not enabled", http.StatusBadRequest)
+				return
+			}
+			if data.Recipient != "" || data.TokenRecipient != nil {
+				s.reject(w, r, "Invalid request: recipients, recipient and recipientToken are exclusive", http.StatusBadRequest)
+				return
+			}
+			data.Recipients, err = s.config.EmailConfig.RecipientSelection.parse(values, s.config.EmailConfig.currentRecipients())
+			if err != nil {
+				s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if brand := r.FormValue("fromBrand"); brand != "" {
+			if s.config.EmailConfig.identities.brand(brand) == nil {
+				s.reject(w, r, "Invalid request: unknown brand "+brand, http.StatusBadRequest)
+				return
+			}
+			data.Brand = brand
+		}
+		inReplyTo, err := parseMessageIDs("inReplyTo", r.FormValue("inReplyTo"))
+		if err == nil && len(inReplyTo) > 1 {
+			err = errors.New("inReplyTo: expected a single message-id")
+		}
+		if err != nil {
+			s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(inReplyTo) == 1 {
+			data.InReplyTo = inReplyTo[0]
+		}
+		data.References, err = parseMessageIDs("references", r.FormValue("references"))
+		if err != nil {
+			s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.config.EmailConfig.Tagging != nil {
+			data.Category, data.Tags, err = parseTags(r.FormValue("category"), r.FormValue("tags"))
+			if err != nil {
+				s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if raw := r.FormValue("data"); raw != "" {
+			data.Data, err = parseDataField(raw)
+			if err != nil {
+				s.reject(w, r, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if s.asyncRequested(r) {
+			go func() {
+				outcome, err := s.dispatch(context.Background(), data)
+				if err == nil {
+					err = outcome.Error
+				}
+				if err != nil {
+					logClientError(&data, err)
+				}
+			}()
+			writeAccepted(w, data.ID)
+			return
+		}
+		ctx := r.Context()
+		if s.config.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+			defer cancel()
+		}
+		outcome, err := s.dispatch(ctx, data)
+		if err != nil {
+			errorLogger.Printf("Gave up waiting for request %s: %v", data.ID, err)
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
 		if outcome.Error != nil {
-			errorLogger.Printf(
-				"Error handling client (IP: %s, Name: %s, Product: %s, Phone: %s, Company: %s, Email: %s): %v",
-				data.IPAddress,
-				data.FirstName+" "+data.LastName,
-				data.ProductSerial+"-"+data.ProductModel,
-				data.PhoneNumber,
-				data.CompanyName,
-				data.EmailAddress,
-				outcome.Error,
-			)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			logClientError(&data, outcome.Error)
+			var limitErr *LimitError
+			if errors.As(outcome.Error, &limitErr) {
+				s.reject(w, r, limitErr.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			status := newSendError(outcome.Error).Category.httpStatus()
+			switch {
+			case status == http.StatusInternalServerError:
+				http.Error(w, "Internal Error", status)
+				s.writeRecipientReport(w, &data, outcome)
+				return
+			case status < http.StatusInternalServerError:
+				s.reject(w, r, http.StatusText(status), status)
+				return
+			}
+			http.Error(w, http.StatusText(status), status)
+			s.writeRecipientReport(w, &data, outcome)
+			return
+		}
+		if outcome.Suppressed {
+			const message = "Not sent, all recipients are suppressed"
+			if status := s.config.EmailConfig.Suppression.allSuppressedStatus(); status >= http.StatusBadRequest {
+				s.reject(w, r, message, status)
+			} else {
+				w.WriteHeader(status)
+				fmt.Fprintf(w, message)
+				s.writeRecipientReport(w, &data, outcome)
+			}
+			return
+		}
+		if outcome.Digest {
+			s.setStatusLocation(w, data.ID)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Accepted, the request will be sent with the next digest")
+			return
+		}
+		if outcome.Queued {
+			s.setStatusLocation(w, data.ID)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Accepted, sending is paused and the request was queued")
+			return
+		}
+		if len(outcome.Deferred) > 0 {
+			s.setStatusLocation(w, data.ID)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Accepted, delivery to some recipients was deferred")
+			s.writeRecipientReport(w, &data, outcome)
+			return
+		}
+		if outcome.Degraded {
+			fmt.Fprintf(w, "Success! (sent as plain text, the HTML body failed to render)")
+			s.writeRecipientReport(w, &data, outcome)
 			return
 		}
 		fmt.Fprintf(w, "Success!")
+		s.writeRecipientReport(w, &data, outcome)
 	default:
 		http.Error(w, "Invalid request", http.StatusNotImplemented)
 	}
 }
 
+//writeRecipientReport follows the response with a line per recipient the
+//request picked, telling whether it was sent to
+func (s *server) writeRecipientReport(w io.Writer, data *EmailSendRequest, outcome EmailSendOutcome) {
+	if len(data.Recipients) == 0 {
+		return
+	}
+	states := make(map[string]string)
+	for _, d := range outcome.Deliveries {
+		states[strings.ToLower(d.Recipient)] = "sent"
+	}
+	for _, addr := range outcome.Deferred {
+		states[strings.ToLower(addr)] = "deferred"
+	}
+	for _, b := range outcome.Bounces {
+		states[strings.ToLower(b.Recipient)] = b.Class + " bounce"
+	}
+	m := &s.config.EmailConfig
+	recipients := m.currentRecipients()
+	for _, key := range data.Recipients {
+		addr := recipients[key].Address
+		state := states[strings.ToLower(addr)]
+		switch {
+		case state != "":
+		case m.suppressions != nil && m.suppressions.contains(addr):
+			state = "suppressed"
+		default:
+			state = "not sent"
+		}
+		fmt.Fprintf(w, "\n%s: %s", key, state)
+	}
+}
+
+//logClientError logs the failure of the client request data
+func logClientError(data *EmailSendRequest, err error) {
+	errorLogger.Printf(
+		"Error handling client (ID: %s, IP: %s, Name: %s, Product: %s, Phone: %s, Company: %s, Email: %s): %v",
+		data.ID,
+		data.IPAddress,
+		data.FirstName+" "+data.LastName,
+		data.ProductSerial+"-"+data.ProductModel,
+		data.PhoneNumber,
+		data.CompanyName,
+		data.EmailAddress,
+		err,
+	)
+}
+
+//submit queues data and waits for its outcome, which is recorded in the
+//request store. It fails only if ctx is done first, the request is then
+//recorded as abandoned.
+func (s *server) submit(ctx context.Context, data EmailSendRequest) (EmailSendOutcome, error) {
+	if s.digest != nil && s.digest.matches(&data) {
+		return s.digest.add(data), nil
+	}
+	if s.queue.paused() {
+		return s.submitPaused(data), nil
+	}
+	result := make(chan EmailSendOutcome)
+	data.Result = result
+	data.Done = ctx.Done()
+	s.queue.enqueue(data)
+	var outcome EmailSendOutcome
+	select {
+	case outcome = <-result:
+	case <-ctx.Done():
+		s.store.Record(data, EmailSendOutcome{Error: fmt.Errorf("abandoned by the requester, the outcome is unknown: %w", ctx.Err())})
+		return outcome, ctx.Err()
+	}
+	s.store.Record(data, outcome)
+	return outcome, nil
+}
+
+//parseDataField decodes the "data" field, which must be a JSON object
+func parseDataField(raw string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("data is not valid JSON: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("data has trailing content")
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("data must be a JSON object")
+	}
+	return obj, nil
+}
+
+//isBodyTooLarge reports whether err comes from reading past the limit of
+//http.MaxBytesReader, which has no error type of its own
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+//readAttachments parses the form and fills data.Attachments from the
+//"attachments" files of a multipart/form-data request. Other requests
+//carry no attachments.
+func (s *server) readAttachments(r *http.Request, data *EmailSendRequest) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.ParseForm()
+	}
+	err := r.ParseMultipartForm(s.config.MultipartMaxMemory)
+	if err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	for _, fh := range r.MultipartForm.File["attachments"] {
+		f, err := fh.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		data.Attachments = append(data.Attachments, Attachment{
+			Filename:    filepath.Base(fh.Filename),
+			ContentType: attachmentContentType(fh.Header.Get("Content-Type"), content),
+			Data:        content,
+		})
+	}
+	return nil
+}
+
 func Execute() {
 	var cfg ServerConfig
 	var configFile string
@@ -214,25 +1293,117 @@ func Execute() {
 
 	flag.StringVar(&configFile, "c", defaultConfigFile, helpMsgConfigFile+" (shortened)")
 	flag.StringVar(&configFile, "configFile", defaultConfigFile, helpMsgConfigFile)
+	flag.DurationVar(&configFetch.Timeout, "configTimeout", defaultConfigFetchTimeout, helpMsgConfigTimeout)
+	flag.StringVar(&configFetch.Header, "configHeader", "", helpMsgConfigHeader)
+	flag.StringVar(&configFetch.CacheFile, "configCache", defaultConfigCacheFile(), helpMsgConfigCache)
+	flag.BoolVar(&strictLint, "strict", false, helpMsgStrict)
 	flag.Parse()
+	if configFetch.Header == "" {
+		//keeps credentials out of the process list
+		configFetch.Header = os.Getenv("CONFIG_HEADER")
+	}
+
+	rand.Seed(time.Now().UnixNano())
 
 	err := cfg.getConfig(configFile)
 	checkFatalError(err, "READING/PARSING CONFIG FILE")
+	if cfg.AuditLogFile != "" {
+		err = openAuditLog(cfg.AuditLogFile)
+		checkFatalError(err, "OPENING AUDIT LOG")
+	}
 	infoLogger.Println("Successfuly Read Config File")
+	//before anything is sent, histograms are only kept if served
+	metrics.enabled = cfg.MetricsPath != ""
+	if cfg.Tracing != nil {
+		tracing = newTracer(*cfg.Tracing)
+		go tracing.run()
+	}
+	if cfg.EmailConfig.VerifyOnStartup {
+		err = cfg.EmailConfig.verifySenders()
+		checkFatalError(err, "VERIFYING SMTP SERVERS")
+	}
 
 	emailChan := make(chan EmailSendRequest)
-	go cfg.EmailConfig.EmailerInstance(emailChan)
+	for i := 0; i < cfg.Workers; i++ {
+		go cfg.EmailConfig.EmailerInstance(emailChan)
+	}
+	local := newEmailQueue(cfg.Queue)
+	var queue requestQueue = local
+	if cfg.Queue.Redis != nil {
+		queue, err = cfg.Queue.Redis.open(local, cfg.Workers)
+		checkFatalError(err, "CONNECTING TO REDIS")
+	}
+	if cfg.EmailConfig.warmup != nil {
+		cfg.EmailConfig.warmup.queue = queue
+	}
+	go queue.dispatch(emailChan)
+	if cfg.Canary != nil {
+		err = cfg.Canary.run(queue)
+		checkFatalError(err, "SENDING CANARY MESSAGE")
+	}
+	if cfg.EmailConfig.RecipientSource != nil {
+		go cfg.EmailConfig.watchRecipientSource()
+	}
+	if cfg.EmailConfig.deferred != nil {
+		go cfg.EmailConfig.deferred.run()
+	}
+	if cfg.EmailConfig.notifiers != nil {
+		go cfg.EmailConfig.notifiers.run()
+	}
 
 	s := &server{}
 	s.config = cfg
-	s.emailSender = emailChan
+	s.configFile = configFile
+	s.queue = queue
+	s.store, err = cfg.Storage.newRequestStore()
+	checkFatalError(err, "OPENING REQUEST STORE")
+	if s.config.Dedup != nil {
+		s.dedup = newDeduplicator(*s.config.Dedup)
+	}
+	if s.config.Status != nil {
+		s.status = newStatusTracker(*s.config.Status)
+		go s.status.run()
+	}
+	if s.config.Digest != nil {
+		s.digest = newDigester(*s.config.Digest, queue, s.finishQueued)
+		go s.digest.run()
+	}
+	if s.config.DisposableDomains != nil {
+		s.disposable, err = newDisposableDomains(*s.config.DisposableDomains)
+		checkFatalError(err, "LOADING DISPOSABLE DOMAINS")
+		if s.config.DisposableDomains.URL != "" && s.config.DisposableDomains.Interval > 0 {
+			go s.disposable.watch()
+		}
+	}
 
-	http.HandleFunc(s.config.BaseURL, s.clientHandler) //TODO: Complete clientHandler
+	err = s.registerRoutes()
+	checkFatalError(err, "REGISTERING ENDPOINTS")
 	infoLogger.Println("Successfuly Initialized WebServer")
 	infoLogger.Printf("Serving at %s\n", s.config.Address)
 
 	os.Stdout.Sync()
 
-	fatalLogger.Fatal(http.ListenAndServe(s.config.Address, nil))
+	ln, err := net.Listen("tcp", s.config.Address)
+	checkFatalError(err, "LISTENING")
+	if s.config.Systemd != nil {
+		s.notifyReady()
+	}
+	srv := &http.Server{
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		MaxHeaderBytes:    s.config.MaxHeaderBytes,
+		ConnContext:       withConn,
+	}
+	if err = serve(srv, ln); err != nil {
+		fatalLogger.Fatal(err)
+	}
+	if s.digest != nil {
+		if err = s.digest.stop(); err != nil {
+			errorLogger.Printf("Stopping: %v", err)
+		}
+	}
+	tracing.stop()
 
 }
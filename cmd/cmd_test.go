@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	infoLogger = log.New(io.Discard, "", 0)
+	fatalLogger = log.New(os.Stderr, "FATAL: ", log.Lshortfile)
+	errorLogger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+//testServer is a server whose requests are handed to send instead of the
+//emailer workers
+type testServer struct {
+	*server
+	mu   sync.Mutex
+	sent []EmailSendRequest
+}
+
+func newTestServer(t *testing.T, config ServerConfig, send func(EmailSendRequest) EmailSendOutcome) *testServer {
+	t.Helper()
+	if config.MaxRequestBytes == 0 {
+		config.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = "/"
+	}
+	queue := newEmailQueue(config.Queue)
+	ts := &testServer{server: &server{config: config, queue: queue, store: noopStore{}}}
+	out := make(chan EmailSendRequest)
+	go queue.dispatch(out)
+	go func() {
+		for req := range out {
+			outcome := send(req)
+			ts.mu.Lock()
+			ts.sent = append(ts.sent, req)
+			ts.mu.Unlock()
+			req.reply(outcome)
+		}
+	}()
+	return ts
+}
+
+//sentCount returns the number of requests handed to send
+func (ts *testServer) sentCount() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.sent)
+}
+
+//testForm returns a request submitting the client form
+func testForm(fields url.Values) *http.Request {
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(fields.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+var errClientGone = errors.New("client hung up")
+
+//failingResponseWriter fails every write, as when the client hung up
+//before the answer
+type failingResponseWriter struct {
+	header http.Header
+	status int
+	writes int
+}
+
+func (w *failingResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *failingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errClientGone
+}
+
+func TestClientHandlerWriteError(t *testing.T) {
+	tests := []struct {
+		name    string
+		outcome EmailSendOutcome
+		status  int
+	}{
+		{"sent", EmailSendOutcome{}, 0},
+		{"deferred", EmailSendOutcome{Deferred: []string{"a@example.com"}}, http.StatusAccepted},
+		{"failed", EmailSendOutcome{Error: &SendError{Category: CategoryConnection, Err: errors.New("unreachable")}}, CategoryConnection.httpStatus()},
+	}
+	for _, test := range tests {
+		ts := newTestServer(t, ServerConfig{}, func(EmailSendRequest) EmailSendOutcome { return test.outcome })
+		w := &failingResponseWriter{}
+		done := make(chan struct{})
+		go func() {
+			ts.clientHandler(w, testForm(url.Values{"firstName": {"Ada"}, "email": {"ada@example.com"}}))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the handler didn't return after failing to write", test.name)
+		}
+		if w.status != test.status || w.writes == 0 {
+			t.Errorf("%s: got status %d after %d writes, want %d", test.name, w.status, w.writes, test.status)
+		}
+		if n := ts.sentCount(); n != 1 {
+			t.Errorf("%s: the request was sent %d times, want once", test.name, n)
+		}
+	}
+}
+
+func TestAbandonedRequest(t *testing.T) {
+	release := make(chan struct{})
+	replied := make(chan struct{})
+	ts := newTestServer(t, ServerConfig{}, func(req EmailSendRequest) EmailSendOutcome {
+		if req.ID == "slow" {
+			<-release
+			defer close(replied)
+		}
+		return EmailSendOutcome{}
+	})
+
+	//the client hangs up while its request is being sent
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ts.submit(ctx, EmailSendRequest{ID: "slow"}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the deadline to pass", err)
+	}
+	close(release)
+	select {
+	case <-replied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker is stuck replying to an abandoned request")
+	}
+
+	//and the worker goes on with the next one
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ts.submit(ctx, EmailSendRequest{ID: "next"}); err != nil {
+		t.Fatalf("the next request got %v", err)
+	}
+	if n := ts.sentCount(); n != 2 {
+		t.Errorf("%d requests were sent, want 2", n)
+	}
+}
+
+func TestReplyAbandoned(t *testing.T) {
+	done := make(chan struct{})
+	req := EmailSendRequest{ID: "gone", Result: make(chan EmailSendOutcome), Done: done}
+	if req.abandoned() {
+		t.Fatal("the request is abandoned before the requester gave up")
+	}
+	close(done)
+	if !req.abandoned() {
+		t.Fatal("the request isn't abandoned after the requester gave up")
+	}
+	returned := make(chan struct{})
+	go func() {
+		req.reply(EmailSendOutcome{Error: errors.New("unreachable")})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply blocks on a Result nobody reads")
+	}
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//stdinConfig is the config file name that reads the config from stdin
+const stdinConfig = "-"
+
+//defaultConfigFetchTimeout bounds fetching a config URL unless
+//-configTimeout is given
+const defaultConfigFetchTimeout = 10 * time.Second
+
+//configFetchOptions controls how config URLs are fetched, set from the
+//command line as the config can't configure its own fetching
+type configFetchOptions struct {
+	Timeout time.Duration
+	//Header is sent with every request, as "Name: value", e.g. for an
+	//Authorization header
+	Header string
+	//CacheFile keeps the last config fetched, to start from when the URL
+	//can't be reached. Empty disables the cache.
+	CacheFile string
+}
+
+//configFetch holds the options of the running instance
+var configFetch = configFetchOptions{Timeout: defaultConfigFetchTimeout}
+
+//configFetchError is a failure to fetch a config URL, as opposed to the
+//content fetched being invalid
+type configFetchError struct {
+	url string
+	err error
+}
+
+func (e *configFetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.url, e.err)
+}
+
+func (e *configFetchError) Unwrap() error {
+	return e.err
+}
+
+var (
+	stdinOnce    sync.Once
+	stdinContent []byte
+	stdinErr     error
+)
+
+//isConfigURL reports whether name is an http(s) URL rather than a path
+func isConfigURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+//defaultConfigCacheFile returns where configs fetched from a URL are
+//cached by default, or "" if there is no cache directory
+func defaultConfigCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "docs-email-sender", "config.yaml")
+}
+
+//configLocation resolves name as given in the Includes of the config read
+//from parent: a URL is resolved against a parent URL, a relative path
+//against the parent's directory
+func configLocation(parent, name string) (string, error) {
+	if isConfigURL(parent) && !filepath.IsAbs(name) {
+		base, err := url.Parse(parent)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(name)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	if isConfigURL(name) || filepath.IsAbs(name) || parent == stdinConfig {
+		return name, nil
+	}
+	return filepath.Join(filepath.Dir(parent), name), nil
+}
+
+//readConfigSource reads a config from a file, stdin for "-" or an http(s)
+//URL. Stdin is only read once, later reads get the same content.
+func readConfigSource(name string) ([]byte, error) {
+	switch {
+	case name == stdinConfig:
+		stdinOnce.Do(func() {
+			stdinContent, stdinErr = ioutil.ReadAll(os.Stdin)
+		})
+		return stdinContent, stdinErr
+	case isConfigURL(name):
+		return fetchConfig(name)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func fetchConfig(u string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if configFetch.Header != "" {
+		i := strings.Index(configFetch.Header, ":")
+		if i <= 0 {
+			return nil, errors.New("config header must be given as \"Name: value\"")
+		}
+		req.Header.Set(strings.TrimSpace(configFetch.Header[:i]), strings.TrimSpace(configFetch.Header[i+1:]))
+	}
+	client := http.Client{Timeout: configFetch.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &configFetchError{u, err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &configFetchError{u, fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &configFetchError{u, err}
+	}
+	return content, nil
+}
+
+//cachedConfig saves the merged config fetched from a URL to the cache, or
+//reads the cached one back if fetching failed
+func cachedConfig(content []byte, err error) ([]byte, error) {
+	file := configFetch.CacheFile
+	if file == "" {
+		return content, err
+	}
+	var fetchErr *configFetchError
+	if errors.As(err, &fetchErr) {
+		cached, cacheErr := ioutil.ReadFile(file)
+		if cacheErr != nil {
+			return nil, err
+		}
+		errorLogger.Printf("WARNING: %v, using the config cached in %s", err, file)
+		return cached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	//the config holds passwords
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		errorLogger.Printf("Caching config: %v", err)
+	} else if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		errorLogger.Printf("Caching config: %v", err)
+	}
+	return content, nil
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import "fmt"
+
+//Content preferences, see Recipient.ContentPreference
+const (
+	ContentBoth = "both"
+	ContentText = "text"
+	ContentHTML = "html"
+)
+
+//bodies returns the plain text and HTML bodies r is sent, either of which
+//may be nil. Without an HTML body everyone gets the plain text.
+func (r *Recipient) bodies(text, html []byte) ([]byte, []byte) {
+	switch {
+	case r.ForcePlainText || r.ContentPreference == ContentText:
+		return text, nil
+	case r.ContentPreference == ContentHTML && html != nil:
+		return nil, html
+	}
+	return text, html
+}
+
+//singlePart reports whether r is sent only one of the bodies
+func (r *Recipient) singlePart() bool {
+	return r.ForcePlainText || r.ContentPreference == ContentText || r.ContentPreference == ContentHTML
+}
+
+//validateContentPreferences rejects unknown content preferences
+func validateContentPreferences(recipients map[string]Recipient) error {
+	for key, r := range recipients {
+		switch r.ContentPreference {
+		case "", ContentBoth, ContentText, ContentHTML:
+		default:
+			return fmt.Errorf("recipient %q: unknown content preference %q", key, r.ContentPreference)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+//mediaTypeOf returns the media type of the body of msg
+func mediaTypeOf(t *testing.T, msg []byte) string {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mediaType
+}
+
+//buildFor builds the message r is sent of text and html
+func buildFor(t *testing.T, r Recipient, text, html []byte) []byte {
+	t.Helper()
+	text, html = r.bodies(text, html)
+	msg, err := (&MailConfig{}).buildMessage(benchHeader(), r.Address, text, html, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestContentPreference(t *testing.T) {
+	text, html := []byte("hello\n"), []byte("<p>hello</p>")
+	tests := []struct {
+		preference string
+		html       []byte
+		//want is the media type of the message, parts those of its parts
+		want  string
+		parts []string
+	}{
+		{"", html, "multipart/alternative", []string{"text/plain", "text/html"}},
+		{ContentBoth, html, "multipart/alternative", []string{"text/plain", "text/html"}},
+		{ContentText, html, "text/plain", nil},
+		{ContentHTML, html, "text/html", nil},
+		//without an HTML body everyone gets the plain text
+		{ContentHTML, nil, "text/plain", nil},
+		{ContentBoth, nil, "text/plain", nil},
+	}
+	for _, test := range tests {
+		r := Recipient{Address: "sales@example.com", ContentPreference: test.preference}
+		msg := buildFor(t, r, text, test.html)
+		if got := mediaTypeOf(t, msg); got != test.want {
+			t.Errorf("preference %q, html %v: got %s, want %s", test.preference, test.html != nil, got, test.want)
+			continue
+		}
+		if test.parts == nil {
+			continue
+		}
+		_, parts, _ := readMultipart(t, msg)
+		var got []string
+		for _, p := range parts {
+			mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			got = append(got, mediaType)
+		}
+		if len(got) != len(test.parts) || got[0] != test.parts[0] || got[1] != test.parts[1] {
+			t.Errorf("preference %q: got parts %v, want %v", test.preference, got, test.parts)
+		}
+	}
+}
+
+func TestValidateContentPreferences(t *testing.T) {
+	valid := map[string]Recipient{"a": {}, "b": {ContentPreference: ContentBoth}, "c": {ContentPreference: ContentText}, "d": {ContentPreference: ContentHTML}}
+	if err := validateContentPreferences(valid); err != nil {
+		t.Error(err)
+	}
+	if err := validateContentPreferences(map[string]Recipient{"a": {ContentPreference: "markdown"}}); err == nil {
+		t.Error("an unknown preference is accepted")
+	}
+}
+
+func TestForcePlainText(t *testing.T) {
+	text, html := []byte("Grüße aus Köln\n"), []byte("<p>Grüße aus Köln</p>")
+	r := Recipient{Address: "legacy@example.com", ForcePlainText: true, ContentPreference: ContentHTML}
+	msg := buildFor(t, r, text, html)
+	if bytes.Contains(bytes.ToLower(msg), []byte("multipart")) {
+		t.Fatalf("the forced plain text message is multipart:\n%s", msg)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/plain" || !strings.EqualFold(params["charset"], "utf-8") {
+		t.Fatalf("got Content-Type %q", m.Header.Get("Content-Type"))
+	}
+	encoded, _ := ioutil.ReadAll(m.Body)
+	body, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	if err != nil || !bytes.Equal(body, text) {
+		t.Errorf("got body %q (%v), want %q", body, err, text)
+	}
+
+	//attachments still go along, next to the only body
+	text, html = r.bodies(text, html)
+	attachment := Attachment{Filename: "logo.png", ContentType: "image/png", Data: testPNG}
+	msg, err = (&MailConfig{}).buildMessage(benchHeader(), r.Address, text, html, []Attachment{attachment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mediaTypeOf(t, msg); got != "multipart/mixed" {
+		t.Fatalf("got %s with an attachment, want multipart/mixed", got)
+	}
+	_, parts, _ := readMultipart(t, msg)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want the text and the attachment", len(parts))
+	}
+	if got := parts[0].Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("the first part is %q, want the plain text", got)
+	}
+	if bytes.Contains(msg, []byte("multipart/alternative")) || bytes.Contains(msg, []byte("text/html")) {
+		t.Errorf("the HTML body was sent along")
+	}
+}
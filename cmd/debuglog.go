@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+//redacted replaces the values of DebugLogConfig.RedactFields
+const redacted = "[REDACTED]"
+
+//debugLogger receives the rendered messages when DebugLog is set, and
+//requests for unknown paths with LogNotFound
+var debugLogger = log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime)
+
+//DebugLogConfig logs the headers and bodies of every message sent. These
+//contain whatever the users submitted, so it is meant for debugging
+//templates and must not be enabled in production.
+type DebugLogConfig struct {
+	//RedactFields names EmailSendRequest fields (e.g. "PhoneNumber") or
+	//keys of its data whose values are masked in the log
+	RedactFields []string `yaml:"RedactFields"`
+}
+
+//warn reminds whoever reads the log that debug logging is on
+func (c *DebugLogConfig) warn() {
+	errorLogger.Printf("WARNING: DebugLog is enabled, rendered emails containing personal data will be logged")
+}
+
+//redactor returns a replacer masking the values of the redacted fields of
+//req, as they appear in both the plain text and the HTML body
+func (c *DebugLogConfig) redactor(req *EmailSendRequest) *strings.Replacer {
+	var pairs []string
+	for _, name := range c.RedactFields {
+		value := req.field(name)
+		if value == "" {
+			continue
+		}
+		pairs = append(pairs, value, redacted)
+		if escaped := htmltemplate.HTMLEscapeString(value); escaped != value {
+			pairs = append(pairs, escaped, redacted)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+//field returns the EmailSendRequest string field called name, or the
+//value of that key of its data
+func (r *EmailSendRequest) field(name string) string {
+	if f := reflect.ValueOf(r).Elem().FieldByName(name); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	if data, ok := r.Data[name]; ok {
+		return fmt.Sprint(data)
+	}
+	return ""
+}
+
+//debugLog logs the message rendered for req to the given recipients, if
+//DebugLog is set
+func (m *MailConfig) debugLog(req *EmailSendRequest, header *Header, to string, text, html []byte) {
+	if m.DebugLog == nil {
+		return
+	}
+	r := m.DebugLog.redactor(req)
+	debugLogger.Printf("Request %s rendered for %s:\n%s\n%s", req.ID, to, r.Replace(m.tagged(header).ToString(to)), r.Replace(string(text)))
+	if html != nil {
+		debugLogger.Printf("Request %s HTML body for %s:\n%s", req.ID, to, r.Replace(string(html)))
+	}
+}
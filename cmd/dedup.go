@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 10 * time.Second
+
+//DedupConfig suppresses submissions identical to one seen within Window,
+//e.g. from a double-click, answering them with the earlier outcome. By
+//default submissions must come from the same IP and be rendered with the
+//same templates to count as identical.
+type DedupConfig struct {
+	Window time.Duration `yaml:"Window"`
+	//IgnoreIP matches submissions regardless of their source address
+	IgnoreIP bool `yaml:"IgnoreIP"`
+	//IgnoreTemplate keeps matching submissions across template changes
+	IgnoreTemplate bool `yaml:"IgnoreTemplate"`
+}
+
+func init() {
+	metrics.describe("duplicate_requests_suppressed_total", counterMetric, "Submissions answered with the outcome of an identical earlier one")
+}
+
+//dedupEntry is a submission, waiting for or holding its outcome
+type dedupEntry struct {
+	requestID string
+	expires   time.Time
+	done      chan struct{}
+	outcome   EmailSendOutcome
+	err       error
+}
+
+//wait returns the outcome of the original submission
+func (e *dedupEntry) wait(ctx context.Context) (EmailSendOutcome, error) {
+	select {
+	case <-e.done:
+		return e.outcome, e.err
+	case <-ctx.Done():
+		return EmailSendOutcome{}, ctx.Err()
+	}
+}
+
+type deduplicator struct {
+	config DedupConfig
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+func newDeduplicator(config DedupConfig) *deduplicator {
+	if config.Window <= 0 {
+		config.Window = defaultDedupWindow
+	}
+	return &deduplicator{config: config, entries: make(map[string]*dedupEntry)}
+}
+
+//key hashes the normalized fields of req within the configured scope
+func (d *deduplicator) key(req *EmailSendRequest, m *MailConfig) string {
+	h := sha256.New()
+	field := func(v string) {
+		h.Write([]byte(strings.TrimSpace(v)))
+		h.Write([]byte{0})
+	}
+	if !d.config.IgnoreIP {
+		ip := req.IPAddress
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		field(ip)
+	}
+	if !d.config.IgnoreTemplate {
+		templates := m.templates.get()
+		field(templates.textSource)
+		field(templates.htmlSource)
+	}
+	field(req.FirstName)
+	field(req.LastName)
+	field(req.ProductSerial)
+	field(req.ProductModel)
+	field(req.PhoneNumber)
+	field(req.CompanyName)
+	field(strings.ToLower(req.EmailAddress))
+	field(req.Description)
+	field(req.InReplyTo)
+	field(strings.Join(req.References, " "))
+	field(req.Recipient)
+	field(strings.Join(req.Recipients, ","))
+	field(req.Brand)
+	if req.TokenRecipient != nil {
+		field(strings.ToLower(req.TokenRecipient.Address))
+	}
+	//maps marshal with sorted keys
+	data, _ := json.Marshal(req.Data)
+	field(string(data))
+	for _, a := range req.Attachments {
+		sum := sha256.Sum256(a.Data)
+		field(a.Filename)
+		field(hex.EncodeToString(sum[:]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//claim returns the entry of an identical submission still within the
+//window, or registers req as a new one, reporting which it did
+func (d *deduplicator) claim(key, requestID string) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for k, e := range d.entries {
+		if now.After(e.expires) {
+			delete(d.entries, k)
+		}
+	}
+	if e, ok := d.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{requestID: requestID, expires: now.Add(d.config.Window), done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+//finish stores the outcome of the submission that claimed key. Failed
+//submissions are forgotten so they can be retried.
+func (d *deduplicator) finish(key string, e *dedupEntry, outcome EmailSendOutcome, err error) {
+	e.outcome, e.err = outcome, err
+	close(e.done)
+	if err != nil || outcome.Error != nil {
+		d.mu.Lock()
+		if d.entries[key] == e {
+			delete(d.entries, key)
+		}
+		d.mu.Unlock()
+	}
+}
+
+//dispatch sends data and waits for the outcome, unless an identical
+//submission was seen recently, whose outcome is returned instead
+func (s *server) dispatch(ctx context.Context, data EmailSendRequest) (outcome EmailSendOutcome, err error) {
+	if s.status != nil {
+		s.status.start(data.ID)
+		defer func() {
+			//paused requests are finished once they are sent
+			if !outcome.Queued {
+				s.status.finish(data.ID, outcome, err)
+			}
+		}()
+	}
+	if s.dedup == nil {
+		return s.submit(ctx, data)
+	}
+	key := s.dedup.key(&data, &s.config.EmailConfig)
+	e, first := s.dedup.claim(key, data.ID)
+	if !first {
+		metrics.inc("duplicate_requests_suppressed_total")
+		infoLogger.Printf("Request %s duplicates request %s, not sending it again", data.ID, e.requestID)
+		return e.wait(ctx)
+	}
+	outcome, err = s.submit(ctx, data)
+	s.dedup.finish(key, e, outcome, err)
+	return outcome, err
+}
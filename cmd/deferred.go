@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGreylistRetryDelay = 10 * time.Minute
+	defaultGreylistMaxRetries = 3
+	//deferredPollInterval is how often due deliveries are looked for
+	deferredPollInterval = 15 * time.Second
+)
+
+//GreylistConfig defers recipients whose server greylisted us and retries
+//them after RetryDelay. Pending deliveries are kept in StateFile so they
+//survive restarts, gzipped with CompressState.
+type GreylistConfig struct {
+	RetryDelay    time.Duration `yaml:"RetryDelay"`
+	MaxRetries    int           `yaml:"MaxRetries"`
+	StateFile     string        `yaml:"StateFile"`
+	CompressState bool          `yaml:"CompressState"`
+}
+
+func init() {
+	metrics.describe("deferred_deliveries_pending", gaugeMetric, "Greylisted deliveries waiting for a retry")
+	metrics.describe("deferred_deliveries_total", counterMetric, "Greylisted deliveries by final result")
+}
+
+//isGreylisted reports whether err looks like a greylisting rejection: a
+//450/451 reply, usually saying so or asking to try again later
+func isGreylisted(err error) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || (tpErr.Code != 450 && tpErr.Code != 451) {
+		return false
+	}
+	msg := strings.ToLower(tpErr.Msg)
+	for _, hint := range []string{"greylist", "graylist", "try again", "4.7.1", "4.2.0"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+//deferredDelivery is a message to one recipient waiting for a retry
+type deferredDelivery struct {
+	RequestID string    `json:"requestId"`
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	MessageID string    `json:"messageId"`
+	Message   []byte    `json:"message"`
+	Attempts  int       `json:"attempts"`
+	Due       time.Time `json:"due"`
+	//Sender is the address of the identity the message is sent as
+	Sender string `json:"sender,omitempty"`
+}
+
+func (d *deferredDelivery) key() string {
+	return d.RequestID + " " + d.Recipient
+}
+
+//journalRecord is a line of the state file. Later records for the same key
+//replace earlier ones, a record without Delivery removes the key. Lines
+//are JSON, or base64 encoded gzipped JSON with CompressState.
+type journalRecord struct {
+	Key      string            `json:"key"`
+	Delivery *deferredDelivery `json:"delivery,omitempty"`
+}
+
+//encode returns the line r is stored as
+func (r journalRecord) encode(compress bool) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil || !compress {
+		return line, err
+	}
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw := gzip.NewWriter(enc)
+	if _, err = zw.Write(line); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//decodeJournalRecord parses a line of the state file, whether it was
+//compressed or not, so CompressState can be toggled on an existing file
+func decodeJournalRecord(line []byte) (journalRecord, error) {
+	var r journalRecord
+	if len(line) > 0 && line[0] != '{' {
+		zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(line)))
+		if err != nil {
+			return r, err
+		}
+		if line, err = ioutil.ReadAll(zr); err != nil {
+			return r, err
+		}
+	}
+	err := json.Unmarshal(line, &r)
+	return r, err
+}
+
+//deferredQueue keeps greylisted deliveries until they are retried
+type deferredQueue struct {
+	config GreylistConfig
+	mail   *MailConfig
+
+	mu      sync.Mutex
+	pending map[string]*deferredDelivery
+	journal *os.File
+}
+
+//openDeferredQueue loads the pending deliveries from the state file, if
+//one is configured, and compacts it
+func openDeferredQueue(m *MailConfig, config GreylistConfig) (*deferredQueue, error) {
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultGreylistRetryDelay
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = defaultGreylistMaxRetries
+	}
+	q := &deferredQueue{config: config, mail: m, pending: make(map[string]*deferredDelivery)}
+	if config.StateFile == "" {
+		return q, nil
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	metrics.set("deferred_deliveries_pending", float64(len(q.pending)))
+	if len(q.pending) > 0 {
+		infoLogger.Printf("Loaded %d deferred deliveries from %s", len(q.pending), config.StateFile)
+	}
+	return q, nil
+}
+
+func (q *deferredQueue) replay() error {
+	f, err := os.Open(q.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var r journalRecord
+		if r, err = decodeJournalRecord(scanner.Bytes()); err != nil {
+			//most likely the last record, cut short by a crash. Compacting
+			//drops it from the file.
+			errorLogger.Printf("Skipping corrupt record on line %d of %s: %v", line, q.config.StateFile, err)
+			continue
+		}
+		if r.Delivery == nil {
+			delete(q.pending, r.Key)
+		} else {
+			q.pending[r.Key] = r.Delivery
+		}
+	}
+	return scanner.Err()
+}
+
+//compact rewrites the state file with only the pending deliveries and
+//opens it for appending
+func (q *deferredQueue) compact() error {
+	tmp := q.config.StateFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for key, d := range q.pending {
+		if err = q.write(f, journalRecord{key, d}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err = os.Rename(tmp, q.config.StateFile); err != nil {
+		return err
+	}
+	q.journal, err = os.OpenFile(q.config.StateFile, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (q *deferredQueue) write(f *os.File, r journalRecord) error {
+	line, err := r.encode(q.config.CompressState)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+//persist records the current state of key. q.mu must be held.
+func (q *deferredQueue) persist(key string, d *deferredDelivery) error {
+	if q.journal == nil {
+		return nil
+	}
+	if err := q.write(q.journal, journalRecord{key, d}); err != nil {
+		return err
+	}
+	return q.journal.Sync()
+}
+
+//schedule defers a greylisted delivery by RetryDelay
+func (q *deferredQueue) schedule(d *deferredDelivery) error {
+	d.Due = time.Now().Add(q.config.RetryDelay)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.persist(d.key(), d); err != nil {
+		return fmt.Errorf("persisting deferred delivery: %w", err)
+	}
+	q.pending[d.key()] = d
+	metrics.set("deferred_deliveries_pending", float64(len(q.pending)))
+	return nil
+}
+
+//remove forgets a delivery that landed or was given up on
+func (q *deferredQueue) remove(d *deferredDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, d.key())
+	if err := q.persist(d.key(), nil); err != nil {
+		errorLogger.Printf("Persisting removal of deferred delivery %s: %v", d.key(), err)
+	}
+	metrics.set("deferred_deliveries_pending", float64(len(q.pending)))
+}
+
+//due returns the deliveries whose retry time has come
+func (q *deferredQueue) due() []*deferredDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []*deferredDelivery
+	now := time.Now()
+	for _, d := range q.pending {
+		if !d.Due.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+//run retries due deliveries, forever
+func (q *deferredQueue) run() {
+	for range time.Tick(deferredPollInterval) {
+		for _, d := range q.due() {
+			q.retry(d)
+		}
+	}
+}
+
+func (q *deferredQueue) retry(d *deferredDelivery) {
+	d.Attempts++
+	tlsStatus, _, err := q.mail.sendBatched(context.Background(), q.mail.identities.find(d.Sender), q.mail.envelopeFrom(d.Recipient), []string{d.Recipient}, d.Message)
+	if err != nil && isGreylisted(err) && d.Attempts < q.config.MaxRetries {
+		infoLogger.Printf("Deferred delivery of request %s to %s greylisted again (attempt %d): %v", d.RequestID, d.Recipient, d.Attempts, err)
+		if err = q.schedule(d); err == nil {
+			return
+		}
+	}
+	q.remove(d)
+	q.mail.sentLog.record(d.RequestID, d.Recipient, d.Subject, d.MessageID, tlsStatus, err)
+	details := map[string]interface{}{"recipient": d.Recipient, "attempts": d.Attempts}
+	if err != nil {
+		metrics.inc("deferred_deliveries_total", "result", "failure")
+		details["error"] = err.Error()
+		errorLogger.Printf("Deferred delivery of request %s to %s failed after %d attempts: %v", d.RequestID, d.Recipient, d.Attempts, err)
+	} else {
+		metrics.inc("deferred_deliveries_total", "result", "success")
+		infoLogger.Printf("Deferred delivery of request %s to %s succeeded after %d attempts", d.RequestID, d.Recipient, d.Attempts)
+	}
+	audit("deferred_delivery", d.RequestID, details)
+}
@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//digestShutdownTimeout bounds how long the digest flushed on shutdown may
+//take to send
+const digestShutdownTimeout = time.Minute
+
+//DigestConfig collects matching requests into a single summary message,
+//sent every Interval or once MaxItems requests are pending, whichever
+//comes first. Either may be 0, but not both.
+type DigestConfig struct {
+	//Priorities are the priorities of the requests collected, "normal" by
+	//default. Requests for a single recipient are always sent right away.
+	Priorities []string      `yaml:"Priorities"`
+	Interval   time.Duration `yaml:"Interval"`
+	MaxItems   int           `yaml:"MaxItems"`
+	//Subject replaces the configured one for digests
+	Subject string `yaml:"Subject"`
+	//Template renders the body, ranging over .Items, the collected
+	//requests. Their attachments aren't sent.
+	Template string `yaml:"Template"`
+	//AllowedRecipients restricts the recipients of digests like
+	//MailConfig.AllowedRecipients
+	AllowedRecipients []string `yaml:"AllowedRecipients"`
+
+	priorities map[Priority]bool
+	template   templateExecutor
+	allowed    recipientAllowlist
+}
+
+func init() {
+	metrics.describe("digest_pending_items", gaugeMetric, "Requests waiting for the next digest")
+	metrics.describe("digests_sent_total", counterMetric, "Digests handed to the workers")
+}
+
+//load validates the config and compiles the template with engine and
+//funcs
+func (c *DigestConfig) load(engine string, funcs template.FuncMap) error {
+	if c.Interval <= 0 && c.MaxItems <= 0 {
+		return errors.New("digest needs an Interval or MaxItems")
+	}
+	if c.Template == "" {
+		return errors.New("digest needs a Template")
+	}
+	names := c.Priorities
+	if len(names) == 0 {
+		names = []string{PriorityNormal.String()}
+	}
+	c.priorities = make(map[Priority]bool)
+	for _, name := range names {
+		p, err := parsePriority(name)
+		if err != nil {
+			return err
+		}
+		c.priorities[p] = true
+	}
+	var err error
+	if c.allowed, err = parseAllowlist(c.AllowedRecipients); err != nil {
+		return err
+	}
+	c.template, err = parseTemplate(engine, funcs, "Digest", c.Template, false)
+	return err
+}
+
+//digestBatch is the template data of a digest, and marks the request
+//carrying it
+type digestBatch struct {
+	Items []EmailSendRequest
+	//Since and Until are when the first and last items came in
+	Since time.Time
+	Until time.Time
+
+	subject  string
+	template templateExecutor
+	allowed  recipientAllowlist
+}
+
+//retitle applies the digest Subject to h. It does nothing on a nil batch,
+//i.e. for requests that aren't digests.
+func (d *digestBatch) retitle(h *Header) {
+	if d != nil && d.subject != "" {
+		h.Subject = d.subject
+	}
+}
+
+//digester holds the requests waiting for the next digest
+type digester struct {
+	config DigestConfig
+	queue  requestQueue
+	//done is called for each request once its digest was sent
+	done func(EmailSendRequest, EmailSendOutcome)
+
+	mu      sync.Mutex
+	pending []EmailSendRequest
+	//flushing tracks digests being sent, for shutdown to wait on
+	flushing sync.WaitGroup
+}
+
+func newDigester(config DigestConfig, queue requestQueue, done func(EmailSendRequest, EmailSendOutcome)) *digester {
+	metrics.set("digest_pending_items", 0)
+	return &digester{config: config, queue: queue, done: done}
+}
+
+//matches reports whether data goes into the digest
+func (d *digester) matches(data *EmailSendRequest) bool {
+	return data.Recipient == "" && d.config.priorities[data.Priority]
+}
+
+//add collects data for the next digest, sending it if MaxItems is reached
+func (d *digester) add(data EmailSendRequest) EmailSendOutcome {
+	data.Result, data.Done = nil, nil
+	data.EnqueuedAt = time.Now()
+	d.mu.Lock()
+	d.pending = append(d.pending, data)
+	metrics.set("digest_pending_items", float64(len(d.pending)))
+	full := d.config.MaxItems > 0 && len(d.pending) >= d.config.MaxItems
+	d.mu.Unlock()
+	infoLogger.Printf("Request %s collected for the next digest", data.ID)
+	if full {
+		d.flush()
+	}
+	return EmailSendOutcome{Queued: true, Digest: true}
+}
+
+//flush hands the pending requests to the workers as one digest, in the
+//background
+func (d *digester) flush() {
+	d.mu.Lock()
+	items := d.pending
+	d.pending = nil
+	metrics.set("digest_pending_items", 0)
+	if len(items) > 0 {
+		d.flushing.Add(1)
+	}
+	d.mu.Unlock()
+	if len(items) == 0 {
+		return
+	}
+
+	result := make(chan EmailSendOutcome, 1)
+	digest := EmailSendRequest{
+		ID:     newRequestID(),
+		Result: result,
+		digest: &digestBatch{
+			Items:    items,
+			Since:    items[0].EnqueuedAt,
+			Until:    items[len(items)-1].EnqueuedAt,
+			subject:  d.config.Subject,
+			template: d.config.template,
+			allowed:  d.config.allowed,
+		},
+	}
+	infoLogger.Printf("Sending digest %s of %d requests", digest.ID, len(items))
+	metrics.inc("digests_sent_total")
+	go func() {
+		defer d.flushing.Done()
+		d.queue.enqueue(digest)
+		outcome := <-result
+		if outcome.Error != nil {
+			errorLogger.Printf("Sending digest %s: %v", digest.ID, outcome.Error)
+		}
+		for _, item := range items {
+			d.done(item, outcome)
+		}
+	}()
+}
+
+//run sends a digest every Interval
+func (d *digester) run() {
+	if d.config.Interval <= 0 {
+		return
+	}
+	for range time.Tick(d.config.Interval) {
+		d.flush()
+	}
+}
+
+//stop sends the pending requests and waits for the digests in flight,
+//for up to digestShutdownTimeout
+func (d *digester) stop() error {
+	d.flush()
+	sent := make(chan struct{})
+	go func() {
+		d.flushing.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return nil
+	case <-time.After(digestShutdownTimeout):
+		return fmt.Errorf("digest not sent within %v", digestShutdownTimeout)
+	}
+}
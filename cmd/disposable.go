@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"strings"
+	"sync"
+	"time"
+)
+
+//builtinDisposableDomains is used when no File or URL is configured
+//
+//go:embed disposable_domains.txt
+var builtinDisposableDomains []byte
+
+//DisposableDomainsConfig rejects submissions from disposable email
+//domains. The list, one domain per line, is read from URL or File, or the
+//built-in one if both are empty. With URL and Interval it's re-read
+//periodically.
+type DisposableDomainsConfig struct {
+	URL      string        `yaml:"URL"`
+	File     string        `yaml:"File"`
+	Interval time.Duration `yaml:"Interval"`
+	Timeout  time.Duration `yaml:"Timeout"`
+}
+
+func init() {
+	metrics.describe("disposable_domain_rejections_total", counterMetric, "Submissions rejected for a disposable email domain")
+	metrics.describe("disposable_domains", gaugeMetric, "Domains in the disposable domain list")
+}
+
+//disposableDomains holds the current list, which may be replaced while
+//requests are checked against it
+type disposableDomains struct {
+	config DisposableDomainsConfig
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+func parseDomainList(content []byte) map[string]bool {
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.ToLower(strings.TrimSuffix(line, "."))] = true
+	}
+	return domains
+}
+
+//newDisposableDomains loads the configured list
+func newDisposableDomains(config DisposableDomainsConfig) (*disposableDomains, error) {
+	d := &disposableDomains{config: config}
+	if config.URL == "" && config.File == "" {
+		d.set(parseDomainList(builtinDisposableDomains))
+		return d, nil
+	}
+	content, err := fetchSource(config.URL, config.File, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	d.set(parseDomainList(content))
+	return d, nil
+}
+
+func (d *disposableDomains) set(domains map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.domains = domains
+	metrics.set("disposable_domains", float64(len(domains)))
+}
+
+//match returns the listed domain address belongs to, checking parent
+//domains too, or "" if it isn't disposable
+func (d *disposableDomains) match(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(address[at+1:]), "."))
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for domain != "" {
+		if d.domains[domain] {
+			return domain
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return ""
+}
+
+//watch re-reads the list from URL every Interval, forever, keeping the
+//last good list if that fails
+func (d *disposableDomains) watch() {
+	for range time.Tick(d.config.Interval) {
+		content, err := fetchSource(d.config.URL, "", d.config.Timeout)
+		if err != nil {
+			errorLogger.Printf("Refreshing disposable domains from %s failed, keeping last good list: %v", d.config.URL, err)
+			continue
+		}
+		d.set(parseDomainList(content))
+	}
+}
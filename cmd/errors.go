@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+)
+
+//ErrorCategory classifies why an email couldn't be sent
+type ErrorCategory string
+
+//Error categories of a SendError
+const (
+	//CategoryValidation means the request itself is unacceptable
+	CategoryValidation ErrorCategory = "validation"
+	//CategoryTemplate means a template failed to render
+	CategoryTemplate ErrorCategory = "template"
+	//CategoryConnection means the server couldn't be reached or the
+	//connection broke down
+	CategoryConnection ErrorCategory = "connection"
+	//CategoryAuth means the server rejected our credentials
+	CategoryAuth ErrorCategory = "auth"
+	//CategoryRejected means the server permanently refused the message
+	CategoryRejected ErrorCategory = "rejected"
+	//CategoryTemporary means the server refused the message for now
+	CategoryTemporary ErrorCategory = "temporary"
+	//CategoryTimeout means sending took longer than allowed
+	CategoryTimeout ErrorCategory = "timeout"
+	//CategoryUnavailable means sending wasn't attempted, see
+	//ErrServiceUnavailable, ErrQueueFull and ErrWarmupCap
+	CategoryUnavailable ErrorCategory = "unavailable"
+	//CategoryExpired means the request waited in the queue for too long
+	//and was dropped unsent, see QueueConfig.MaxAge
+	CategoryExpired ErrorCategory = "expired"
+	//CategoryNotAllowed means the template may not be sent to the
+	//recipient, see MailConfig.AllowedRecipients
+	CategoryNotAllowed ErrorCategory = "not_allowed"
+	//CategoryInternal is anything else
+	CategoryInternal ErrorCategory = "internal"
+)
+
+//SendError is the error of a failed EmailSendOutcome
+type SendError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+func init() {
+	metrics.describe("email_send_failures_total", counterMetric, "Failed email requests by error category")
+}
+
+//newSendError wraps err in a SendError, classifying it unless it already
+//is one
+func newSendError(err error) *SendError {
+	var sendErr *SendError
+	if errors.As(err, &sendErr) {
+		return sendErr
+	}
+	return &SendError{Category: classifyError(err), Err: err}
+}
+
+func classifyError(err error) ErrorCategory {
+	var limitErr *LimitError
+	var threatErr *ThreatError
+	var tpErr *textproto.Error
+	var apiErr *apiError
+	var smErr *sendmailError
+	var rejErr *rejectedRecipientsError
+	var handshakeErr *tlsHandshakeError
+	var netErr net.Error
+	var allowErr *RecipientNotAllowedError
+	switch {
+	case errors.As(err, &limitErr), errors.As(err, &threatErr):
+		return CategoryValidation
+	case errors.As(err, &allowErr):
+		return CategoryNotAllowed
+	case errors.Is(err, context.DeadlineExceeded):
+		return CategoryTimeout
+	case errors.Is(err, ErrServiceUnavailable), errors.Is(err, ErrQueueFull), errors.Is(err, ErrWarmupCap):
+		return CategoryUnavailable
+	case errors.Is(err, ErrRequestExpired):
+		return CategoryExpired
+	case errors.As(err, &tpErr):
+		switch {
+		case tpErr.Code == 530 || tpErr.Code == 534 || tpErr.Code == 535 || tpErr.Code == 538:
+			return CategoryAuth
+		case tpErr.Code >= 500:
+			return CategoryRejected
+		}
+		return CategoryTemporary
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden:
+			return CategoryAuth
+		case apiErr.temporary():
+			return CategoryTemporary
+		}
+		return CategoryRejected
+	case errors.As(err, &rejErr):
+		return CategoryRejected
+	case errors.As(err, &smErr):
+		if smErr.temporary() {
+			return CategoryTemporary
+		}
+		return CategoryRejected
+	case errors.Is(err, errAUTHUnavailable):
+		return CategoryAuth
+	case errors.As(err, &handshakeErr), errors.Is(err, errSTARTTLSUnavailable), errors.As(err, &netErr):
+		return CategoryConnection
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		//the server hung up, e.g. in the middle of DATA
+		return CategoryConnection
+	}
+	return CategoryInternal
+}
+
+//httpStatus is the status clientHandler answers a request failing with a
+//category with
+func (c ErrorCategory) httpStatus() int {
+	switch c {
+	case CategoryValidation:
+		return http.StatusUnprocessableEntity
+	case CategoryConnection, CategoryAuth, CategoryRejected, CategoryTemporary:
+		return http.StatusBadGateway
+	case CategoryNotAllowed:
+		return http.StatusForbidden
+	case CategoryTimeout:
+		return http.StatusGatewayTimeout
+	case CategoryUnavailable, CategoryExpired:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
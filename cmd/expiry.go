@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+//ErrRequestExpired is returned for a request that waited in the queue for
+//longer than QueueConfig.MaxAge
+var ErrRequestExpired = errors.New("request expired in the queue")
+
+//expired reports whether r waited in the queue for longer than maxAge
+func (r *EmailSendRequest) expired(maxAge time.Duration) bool {
+	return maxAge > 0 && !r.EnqueuedAt.IsZero() && time.Since(r.EnqueuedAt) > maxAge
+}
+
+//expire drops req without sending it
+func (m *MailConfig) expire(req *EmailSendRequest) {
+	age := time.Since(req.EnqueuedAt).Round(time.Second)
+	errorLogger.Printf("Dropping request %s, it waited in the queue for %s", req.ID, age)
+	if err := m.deadLetters.add(req, ErrRequestExpired); err != nil {
+		errorLogger.Printf("Dead-lettering request %s: %v", req.ID, err)
+	}
+	m.reply(req, EmailSendOutcome{Error: ErrRequestExpired})
+}
+
+//deadLetter is a line of the dead letter file
+type deadLetter struct {
+	Time    time.Time         `json:"time"`
+	Reason  string            `json:"reason"`
+	Request *EmailSendRequest `json:"request"`
+}
+
+//deadLetterFile keeps the requests given up on, one JSON object per line,
+//so they can be looked into or submitted again
+type deadLetterFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openDeadLetterFile(filename string) (*deadLetterFile, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterFile{f: f}, nil
+}
+
+//add appends req with the reason it was given up on. It's a no-op on a
+//nil file.
+func (d *deadLetterFile) add(req *EmailSendRequest, reason error) error {
+	if d == nil {
+		return nil
+	}
+	line, err := json.Marshal(deadLetter{Time: time.Now(), Reason: reason.Error(), Request: req})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.f.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+//relay is one server messages can be sent through, together with its own
+//circuit breaker
+type relay struct {
+	name    string
+	sender  Sender
+	breaker *circuitBreaker
+}
+
+func init() {
+	metrics.describe("smtp_connection_attempts_total", counterMetric, "SMTP connections attempted per server")
+	metrics.describe("smtp_connection_successes_total", counterMetric, "SMTP transactions completed per server")
+	metrics.describe("smtp_connection_failures_total", counterMetric, "SMTP connections or transactions failed per server")
+	metrics.describe("smtp_open_connections", gaugeMetric, "Currently open SMTP connections per server")
+	metrics.describe("sends_in_flight", gaugeMetric, "Sends currently holding a concurrency slot")
+}
+
+//inheritSender fills in the identity of a failover server left empty from
+//the primary sender
+func (s *SenderConfig) inheritSender(primary *SenderConfig) {
+	if s.Address == "" {
+		s.Address = primary.Address
+		s.Password = primary.Password
+		s.ClientCertificateFile = primary.ClientCertificateFile
+		s.ClientKeyFile = primary.ClientKeyFile
+		s.Identities = primary.Identities
+		s.Brands = primary.Brands
+	}
+	if s.Name == "" {
+		s.Name = primary.Name
+	}
+}
+
+func newRelay(s *SenderConfig, breaker BreakerConfig) *relay {
+	return &relay{
+		name:    s.serverName(),
+		sender:  s.newSender(),
+		breaker: newCircuitBreaker(s.serverName(), breaker),
+	}
+}
+
+//newRelays returns the primary sender followed by the failover servers,
+//in the order they are tried. They are shared by all emailer instances.
+func (m *MailConfig) newRelays() []*relay {
+	relays := []*relay{newRelay(&m.Sender, m.CircuitBreaker)}
+	for i := range m.Failover {
+		relays = append(relays, newRelay(&m.Failover[i], m.CircuitBreaker))
+	}
+	return relays
+}
+
+//sendVia sends msg as identity id, if it isn't nil, through the first
+//relay that accepts it, with from as the envelope sender unless it's
+//empty. Relays are only failed over on temporary errors, a permanent
+//rejection or greylisting would be the same everywhere.
+func (m *MailConfig) sendVia(ctx context.Context, id *SenderIdentity, from string, to []string, msg []byte) (string, error) {
+	if from == "" {
+		from = id.address()
+	}
+	envFrom, envTo, err := envelopeAddresses(from, to)
+	if err != nil {
+		return "", err
+	}
+	if err = m.warmup.take(len(envTo)); err != nil {
+		return "", err
+	}
+	relays := m.relays
+	var tlsStatus string
+	for i, rl := range relays {
+		err = m.retryFor(to).withRetry(ctx, rl.breaker, func() error {
+			weight, err := m.acquireSendSlot(ctx, len(envTo))
+			if err != nil {
+				return err
+			}
+			defer m.releaseSendSlot(weight)
+			sendCtx := ctx
+			if m.SendTimeout > 0 {
+				var cancel context.CancelFunc
+				sendCtx, cancel = context.WithTimeout(ctx, m.SendTimeout)
+				defer cancel()
+			}
+			atomic.AddInt32(m.sendsInFlight, 1)
+			defer atomic.AddInt32(m.sendsInFlight, -1)
+			return m.ConnectRetry.whileUnreachable(sendCtx, rl.name, func() error {
+				var sendErr error
+				tlsStatus, sendErr = rl.sender.Send(sendCtx, &Message{From: envFrom, To: envTo, Data: msg, Identity: id})
+				return sendErr
+			})
+		})
+		if err == nil || !isTemporary(err) || isGreylisted(err) {
+			break
+		}
+		if i+1 < len(relays) {
+			errorLogger.Printf("Sending through %s failed, failing over to %s: %v", rl.name, relays[i+1].name, err)
+		}
+	}
+	var rejErr *rejectedRecipientsError
+	if errors.As(err, &rejErr) {
+		rejErr.relabel(to, envTo)
+	}
+	if err == nil && id != nil {
+		metrics.inc("emails_sent_by_identity_total", "identity", id.Address)
+	}
+	return tlsStatus, err
+}
+
+//acquireSendSlot blocks until the MaxConcurrentSends cap, across all
+//emailer instances, has room for a transaction to n recipients, or ctx is
+//done. A transaction weighs a send per recipient, as providers rate by
+//recipient, but never more than the whole cap.
+func (m *MailConfig) acquireSendSlot(ctx context.Context, n int) (int64, error) {
+	if m.sendSlots == nil {
+		return 0, nil
+	}
+	weight := int64(n)
+	if weight > int64(m.MaxConcurrentSends) {
+		weight = int64(m.MaxConcurrentSends)
+	}
+	if err := m.sendSlots.Acquire(ctx, weight); err != nil {
+		return 0, err
+	}
+	metrics.add("sends_in_flight", 1)
+	return weight, nil
+}
+
+//releaseSendSlot gives back the weight acquireSendSlot took
+func (m *MailConfig) releaseSendSlot(weight int64) {
+	if m.sendSlots == nil {
+		return
+	}
+	m.sendSlots.Release(weight)
+	metrics.add("sends_in_flight", -1)
+}
+
+//defaultMaxRecipientsPerMessage is the RCPT count every server must
+//accept per RFC 5321, and what most providers cap transactions at
+const defaultMaxRecipientsPerMessage = 100
+
+//maxRecipients returns the configured recipients per SMTP transaction
+func (m *MailConfig) maxRecipients() int {
+	if m.MaxRecipientsPerMessage <= 0 {
+		return defaultMaxRecipientsPerMessage
+	}
+	return m.MaxRecipientsPerMessage
+}
+
+//sendBatched sends msg to all of to, splitting them into as many SMTP
+//transactions as the recipients per message limit requires. Every batch is
+//attempted; the first failure is returned along with the number of batches.
+func (m *MailConfig) sendBatched(ctx context.Context, id *SenderIdentity, from string, to []string, msg []byte) (string, int, error) {
+	limit := m.maxRecipients()
+	batches := (len(to) + limit - 1) / limit
+	var tlsStatus string
+	var firstErr error
+	for i := 0; i < batches; i++ {
+		end := (i + 1) * limit
+		if end > len(to) {
+			end = len(to)
+		}
+		status, err := m.sendVia(ctx, id, from, to[i*limit:end], msg)
+		if err != nil {
+			if batches > 1 {
+				err = fmt.Errorf("batch %d/%d: %w", i+1, batches, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if tlsStatus == "" || status == tlsNone {
+			tlsStatus = status
+		}
+	}
+	return tlsStatus, batches, firstErr
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestSendSlots(t *testing.T) {
+	m := &MailConfig{MaxConcurrentSends: 3, sendSlots: semaphore.NewWeighted(3)}
+	//two single recipient sends fit next to each other
+	a, err := m.acquireSendSlot(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.acquireSendSlot(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a transaction to more recipients than the cap waits for all of it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err = m.acquireSendSlot(ctx, 10); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want to give up once the context is done", err)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("waited %v for a slot after the context was done", waited)
+	}
+
+	m.releaseSendSlot(a)
+	m.releaseSendSlot(b)
+	weight, err := m.acquireSendSlot(context.Background(), 10)
+	if err != nil || weight != 3 {
+		t.Fatalf("got weight %d (%v), want the whole cap", weight, err)
+	}
+	m.releaseSendSlot(weight)
+}
+
+func TestSendSlotsUncapped(t *testing.T) {
+	m := &MailConfig{}
+	weight, err := m.acquireSendSlot(context.Background(), 100)
+	if err != nil || weight != 0 {
+		t.Errorf("got weight %d (%v) without a cap", weight, err)
+	}
+	m.releaseSendSlot(weight)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"bytes"
+)
+
+//FooterConfig is appended to every message, e.g. the company address
+//required by legal. Both variants are templates executed with the same
+//data as the body.
+type FooterConfig struct {
+	//Text is appended to the plain text body
+	Text string `yaml:"Text"`
+	//HTML is inserted before the closing body tag of the HTML body, or
+	//appended if there is none
+	HTML string `yaml:"HTML"`
+}
+
+//parseFooter compiles the footer templates into t
+func (t *templateSet) parseFooter(footer *FooterConfig) error {
+	if footer == nil {
+		return nil
+	}
+	var err error
+	if footer.Text != "" {
+		if t.textFooter, err = parseTemplate(t.engine, t.funcs, "Footer", footer.Text, false); err != nil {
+			return err
+		}
+	}
+	if footer.HTML != "" {
+		if t.htmlFooter, err = parseTemplate(t.engine, t.funcs, "HTMLFooter", footer.HTML, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//addFooter renders the footers of templates for req and adds them to the
+//rendered bodies
+func (m *MailConfig) addFooter(templates *templateSet, req *EmailSendRequest, text, html []byte) ([]byte, []byte, error) {
+	if templates.textFooter != nil {
+		footer, err := m.Limits.render("footer", templates.textFooter, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		text = append(append(text, '\n'), footer...)
+	}
+	if templates.htmlFooter != nil && html != nil {
+		footer, err := m.Limits.render("HTML footer", templates.htmlFooter, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		html = insertBeforeBodyEnd(html, footer)
+	}
+	return text, html, nil
+}
+
+//insertBeforeBodyEnd inserts fragment before the last </body> of html, or
+//appends it
+func insertBeforeBodyEnd(html, fragment []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(html), []byte("</body>"))
+	if i < 0 {
+		return append(html, fragment...)
+	}
+	out := make([]byte, 0, len(html)+len(fragment))
+	out = append(out, html[:i]...)
+	out = append(out, fragment...)
+	return append(out, html[i:]...)
+}
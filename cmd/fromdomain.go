@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+func init() {
+	metrics.describe("from_domain_violations_total", counterMetric, "Sends refused for a From address outside AllowedFromDomains")
+}
+
+//FromDomainError means a message would go out with a From address outside
+//MailConfig.AllowedFromDomains, which would fail DMARC
+type FromDomainError struct {
+	Address string
+}
+
+func (e *FromDomainError) Error() string {
+	return fmt.Sprintf("From address %s is not in an allowed domain", e.Address)
+}
+
+//checkFrom fails with a FromDomainError if any address of from is outside
+//AllowedFromDomains
+func (m *MailConfig) checkFrom(from string) error {
+	if len(m.fromDomains) == 0 {
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil || len(addrs) == 0 {
+		metrics.inc("from_domain_violations_total")
+		return &FromDomainError{Address: from}
+	}
+	for _, a := range addrs {
+		if !m.fromDomains.allows(a.Address[strings.LastIndex(a.Address, "@")+1:]) {
+			metrics.inc("from_domain_violations_total")
+			return &FromDomainError{Address: a.Address}
+		}
+	}
+	return nil
+}
+
+//checkStaticFrom checks the From addresses of the config: the header's,
+//those of recipient header overrides, identities and brands. Recipients
+//that come from a RecipientSource are checked as they are sent to.
+func (m *MailConfig) checkStaticFrom() error {
+	froms := map[string]string{"Header.From": m.Header.From}
+	for key, r := range m.Recipients {
+		if r.Header != nil && r.Header.From != "" {
+			froms["the header override of recipient "+key] = r.Header.From
+		}
+	}
+	for i := range m.Sender.Identities {
+		froms[fmt.Sprintf("identity %d", i+1)] = m.Sender.Identities[i].from()
+	}
+	for key, id := range m.Sender.Brands {
+		froms["brand "+key] = id.from()
+	}
+	var violations []string
+	for where, from := range froms {
+		if from == "" {
+			continue
+		}
+		if err := m.checkFrom(from); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", where, err))
+		}
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return fmt.Errorf("%d From addresses outside AllowedFromDomains: %s", len(violations), strings.Join(violations, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,480 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//maxRepeatBytes caps what repeat may produce, so a template can't exhaust
+//memory
+const maxRepeatBytes = 1 << 20
+
+//TemplateFunctionsConfig gives Go templates the functions of
+//templateFunctions, named and called like their Sprig counterparts, minus
+//those in Disable
+type TemplateFunctionsConfig struct {
+	Disable []string `yaml:"Disable"`
+}
+
+//templateFunctions is a curated subset of the Sprig library, with the
+//value piped in as the last argument:
+//
+//strings: trim trimPrefix trimSuffix upper lower title repeat substr trunc
+//abbrev contains hasPrefix hasSuffix replace quote squote nospace indent
+//nindent splitList join
+//defaults: default empty coalesce ternary
+//math: add add1 sub mul div mod max min floor ceil round
+//dates: now date toDate dateModify unixEpoch
+//lists: list first last rest has uniq sortAlpha compact
+//dictionaries: dict get hasKey keys
+//conversion: atoi int int64 float64 toString toStrings b64enc b64dec
+//
+//Sprig functions reading the environment (env, expandenv), resolving
+//names (getHostByName) or generating keys and passwords (genPrivateKey,
+//derivePassword and the like) are left out on purpose, as nothing in the
+//templates should reach beyond their data. There is no file access either.
+var templateFunctions = template.FuncMap{
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"repeat":     repeatString,
+	"substr":     substring,
+	"trunc":      truncate,
+	"abbrev":     abbreviate,
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"quote":      func(v ...interface{}) string { return joinQuoted(v, strconv.Quote) },
+	"squote":     func(v ...interface{}) string { return joinQuoted(v, func(s string) string { return "'" + s + "'" }) },
+	"nospace":    func(s string) string { return strings.Join(strings.Fields(s), "") },
+	"indent":     indentLines,
+	"nindent":    func(n int, s string) string { return "\n" + indentLines(n, s) },
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, v interface{}) string { return strings.Join(toStrings(v), sep) },
+
+	"default":  func(d, v interface{}) interface{} { return choose(v, d, !isEmpty(v)) },
+	"empty":    isEmpty,
+	"coalesce": firstNonEmpty,
+	"ternary":  choose,
+
+	"add": func(a interface{}, b ...interface{}) int64 {
+		return fold(a, b, func(x, y int64) int64 { return x + y })
+	},
+	"add1": func(a interface{}) int64 { return toInt64(a) + 1 },
+	"sub":  func(a, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+	"mul": func(a interface{}, b ...interface{}) int64 {
+		return fold(a, b, func(x, y int64) int64 { return x * y })
+	},
+	"div":   divInt,
+	"mod":   modInt,
+	"max":   func(a interface{}, b ...interface{}) int64 { return fold(a, b, maxInt64) },
+	"min":   func(a interface{}, b ...interface{}) int64 { return fold(a, b, minInt64) },
+	"floor": func(a interface{}) float64 { return math.Floor(toFloat64(a)) },
+	"ceil":  func(a interface{}) float64 { return math.Ceil(toFloat64(a)) },
+	"round": roundPlaces,
+
+	"now":        time.Now,
+	"date":       formatDate,
+	"toDate":     parseDate,
+	"dateModify": addDuration,
+	"unixEpoch":  func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+
+	"list":      func(v ...interface{}) []interface{} { return v },
+	"first":     func(v interface{}) interface{} { return listAt(toList(v), 0) },
+	"last":      func(v interface{}) interface{} { l := toList(v); return listAt(l, len(l)-1) },
+	"rest":      listRest,
+	"has":       listHas,
+	"uniq":      uniqList,
+	"sortAlpha": func(v interface{}) []string { s := toStrings(v); sort.Strings(s); return s },
+	"compact":   compactList,
+
+	"dict":   makeDict,
+	"get":    func(d map[string]interface{}, key string) interface{} { return d[key] },
+	"hasKey": func(d map[string]interface{}, key string) bool { _, ok := d[key]; return ok },
+	"keys":   sortedKeys,
+
+	"atoi":      func(s string) int { n, _ := strconv.Atoi(strings.TrimSpace(s)); return n },
+	"int":       func(v interface{}) int { return int(toInt64(v)) },
+	"int64":     toInt64,
+	"float64":   toFloat64,
+	"toString":  toString,
+	"toStrings": toStrings,
+	"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":    b64dec,
+}
+
+//funcMap returns templateFunctions without the disabled ones. It's
+//nil-safe, returning no functions.
+func (c *TemplateFunctionsConfig) funcMap(engine string) (template.FuncMap, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if engine == TemplateEngineMustache {
+		return nil, errors.New("template functions need the go template engine")
+	}
+	funcs := make(template.FuncMap, len(templateFunctions))
+	for name, f := range templateFunctions {
+		funcs[name] = f
+	}
+	for _, name := range c.Disable {
+		if _, ok := funcs[name]; !ok {
+			return nil, fmt.Errorf("unknown template function %q", name)
+		}
+		delete(funcs, name)
+	}
+	return funcs, nil
+}
+
+func repeatString(count int, s string) (string, error) {
+	if count < 0 || count > 0 && len(s) > maxRepeatBytes/count {
+		return "", errors.New("repeat: result too large")
+	}
+	return strings.Repeat(s, count), nil
+}
+
+//substring returns the runes of s from start to end, to its end if end is
+//negative
+func substring(start, end int, s string) string {
+	r := []rune(s)
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end > len(r) {
+		end = len(r)
+	}
+	if start > end {
+		return ""
+	}
+	return string(r[start:end])
+}
+
+//truncate keeps the first n runes of s, or the last -n if n is negative
+func truncate(n int, s string) string {
+	r := []rune(s)
+	switch {
+	case n >= 0 && n < len(r):
+		return string(r[:n])
+	case n < 0 && -n < len(r):
+		return string(r[len(r)+n:])
+	}
+	return s
+}
+
+//abbreviate shortens s to width runes with an ellipsis
+func abbreviate(width int, s string) string {
+	r := []rune(s)
+	if width < 4 || len(r) <= width {
+		return s
+	}
+	return string(r[:width-3]) + "..."
+}
+
+func indentLines(n int, s string) string {
+	if n < 0 {
+		n = 0
+	}
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func joinQuoted(v []interface{}, quote func(string) string) string {
+	quoted := make([]string, 0, len(v))
+	for _, s := range v {
+		if s != nil {
+			quoted = append(quoted, quote(toString(s)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+//isEmpty reports whether v is nil or the zero value of its type, or an empty
+//collection
+func isEmpty(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+func firstNonEmpty(v ...interface{}) interface{} {
+	for _, x := range v {
+		if !isEmpty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func choose(a, b interface{}, cond bool) interface{} {
+	if cond {
+		return a
+	}
+	return b
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64); err == nil {
+			return i
+		}
+		return int64(toFloat64(n))
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		return int64(toFloat64(n))
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint())
+	}
+	return int64(toFloat64(v))
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	case bool:
+		if n {
+			return 1
+		}
+		return 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+	return 0
+}
+
+func fold(a interface{}, b []interface{}, op func(x, y int64) int64) int64 {
+	acc := toInt64(a)
+	for _, x := range b {
+		acc = op(acc, toInt64(x))
+	}
+	return acc
+}
+
+func maxInt64(x, y int64) int64 {
+	if y > x {
+		return y
+	}
+	return x
+}
+
+func minInt64(x, y int64) int64 {
+	if y < x {
+		return y
+	}
+	return x
+}
+
+func divInt(a, b interface{}) (int64, error) {
+	d := toInt64(b)
+	if d == 0 {
+		return 0, errors.New("div: division by zero")
+	}
+	return toInt64(a) / d, nil
+}
+
+func modInt(a, b interface{}) (int64, error) {
+	d := toInt64(b)
+	if d == 0 {
+		return 0, errors.New("mod: division by zero")
+	}
+	return toInt64(a) % d, nil
+}
+
+//roundPlaces rounds a half away from zero to places decimals
+func roundPlaces(a interface{}, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(toFloat64(a)*p) / p
+}
+
+//toTime accepts the times and Unix timestamps date formats
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t != nil {
+			return *t, nil
+		}
+	case int, int32, int64, json.Number:
+		return time.Unix(toInt64(t), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("%v is not a time", v)
+}
+
+//formatDate formats t with a Go layout such as "2006-01-02"
+func formatDate(layout string, t interface{}) (string, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return "", err
+	}
+	return tm.Format(layout), nil
+}
+
+func parseDate(layout, s string) (time.Time, error) {
+	return time.Parse(layout, s)
+}
+
+//addDuration adds a duration such as "-1.5h" to t
+func addDuration(d string, t interface{}) (time.Time, error) {
+	tm, err := toTime(t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	dur, err := time.ParseDuration(d)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tm.Add(dur), nil
+}
+
+//toList turns a slice or array of any type into a list, anything else into
+//a list of itself
+func toList(v interface{}) []interface{} {
+	if l, ok := v.([]interface{}); ok {
+		return l
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		l := make([]interface{}, rv.Len())
+		for i := range l {
+			l[i] = rv.Index(i).Interface()
+		}
+		return l
+	case reflect.Invalid:
+		return nil
+	}
+	return []interface{}{v}
+}
+
+func listAt(l []interface{}, i int) interface{} {
+	if i < 0 || i >= len(l) {
+		return nil
+	}
+	return l[i]
+}
+
+func listRest(v interface{}) []interface{} {
+	l := toList(v)
+	if len(l) == 0 {
+		return l
+	}
+	return l[1:]
+}
+
+func listHas(needle, v interface{}) bool {
+	for _, x := range toList(v) {
+		if reflect.DeepEqual(x, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqList(v interface{}) []interface{} {
+	var l []interface{}
+	for _, x := range toList(v) {
+		if !listHas(x, l) {
+			l = append(l, x)
+		}
+	}
+	return l
+}
+
+func compactList(v interface{}) []interface{} {
+	var l []interface{}
+	for _, x := range toList(v) {
+		if !isEmpty(x) {
+			l = append(l, x)
+		}
+	}
+	return l
+}
+
+func makeDict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+	d := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		d[toString(v[i])] = v[i+1]
+	}
+	return d, nil
+}
+
+//sortedKeys returns the keys of d, sorted
+func sortedKeys(d map[string]interface{}) []string {
+	k := make([]string, 0, len(d))
+	for key := range d {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case nil:
+		return ""
+	case fmt.Stringer:
+		return s.String()
+	case []byte:
+		return string(s)
+	}
+	return fmt.Sprint(v)
+}
+
+func toStrings(v interface{}) []string {
+	l := toList(v)
+	s := make([]string, 0, len(l))
+	for _, x := range l {
+		s = append(s, toString(x))
+	}
+	return s
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
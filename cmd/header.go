@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	//maxHeaderLine is the line length RFC 5322 asks for, longer fields
+	//are folded where they have whitespace
+	maxHeaderLine = 78
+	//maxHeaderLineHard is the line length RFC 5322 forbids exceeding
+	maxHeaderLineHard = 998
+)
+
+//headerWriter assembles header fields. Whatever a value contains, it
+//can't break out of its field: line breaks and other control characters
+//are replaced by spaces.
+type headerWriter struct {
+	b   strings.Builder
+	eol string
+}
+
+//sanitizeHeaderValue replaces control characters, CR and LF included,
+//with spaces
+func sanitizeHeaderValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, v)
+}
+
+//raw adds a field whose value needs no encoding, folding it at spaces.
+//A word too long for any line is split, which is the lesser evil.
+func (w *headerWriter) raw(name, value string) {
+	w.b.WriteString(name)
+	w.b.WriteByte(':')
+	//col is the length of the current line, blank is set until a word is
+	//written
+	col, blank := len(name)+1, true
+	//the words of value, split as by strings.Fields without allocating
+	rest := sanitizeHeaderValue(value)
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			break
+		}
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		word := rest[:end]
+		rest = rest[end:]
+		for len(word) > 0 {
+			if col+1+len(word) > maxHeaderLine && !blank {
+				w.b.WriteString(w.eol)
+				col = 0
+			}
+			n := len(word)
+			if room := maxHeaderLineHard - col - 1; n > room {
+				n = room
+				for n > 0 && !utf8.RuneStart(word[n]) {
+					n--
+				}
+			}
+			w.b.WriteByte(' ')
+			w.b.WriteString(word[:n])
+			col += 1 + n
+			blank = false
+			word = word[n:]
+		}
+	}
+	if blank {
+		w.b.WriteByte(' ')
+	}
+	w.b.WriteString(w.eol)
+}
+
+//text adds an unstructured field such as Subject, RFC 2047 encoded unless
+//it's plain ASCII
+func (w *headerWriter) text(name, value string) {
+	//the encoder splits the value into words short enough to fold
+	w.raw(name, mime.QEncoding.Encode("utf-8", sanitizeHeaderValue(value)))
+}
+
+//formattedAddresses caches address lists as addresses writes them, by
+//value, as parsing dominates building a header. The From and recipient
+//addresses of the config repeat in every message; addresses from
+//requests might not, so caching stops at maxFormattedAddresses entries.
+var (
+	formattedAddresses      sync.Map
+	formattedAddressEntries int32
+)
+
+const maxFormattedAddresses = 1024
+
+//addresses adds an address list field. Addresses that parse are written
+//in canonical form, display names encoded as needed; anything else is
+//written as is.
+func (w *headerWriter) addresses(name, value string) {
+	if cached, ok := formattedAddresses.Load(value); ok {
+		w.raw(name, cached.(string))
+		return
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		w.raw(name, value)
+		return
+	}
+	formatted := make([]string, len(list))
+	for i, a := range list {
+		formatted[i] = a.String()
+		if a.Name == "" {
+			formatted[i] = a.Address
+		}
+	}
+	joined := strings.Join(formatted, ", ")
+	if atomic.LoadInt32(&formattedAddressEntries) < maxFormattedAddresses {
+		if _, loaded := formattedAddresses.LoadOrStore(value, joined); !loaded {
+			atomic.AddInt32(&formattedAddressEntries, 1)
+		}
+	}
+	w.raw(name, joined)
+}
+
+//HeaderOverride replaces parts of the global Header for one recipient
+//group. Empty fields keep the global value.
+type HeaderOverride struct {
+	From    string `yaml:"From"`
+	Subject string `yaml:"Subject"`
+	ReplyTo string `yaml:"ReplyTo"`
+}
+
+//validate rejects addresses that don't parse and values that would break
+//out of their header line
+func (o *HeaderOverride) validate() error {
+	for name, v := range map[string]string{"From": o.From, "Subject": o.Subject, "ReplyTo": o.ReplyTo} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("header override %s contains a line break", name)
+		}
+	}
+	for name, v := range map[string]string{"From": o.From, "ReplyTo": o.ReplyTo} {
+		if v == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(v); err != nil {
+			return fmt.Errorf("header override %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+//headerFor returns the header messages to r are sent with
+func (m *MailConfig) headerFor(r Recipient) *Header {
+	if r.Header == nil {
+		return &m.Header
+	}
+	h := m.Header
+	if r.Header.From != "" {
+		h.From = r.Header.From
+	}
+	if r.Header.Subject != "" {
+		h.Subject = r.Header.Subject
+	}
+	if r.Header.ReplyTo != "" {
+		h.ReplyTo = r.Header.ReplyTo
+	}
+	return &h
+}
+
+//messageHeader returns the header of a message of req based on base, as
+//id if it isn't nil, with the fields set per message
+func (m *MailConfig) messageHeader(req *EmailSendRequest, base *Header, id *SenderIdentity) Header {
+	header := *base
+	req.digest.retitle(&header)
+	if id != nil {
+		header.From = id.from()
+	}
+	header.MessageID = m.newMessageID(req.ID)
+	header.InReplyTo = req.InReplyTo
+	header.References = req.References
+	header.Tags = m.Tagging.headers(req)
+	return header
+}
+
+//tagged returns h with the SubjectPrefix and Environment applied
+func (m *MailConfig) tagged(h *Header) *Header {
+	if m.SubjectPrefix == "" && m.Environment == "" {
+		return h
+	}
+	t := *h
+	t.Subject = m.SubjectPrefix + t.Subject
+	t.Environment = m.Environment
+	return &t
+}
+
+//validateEnvironment rejects a SubjectPrefix or Environment that would
+//break out of its header line
+func (m *MailConfig) validateEnvironment() error {
+	for name, v := range map[string]string{"SubjectPrefix": m.SubjectPrefix, "Environment": m.Environment} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("%s contains a line break", name)
+		}
+	}
+	return nil
+}
+
+//normalize checks the MIME and Miscellaneous blocks, which are written
+//into the header as they are, and folds their fields anew
+func (h *Header) normalize() error {
+	var err error
+	if h.MIME, err = normalizeHeaderBlock(h.MIME); err != nil {
+		return fmt.Errorf("MIME: %w", err)
+	}
+	if h.Miscellaneous, err = normalizeHeaderBlock(h.Miscellaneous); err != nil {
+		return fmt.Errorf("Miscellaneous: %w", err)
+	}
+	return nil
+}
+
+//normalizeHeaderBlock parses block as header fields, a line each with
+//folded lines starting with whitespace, and returns them folded at
+//maxHeaderLine without a trailing line break. Anything that would corrupt
+//the header is rejected: blank lines, which end it, lines that aren't
+//fields, and control or non-ASCII characters, which need encoding.
+func normalizeHeaderBlock(block string) (string, error) {
+	block = strings.TrimRight(strings.ReplaceAll(block, "\r\n", "\n"), "\n")
+	if block == "" {
+		return "", nil
+	}
+	var names, values []string
+	for i, line := range strings.Split(block, "\n") {
+		for _, r := range line {
+			if (r < ' ' && r != '\t') || r > '~' {
+				return "", fmt.Errorf("line %d contains %q, which must be encoded", i+1, r)
+			}
+		}
+		switch {
+		case strings.TrimSpace(line) == "":
+			return "", fmt.Errorf("line %d is blank, which would end the header", i+1)
+		case line[0] == ' ' || line[0] == '\t':
+			if len(values) == 0 {
+				return "", errors.New("the first line continues no field")
+			}
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 || !isHeaderName(line[:colon]) {
+			return "", fmt.Errorf("line %d is not a header field: %q", i+1, line)
+		}
+		names = append(names, line[:colon])
+		values = append(values, strings.TrimSpace(line[colon+1:]))
+	}
+	w := &headerWriter{eol: "\n"}
+	for i, name := range names {
+		w.raw(name, values[i])
+	}
+	return strings.TrimSuffix(w.b.String(), "\n"), nil
+}
+
+//validateHeaderOverrides checks the header overrides of all recipients
+func validateHeaderOverrides(recipients map[string]Recipient) error {
+	for key, r := range recipients {
+		if r.Header == nil {
+			continue
+		}
+		if err := r.Header.validate(); err != nil {
+			return fmt.Errorf("recipient %q: %w", key, err)
+		}
+	}
+	return nil
+}
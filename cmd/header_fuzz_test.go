@@ -0,0 +1,84 @@
+//go:build go1.18
+// +build go1.18
+
+package cmd
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+//FuzzHeaderFields checks that whatever From, To and Subject hold, the
+//fields written for them stay well formed: CRLF ended lines no longer
+//than RFC 5322 allows, folded with whitespace, no line breaks or other
+//controls smuggled in, no fields but those written, and a Subject that
+//decodes back to its value.
+func FuzzHeaderFields(f *testing.F) {
+	f.Add("Docs <docs@example.com>", "sales@example.com", "New request")
+	f.Add("docs@example.com", "a@example.com, b@example.com", "x\r\nBcc: evil@example.com")
+	f.Add("docs@example.com\r\nBcc: evil@example.com", "sales@example.com\nX-Injected: 1", "bare\rCR and\x00NUL")
+	f.Add("\"Dócs, Teäm\" <docs@example.com>", "Säles <sales@example.com>", "Ünïcødé subject, with an encoded word =?utf-8?q?x?= in it")
+	f.Add("docs@example.com", "sales@example.com", strings.Repeat("long subject ", 40))
+	f.Add("docs@example.com", "sales@example.com", strings.Repeat("x", 2000))
+	f.Add("docs@example.com", "sales@example.com", strings.Repeat("é", 700))
+	f.Add("", "", "")
+	f.Fuzz(func(t *testing.T, from, to, subject string) {
+		h := &Header{From: from, Subject: subject, MessageID: "<id@example.com>"}
+		fields := h.fields(to, "\r\n")
+		if !strings.HasSuffix(fields, "\r\n") {
+			t.Fatalf("fields don't end with CRLF: %q", fields)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSuffix(fields, "\r\n"), "\r\n") {
+			if len(line) > maxHeaderLineHard {
+				t.Fatalf("line of %d octets: %q", len(line), line)
+			}
+			for _, r := range line {
+				if r == '\r' || r == '\n' || unicode.IsControl(r) {
+					t.Fatalf("control character %q in line %q", r, line)
+				}
+			}
+			switch {
+			case line == "":
+				t.Fatalf("blank line ends the header early: %q", fields)
+			case line[0] == ' ' || line[0] == '\t':
+				if len(names) == 0 {
+					t.Fatalf("header starts with a folded line: %q", fields)
+				}
+			default:
+				names = append(names, line[:strings.IndexByte(line, ':')+1])
+			}
+		}
+		if got := strings.Join(names, " "); got != "From: To: Subject: Message-ID:" {
+			t.Fatalf("got fields %q in %q", got, fields)
+		}
+
+		msg, err := mail.ReadMessage(strings.NewReader(fields + "\r\n"))
+		if err != nil {
+			t.Fatalf("unreadable header %q: %v", fields, err)
+		}
+		want := sanitizeHeaderValue(subject)
+		if strings.Contains(want, "=?") || !utf8.ValidString(subject) {
+			//text that looks encoded would be decoded, and invalid UTF-8
+			//comes back replaced
+			return
+		}
+		got, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil {
+			t.Fatalf("undecodable Subject %q: %v", msg.Header.Get("Subject"), err)
+		}
+		if mime.QEncoding.Encode("utf-8", want) != want {
+			if got != want {
+				t.Fatalf("Subject %q decodes to %q", want, got)
+			}
+		} else if long := len(want) > maxHeaderLineHard/2; !long && strings.Join(strings.Fields(got), " ") != strings.Join(strings.Fields(want), " ") {
+			//plain text is folded at spaces, only words too long for a
+			//line get split
+			t.Fatalf("Subject %q reads as %q", want, got)
+		}
+	})
+}
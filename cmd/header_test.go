@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHeaderBlock(t *testing.T) {
+	long := "X-Campaign: " + strings.Repeat("spring-launch ", 12)
+	tests := []struct {
+		name, block, want string
+	}{
+		{"empty", "", ""},
+		{"trailing line breaks", "X-Mailer: docs-email-sender\r\n\r\n", "X-Mailer: docs-email-sender"},
+		{"CRLF", "X-A: one\r\nX-B: two", "X-A: one\nX-B: two"},
+		{"spacing", "X-A:one\nX-B:   two   ", "X-A: one\nX-B: two"},
+		{"unfolded", "X-A: one\n two\n\tthree", "X-A: one two three"},
+		{"folded", long, "X-Campaign: spring-launch spring-launch spring-launch spring-launch\n" +
+			" spring-launch spring-launch spring-launch spring-launch spring-launch\n" +
+			" spring-launch spring-launch spring-launch"},
+	}
+	for _, test := range tests {
+		got, err := normalizeHeaderBlock(test.block)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		//normalizing is idempotent
+		if again, err := normalizeHeaderBlock(got); err != nil || again != got {
+			t.Errorf("%s: normalizing again gave %q (%v)", test.name, again, err)
+		}
+	}
+}
+
+func TestNormalizeHeaderBlockInvalid(t *testing.T) {
+	for name, block := range map[string]string{
+		"blank line":        "X-A: one\n\nX-B: two",
+		"whitespace line":   "X-A: one\n \nX-B: two",
+		"no colon":          "X-A: one\nthis is the body",
+		"bad field name":    "X Campaign: spring",
+		"empty field name":  ": spring",
+		"leading fold":      " X-A: one",
+		"non-ASCII":         "X-Team: Köln",
+		"control character": "X-A: one\x00two",
+		"bare CR":           "X-A: one\rX-B: two",
+	} {
+		if got, err := normalizeHeaderBlock(block); err == nil {
+			t.Errorf("%s: %q is accepted as %q", name, block, got)
+		}
+	}
+}
+
+func TestHeaderNormalize(t *testing.T) {
+	h := benchHeader()
+	h.MIME = "Content-Type: text/plain;\n charset=\"utf-8\"\nContent-Transfer-Encoding: base64\n"
+	h.Miscellaneous = "X-Mailer: docs-email-sender\r\nX-Campaign: " + strings.Repeat("spring-launch ", 12)
+	if err := h.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	msg := buildPlainMessage(h, "sales@example.com", []byte("hello\n"))
+	header := msg[:bytes.Index(msg, []byte("\r\n\r\n"))+2]
+	for i, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line != "" && (!strings.HasSuffix(line, "\r\n") || len(line) > maxHeaderLine+2) {
+			t.Errorf("header line %d is %q", i+1, line)
+		}
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":              `text/plain; charset="utf-8"`,
+		"Content-Transfer-Encoding": "base64",
+		"X-Mailer":                  "docs-email-sender",
+		"X-Campaign":                strings.TrimSpace(strings.Repeat("spring-launch ", 12)),
+	} {
+		if got := m.Header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	h.Miscellaneous = "X-Mailer: docs-email-sender\n\nInjected body"
+	if err := h.normalize(); err == nil || !strings.HasPrefix(err.Error(), "Miscellaneous: ") {
+		t.Errorf("got %v, want Miscellaneous refused", err)
+	}
+}
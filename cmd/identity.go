@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+)
+
+//Identity selection strategies, see SenderConfig.IdentitySelection
+const (
+	IdentityRoundRobin = "round-robin"
+	IdentityHash       = "hash"
+)
+
+//SenderIdentity is one of the addresses messages are sent from, see
+//SenderConfig.Identities. The other settings are shared with the sender.
+type SenderIdentity struct {
+	Address  string `yaml:"SenderAddress"`
+	Name     string `yaml:"SenderName"`
+	Password string `yaml:"SenderPassword"`
+}
+
+func init() {
+	metrics.describe("emails_sent_by_identity_total", counterMetric, "Messages sent per sender identity")
+}
+
+//from returns the From header of messages sent as id
+func (id *SenderIdentity) from() string {
+	return (&mail.Address{Name: id.Name, Address: id.Address}).String()
+}
+
+//address returns the address of id, or "" for a nil identity
+func (id *SenderIdentity) address() string {
+	if id == nil {
+		return ""
+	}
+	return id.Address
+}
+
+//hasIdentities reports whether messages may be sent as other identities
+//than the sender itself
+func (s *SenderConfig) hasIdentities() bool {
+	return len(s.Identities) > 0 || len(s.Brands) > 0
+}
+
+//withIdentity returns a copy of s that authenticates as id
+func (s *SenderConfig) withIdentity(id *SenderIdentity) *SenderConfig {
+	c := *s
+	c.Address = id.Address
+	c.Name = id.Name
+	c.Password = id.Password
+	return &c
+}
+
+func (s *SenderConfig) validateIdentities() error {
+	switch s.IdentitySelection {
+	case "", IdentityRoundRobin, IdentityHash:
+	default:
+		return fmt.Errorf("unknown identity selection %q", s.IdentitySelection)
+	}
+	seen := make(map[string]bool)
+	for i, id := range s.Identities {
+		if err := id.validate(); err != nil {
+			return fmt.Errorf("identity %d: %w", i+1, err)
+		}
+		key := strings.ToLower(id.Address)
+		if seen[key] {
+			return fmt.Errorf("identity %s is listed twice", id.Address)
+		}
+		seen[key] = true
+	}
+	if len(s.Identities) == 0 && s.IdentitySelection != "" {
+		return errors.New("identity selection set without identities")
+	}
+	for key, id := range s.Brands {
+		if err := id.validate(); err != nil {
+			return fmt.Errorf("brand %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (id *SenderIdentity) validate() error {
+	if _, err := mail.ParseAddress(id.Address); err != nil {
+		return err
+	}
+	if err := validateDomain(id.Address); err != nil {
+		return err
+	}
+	if strings.ContainsAny(id.Name, "\r\n") {
+		return errors.New("name contains a line break")
+	}
+	return nil
+}
+
+//identityPicker chooses the identity each message is sent as
+type identityPicker struct {
+	identities []SenderIdentity
+	brands     map[string]SenderIdentity
+	hash       bool
+	next       uint32
+}
+
+//newIdentityPicker returns nil unless s has identities or brands
+func newIdentityPicker(s *SenderConfig) *identityPicker {
+	if !s.hasIdentities() {
+		return nil
+	}
+	return &identityPicker{identities: s.Identities, brands: s.Brands, hash: s.IdentitySelection == IdentityHash}
+}
+
+//pick returns the identity for a message to rcpt: the next one in turn,
+//or with IdentityHash always the same one for the same recipient. It
+//returns nil on a nil picker.
+func (p *identityPicker) pick(rcpt string) *SenderIdentity {
+	if p == nil || len(p.identities) == 0 {
+		return nil
+	}
+	var i uint32
+	if p.hash {
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(rcpt)))
+		i = h.Sum32()
+	} else {
+		i = atomic.AddUint32(&p.next, 1) - 1
+	}
+	return &p.identities[i%uint32(len(p.identities))]
+}
+
+//find returns the identity with the given address, or nil if there is
+//none, e.g. as it was removed from the config since
+func (p *identityPicker) find(address string) *SenderIdentity {
+	if p == nil {
+		return nil
+	}
+	for i := range p.identities {
+		if strings.EqualFold(p.identities[i].Address, address) {
+			return &p.identities[i]
+		}
+	}
+	for _, id := range p.brands {
+		if strings.EqualFold(id.Address, address) {
+			return &id
+		}
+	}
+	return nil
+}
+
+//brand returns the brand identity with the given key, or nil if there is
+//none or key is empty
+func (p *identityPicker) brand(key string) *SenderIdentity {
+	if p == nil || key == "" {
+		return nil
+	}
+	id, ok := p.brands[key]
+	if !ok {
+		return nil
+	}
+	return &id
+}
+
+//identityFor picks the identity the message of req to r is sent as: the
+//brand req asks for, if any. Otherwise recipients whose header override
+//sets From are sent as the sender itself.
+func (m *MailConfig) identityFor(req *EmailSendRequest, r Recipient) *SenderIdentity {
+	if id := m.identities.brand(req.Brand); id != nil {
+		return id
+	}
+	if r.Header != nil && r.Header.From != "" {
+		return nil
+	}
+	return m.identities.pick(r.Address)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+//idnaProfile converts domains for lookup, rejecting empty or overlong
+//labels too
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+//asciiAddress returns addr with an internationalized domain converted to
+//punycode, as SMTP servers without SMTPUTF8 only accept those in the
+//envelope. Headers keep the Unicode form. Malformed domains are an error.
+func asciiAddress(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || isASCII(addr[at+1:]) {
+		return addr, nil
+	}
+	domain, err := idnaProfile.ToASCII(addr[at+1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized domain in %q: %w", addr, err)
+	}
+	return addr[:at+1] + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+//envelopeAddress returns the sender's address as used in the envelope
+func (s *SenderConfig) envelopeAddress() string {
+	addr, err := asciiAddress(s.Address)
+	if err != nil {
+		//rejected by validate
+		return s.Address
+	}
+	return addr
+}
+
+//validateDomain rejects addr if its domain can't be converted to punycode
+func validateDomain(addr string) error {
+	_, err := asciiAddress(addr)
+	return err
+}
+
+//envelopeAddresses converts from and to with asciiAddress
+func envelopeAddresses(from string, to []string) (string, []string, error) {
+	from, err := asciiAddress(from)
+	if err != nil {
+		return "", nil, err
+	}
+	ascii := make([]string, len(to))
+	for i, rcpt := range to {
+		if ascii[i], err = asciiAddress(rcpt); err != nil {
+			return "", nil, err
+		}
+	}
+	return from, ascii, nil
+}
+
+//relabel reports the rejected recipients under the addresses in given
+//rather than their envelope form in ascii, index by index
+func (e *rejectedRecipientsError) relabel(given, ascii []string) {
+	rejected := make(map[string]error, len(e.rejected))
+	for rcpt, rcptErr := range e.rejected {
+		for i := range ascii {
+			if ascii[i] == rcpt {
+				rcpt = given[i]
+				break
+			}
+		}
+		rejected[rcpt] = rcptErr
+	}
+	e.rejected = rejected
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestASCIIAddress(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"user@münchen.de", "user@xn--mnchen-3ya.de"},
+		{"user@MÜNCHEN.de", "user@xn--mnchen-3ya.de"},
+		{"info@bücher.example", "info@xn--bcher-kva.example"},
+		{"contact@例え.jp", "contact@xn--r8jz45g.jp"},
+		//only the domain is converted, a Unicode local part needs SMTPUTF8
+		{"müller@example.com", "müller@example.com"},
+	}
+	for _, test := range tests {
+		got, err := asciiAddress(test.addr)
+		if err != nil || got != test.want {
+			t.Errorf("asciiAddress(%q) = %q, %v, want %q", test.addr, got, err, test.want)
+		}
+	}
+}
+
+func TestASCIIAddressInvalid(t *testing.T) {
+	for _, addr := range []string{
+		"user@münchen..de",
+		"user@" + strings.Repeat("ü", 64) + ".de",
+		"user@xn--mnchen-3ya.ü-",
+		"user@münchen\u0000.de",
+	} {
+		if got, err := asciiAddress(addr); err == nil {
+			t.Errorf("asciiAddress(%q) = %q, want an error", addr, got)
+		}
+		if validateDomain(addr) == nil {
+			t.Errorf("validateDomain(%q) accepts it", addr)
+		}
+	}
+}
+
+//TestIDNEnvelope sends to an IDN address: the envelope has the punycode
+//domain, with SMTPUTF8 requested if the server offers it, while refusals
+//are reported under the address as given
+func TestIDNEnvelope(t *testing.T) {
+	for _, smtputf8 := range []bool{false, true} {
+		s := startFakeSMTP(t, true, 0)
+		if smtputf8 {
+			s.mu.Lock()
+			s.extensions = []string{"SMTPUTF8"}
+			s.mu.Unlock()
+		}
+		given := []string{"user@münchen.de", "nobody@bücher.example"}
+		from, to, err := envelopeAddresses("docs@example.com", given)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = deliverTo(context.Background(), s, true, from, to...)
+		var rejErr *rejectedRecipientsError
+		if !errors.As(err, &rejErr) {
+			t.Fatalf("got %v, want the refused recipient reported", err)
+		}
+		rejErr.relabel(given, to)
+		if _, ok := rejErr.rejected["nobody@bücher.example"]; !ok || len(rejErr.rejected) != 1 {
+			t.Errorf("got rejected %v, want nobody@bücher.example", rejErr.rejected)
+		}
+
+		s.mu.Lock()
+		sent := strings.Join(s.reads, "")
+		s.mu.Unlock()
+		for _, want := range []string{"RCPT TO:<user@xn--mnchen-3ya.de>", "RCPT TO:<nobody@xn--bcher-kva.example>"} {
+			if !strings.Contains(sent, want) {
+				t.Errorf("the envelope lacks %s: %q", want, sent)
+			}
+		}
+		if got := strings.Contains(sent, " SMTPUTF8\r\n"); got != smtputf8 {
+			t.Errorf("SMTPUTF8 requested: %v, offered: %v", got, smtputf8)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//includesKey lists the config files a config file is layered on. They
+//are merged in order, each overriding the previous ones, and the including
+//file overrides them all. Relative paths are relative to the including
+//file, or URL.
+const includesKey = "Includes"
+
+//configFile is the layout of a single config file. Each file is checked
+//against it on its own, so misspelled keys are reported with the file
+//and line they are on rather than a line of the merged config.
+type configFile struct {
+	Includes     []string `yaml:"Includes"`
+	ServerConfig `yaml:",inline"`
+}
+
+//readConfigFile returns the content of filename with its includes merged
+//in, as YAML. filename may also be "-" for stdin or a URL, see
+//readConfigSource; a config from a URL is cached.
+func readConfigFile(filename string) ([]byte, error) {
+	merged, err := loadConfigTree(filename, nil)
+	var content []byte
+	if err == nil {
+		content, err = yaml.Marshal(merged)
+	}
+	if isConfigURL(filename) {
+		return cachedConfig(content, err)
+	}
+	return content, err
+}
+
+//loadConfigTree loads filename and its includes. stack holds the files
+//being loaded, to detect cycles.
+func loadConfigTree(filename string, stack []string) (map[interface{}]interface{}, error) {
+	path := filename
+	if !isConfigURL(path) && path != stdinConfig {
+		var err error
+		if path, err = filepath.Abs(filename); err != nil {
+			return nil, err
+		}
+	}
+	for i, p := range stack {
+		if p == path {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack[i:], path), " -> "))
+		}
+	}
+	stack = append(stack, path)
+
+	content, err := readConfigSource(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.UnmarshalStrict(content, &configFile{}); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	tree := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(content, &tree); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	raw, ok := tree[includesKey]
+	if !ok {
+		return tree, nil
+	}
+	delete(tree, includesKey)
+	includes, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a list of file names", path, includesKey)
+	}
+
+	merged := make(map[interface{}]interface{})
+	for _, inc := range includes {
+		name, ok := inc.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a list of file names", path, includesKey)
+		}
+		name, err := configLocation(path, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		included, err := loadConfigTree(name, stack)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfigTrees(merged, included)
+	}
+	mergeConfigTrees(merged, tree)
+	return merged, nil
+}
+
+//mergeConfigTrees merges src into dst. Mappings are merged key by key,
+//anything else in src, lists included, replaces what's in dst.
+func mergeConfigTrees(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[k].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfigTrees(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
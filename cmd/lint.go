@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+//strictLint, set with -strict, refuses to start on lint warnings
+var strictLint bool
+
+//noReplyPattern matches the local parts of addresses nobody reads
+var noReplyPattern = regexp.MustCompile(`(?i)^(no|do-?not)[-_.]?reply`)
+
+//replyInvitePattern matches wording asking recipients to answer by mail
+var replyInvitePattern = regexp.MustCompile(`(?i)\b(reply|respond)\s+(directly\s+)?to\s+this\s+(e-?mail|message)\b|\b(hit|just|simply)\s+reply\b`)
+
+//lint returns the deliverability problems of the config that don't stop
+//it from working, such as an empty Subject
+func (m *MailConfig) lint() []string {
+	var warnings []string
+	if strings.TrimSpace(m.Header.Subject) == "" {
+		warnings = append(warnings, "Header.Subject is empty, spam filters penalize messages without a subject")
+	}
+	if strings.TrimSpace(m.TemplateText) == "" {
+		warnings = append(warnings, "TemplateText is empty, messages have no plain text part spam filters and text clients can use")
+	}
+
+	replyTo := m.Header.ReplyTo
+	if replyTo == "" {
+		replyTo = m.Header.From
+	}
+	if addr := lintAddress(replyTo); addr != "" && noReplyPattern.MatchString(addr) {
+		if replyInvitePattern.MatchString(m.TemplateText) || replyInvitePattern.MatchString(m.HTMLTemplateText) {
+			warnings = append(warnings, fmt.Sprintf("the templates invite replies, but they go to the no-reply address %s", addr))
+		}
+	}
+
+	//messages sent as identities have them as the envelope sender too
+	if !m.Sender.hasIdentities() {
+		envelope := m.Sender.Address
+		if m.VERP != nil {
+			envelope = "@" + m.VERP.Domain
+		}
+		from := lintAddress(m.Header.From)
+		if from != "" && envelope != "" && !strings.EqualFold(lintDomain(from), lintDomain(envelope)) {
+			warnings = append(warnings, fmt.Sprintf("the From domain %s differs from the envelope sender domain %s, so DMARC fails unless the relay signs for %[1]s with DKIM", lintDomain(from), lintDomain(envelope)))
+		}
+	}
+	return warnings
+}
+
+//lintAddress returns the first address of list, or "" if there is none
+func lintAddress(list string) string {
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].Address
+}
+
+func lintDomain(addr string) string {
+	return addr[strings.LastIndex(addr, "@")+1:]
+}
+
+//reportLint logs warnings, failing instead with strictLint
+func reportLint(warnings []string) error {
+	if strictLint && len(warnings) > 0 {
+		return errors.New(strings.Join(warnings, "; "))
+	}
+	for _, w := range warnings {
+		errorLogger.Printf("WARNING: %s", w)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultManagerLookupTimeout  = 5 * time.Second
+	defaultManagerLookupCacheTTL = time.Hour
+)
+
+//ManagerLookupConfig points to a directory that maps a submitter's email
+//address to their manager's, who gets a BCC of the notification. With URL
+//the address is passed in the `email` query parameter and the response
+//body is the manager's address, 404 meaning there is none. File is a YAML
+//map of submitter to manager addresses. Exactly one of them should be set.
+type ManagerLookupConfig struct {
+	URL      string        `yaml:"URL"`
+	File     string        `yaml:"File"`
+	Timeout  time.Duration `yaml:"Timeout"`
+	CacheTTL time.Duration `yaml:"CacheTTL"`
+}
+
+func init() {
+	metrics.describe("manager_lookups_total", counterMetric, "Manager directory lookups by result")
+}
+
+type managerEntry struct {
+	manager string
+	expires time.Time
+}
+
+//managerDirectory caches lookups against the configured directory
+type managerDirectory struct {
+	config ManagerLookupConfig
+
+	mu    sync.Mutex
+	cache map[string]managerEntry
+}
+
+func newManagerDirectory(config ManagerLookupConfig) (*managerDirectory, error) {
+	if (config.URL == "") == (config.File == "") {
+		return nil, errors.New("exactly one of URL and File must be set")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultManagerLookupTimeout
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = defaultManagerLookupCacheTTL
+	}
+	return &managerDirectory{config: config, cache: make(map[string]managerEntry)}, nil
+}
+
+//manager returns the manager of submitter, or "" if they have none
+func (d *managerDirectory) manager(submitter string) (string, error) {
+	key := strings.ToLower(submitter)
+	d.mu.Lock()
+	e, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		metrics.inc("manager_lookups_total", "result", "cached")
+		return e.manager, nil
+	}
+
+	manager, err := d.fetch(submitter)
+	if err != nil {
+		metrics.inc("manager_lookups_total", "result", "failure")
+		return "", err
+	}
+	if manager != "" {
+		if _, err = mail.ParseAddress(manager); err != nil {
+			metrics.inc("manager_lookups_total", "result", "failure")
+			return "", fmt.Errorf("manager of %s: %w", submitter, err)
+		}
+	}
+	metrics.inc("manager_lookups_total", "result", "success")
+	d.mu.Lock()
+	d.cache[key] = managerEntry{manager: manager, expires: time.Now().Add(d.config.CacheTTL)}
+	d.mu.Unlock()
+	return manager, nil
+}
+
+func (d *managerDirectory) fetch(submitter string) (string, error) {
+	if d.config.File != "" {
+		content, err := ioutil.ReadFile(d.config.File)
+		if err != nil {
+			return "", err
+		}
+		managers := make(map[string]string)
+		if err = yaml.Unmarshal(content, &managers); err != nil {
+			return "", err
+		}
+		for s, m := range managers {
+			if strings.EqualFold(s, submitter) {
+				return m, nil
+			}
+		}
+		return "", nil
+	}
+
+	u, err := url.Parse(d.config.URL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("email", submitter)
+	u.RawQuery = q.Encode()
+	client := http.Client{Timeout: d.config.Timeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+//bccManager sends the submitter's manager a copy of the message addressed
+//to the recipients. A failed lookup only costs the copy.
+func (m *MailConfig) bccManager(ctx context.Context, req *EmailSendRequest, text, html []byte, attachments []Attachment) {
+	if m.managers == nil || req.EmailAddress == "" {
+		return
+	}
+	manager, err := m.managers.manager(req.EmailAddress)
+	if err != nil {
+		errorLogger.Printf("WARNING: looking up manager of %s failed, sending no BCC: %v", req.EmailAddress, err)
+		return
+	}
+	if manager == "" {
+		return
+	}
+	header := m.Header
+	id := m.identities.brand(req.Brand)
+	if id == nil {
+		id = m.identities.pick(manager)
+	}
+	if id != nil {
+		header.From = id.from()
+	}
+	msg, err := m.buildMessage(&header, strings.Join(m.recipientAddresses(), ", "), text, html, attachments)
+	if err != nil {
+		errorLogger.Printf("WARNING: building BCC for %s failed: %v", manager, err)
+		return
+	}
+	tlsStatus, _, err := m.sendBatched(ctx, id, m.envelopeFrom(manager), []string{manager}, msg)
+	m.sentLog.record(req.ID, manager, m.Header.Subject, "", tlsStatus, err)
+	if err != nil {
+		errorLogger.Printf("WARNING: sending BCC of request %s to %s failed: %v", req.ID, manager, err)
+	}
+}
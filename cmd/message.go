@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//base64LineLength is the maximum encoded line length allowed by RFC 2045
+const base64LineLength = 76
+
+//Attachment is a file submitted alongside an EmailSendRequest
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+//genericContentTypes carry no information about an attachment, which is
+//sniffed instead
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+	"application/binary":       true,
+}
+
+//attachmentContentType returns declared, or the sniffed type of data if
+//declared is missing or generic
+func attachmentContentType(declared string, data []byte) string {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil || genericContentTypes[strings.ToLower(mediaType)] {
+		return http.DetectContentType(data)
+	}
+	return declared
+}
+
+//MessageLimits restricts what a single message built from a template
+//may carry. Zero means unlimited.
+type MessageLimits struct {
+	MaxBodyBytes       int   `yaml:"MaxBodyBytes"`
+	MaxAttachments     int   `yaml:"MaxAttachments"`
+	MaxAttachmentBytes int64 `yaml:"MaxAttachmentBytes"`
+	//RenderTimeout and MaxRenderBytes abort a template that runs too long
+	//or produces too much, e.g. ranging over huge recipient data
+	RenderTimeout  time.Duration `yaml:"RenderTimeout"`
+	MaxRenderBytes int           `yaml:"MaxRenderBytes"`
+	//MaxMessageBytes rejects messages whose estimated size on the wire is
+	//larger, e.g. the relay's limit, before anything is sent
+	MaxMessageBytes int64 `yaml:"MaxMessageBytes"`
+}
+
+//Allowances for what estimatedSize can't know before the message is
+//built: the header, and the headers and boundaries of each MIME part
+const (
+	estimatedHeaderBytes   = 2048
+	estimatedMIMEPartBytes = 256
+)
+
+//LimitError reports which MessageLimits entry a request violated
+type LimitError struct {
+	Limit   string
+	Allowed int64
+	Actual  int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeded: got %d, allowed %d", e.Limit, e.Actual, e.Allowed)
+}
+
+//check validates the rendered bodies and attachments against the limits
+func (l *MessageLimits) check(text, html []byte, attachments []Attachment) error {
+	if body := len(text) + len(html); l.MaxBodyBytes > 0 && body > l.MaxBodyBytes {
+		return &LimitError{"MaxBodyBytes", int64(l.MaxBodyBytes), int64(body)}
+	}
+	if l.MaxAttachments > 0 && len(attachments) > l.MaxAttachments {
+		return &LimitError{"MaxAttachments", int64(l.MaxAttachments), int64(len(attachments))}
+	}
+	if l.MaxAttachmentBytes > 0 {
+		var total int64
+		for _, a := range attachments {
+			total += int64(len(a.Data))
+		}
+		if total > l.MaxAttachmentBytes {
+			return &LimitError{"MaxAttachmentBytes", l.MaxAttachmentBytes, total}
+		}
+	}
+	return nil
+}
+
+//base64Size returns the length of n bytes as written by writeBase64
+func base64Size(n int) int64 {
+	encoded := int64(base64.StdEncoding.EncodedLen(n))
+	lines := (encoded + base64LineLength - 1) / base64LineLength
+	if lines == 0 {
+		lines = 1
+	}
+	return encoded + 2*lines
+}
+
+//estimatedSize estimates the size of the message built from the bodies
+//and attachments, all of which are base64 encoded
+func estimatedSize(text, html []byte, attachments []Attachment) int64 {
+	size := int64(estimatedHeaderBytes)
+	parts := len(attachments)
+	for _, body := range [][]byte{text, html} {
+		if body != nil {
+			size += base64Size(len(body))
+			parts++
+		}
+	}
+	for _, a := range attachments {
+		size += base64Size(len(a.Data))
+	}
+	if parts > 1 {
+		size += int64(parts) * estimatedMIMEPartBytes
+	}
+	return size
+}
+
+//checkSize rejects the message if its estimated size exceeds
+//MaxMessageBytes, sparing the upload of a message the relay would refuse
+//at the end of DATA
+func (l *MessageLimits) checkSize(text, html []byte, attachments []Attachment) error {
+	if l.MaxMessageBytes <= 0 {
+		return nil
+	}
+	if size := estimatedSize(text, html, attachments); size > l.MaxMessageBytes {
+		return &LimitError{"MaxMessageBytes", l.MaxMessageBytes, size}
+	}
+	return nil
+}
+
+//lineWriter breaks its output into lines of at most n bytes
+type lineWriter struct {
+	w   io.Writer
+	n   int
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.col == l.n {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+		chunk := l.n - l.col
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		k, err := l.w.Write(p[:chunk])
+		written += k
+		l.col += k
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+//writeBase64 writes data base64 encoded in RFC 2045 sized lines
+func writeBase64(w io.Writer, data []byte) error {
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w, n: base64LineLength})
+	if _, err := enc.Write(data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+//mimePart is a node of a MIME message tree. Leaf parts carry a body
+//that is base64 encoded on output, multipart parts carry child parts.
+//A part with raw set has already been rendered, headers included.
+type mimePart struct {
+	contentType string
+	header      textproto.MIMEHeader
+	body        []byte
+	parts       []*mimePart
+	boundary    string
+	raw         []byte
+}
+
+func newMultipart(subtype string, parts ...*mimePart) *mimePart {
+	return &mimePart{
+		contentType: "multipart/" + subtype,
+		parts:       parts,
+		boundary:    multipart.NewWriter(nil).Boundary(),
+	}
+}
+
+func textPart(subtype string, body []byte) *mimePart {
+	return &mimePart{contentType: "text/" + subtype + "; charset=\"utf-8\"", body: body}
+}
+
+func attachmentPart(a Attachment) *mimePart {
+	contentType := a.ContentType
+	switch {
+	case contentType == "":
+		contentType = "application/octet-stream"
+	case inviteMethod(a) != "":
+		//the alternative is the invite, the attached copy a file to import
+		contentType = mime.FormatMediaType("application/ics", map[string]string{"name": a.Filename})
+	}
+	return &mimePart{
+		contentType: contentType,
+		header: textproto.MIMEHeader{
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		},
+		body: a.Data,
+	}
+}
+
+//headers returns the MIME headers describing the part
+func (p *mimePart) headers() textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	for k, v := range p.header {
+		h[k] = v
+	}
+	if len(p.parts) > 0 {
+		h.Set("Content-Type", fmt.Sprintf("%s; boundary=%q", p.contentType, p.boundary))
+	} else {
+		h.Set("Content-Type", p.contentType)
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
+	return h
+}
+
+//write writes the part's headers and body
+func (p *mimePart) write(w io.Writer) error {
+	if p.raw != nil {
+		_, err := w.Write(p.raw)
+		return err
+	}
+	writeHeaders(w, p.headers())
+	return p.writeBody(w)
+}
+
+//render returns the part as written by write
+func (p *mimePart) render() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := p.write(buf)
+	return buf.Bytes(), err
+}
+
+//writeBody writes everything following the part's headers
+func (p *mimePart) writeBody(w io.Writer) error {
+	if len(p.parts) == 0 {
+		return writeBase64(w, p.body)
+	}
+	for i, child := range p.parts {
+		delimiter := "\r\n--" + p.boundary + "\r\n"
+		if i == 0 {
+			delimiter = delimiter[2:]
+		}
+		if _, err := io.WriteString(w, delimiter); err != nil {
+			return err
+		}
+		if err := child.write(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n--"+p.boundary+"--\r\n")
+	return err
+}
+
+//writeHeaders writes h in a stable order followed by the blank line
+//separating headers from the body
+func writeHeaders(w io.Writer, h textproto.MIMEHeader) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	io.WriteString(w, "\r\n")
+}
+
+//buildMessage assembles the full message sent to `to` with header h. A
+//plain text body without attachments uses h verbatim; everything else
+//is built as a MIME tree: the text and html bodies become a
+//multipart/alternative, which is wrapped in a multipart/mixed together
+//with the attachments. A calendar invite among them is also one of the
+//alternatives. A nil text sends the html body alone. The result is
+//encrypted if `to` all have PGP keys, or else signed with S/MIME
+//configured. Lines end in CRLF either way. The message is dated now
+//unless h has a Date.
+func (m *MailConfig) buildMessage(h *Header, to string, text, html []byte, attachments []Attachment) ([]byte, error) {
+	h = m.tagged(h)
+	if h.Date.IsZero() {
+		dated := *h
+		dated.Date = time.Now()
+		h = &dated
+	}
+	if err := m.checkFrom(h.From); err != nil {
+		return nil, err
+	}
+	keys := m.pgp.keysFor(to)
+	if len(html) == 0 && len(attachments) == 0 && m.signer == nil && keys == nil {
+		return buildPlainMessage(h, to, text), nil
+	}
+
+	var root *mimePart
+	switch {
+	case text == nil && len(html) > 0:
+		root = textPart("html", html)
+	case len(html) > 0:
+		root = newMultipart("alternative", textPart("plain", text), textPart("html", html))
+	default:
+		root = textPart("plain", text)
+	}
+	for _, a := range attachments {
+		if inviteMethod(a) == "" {
+			continue
+		}
+		//calendar clients only take the invite for one among the
+		//alternatives, the attached copy is for the others
+		if len(root.parts) == 0 {
+			root = newMultipart("alternative", root)
+		}
+		root.parts = append(root.parts, &mimePart{contentType: a.ContentType, body: a.Data})
+	}
+	if len(attachments) > 0 {
+		root = newMultipart("mixed", root)
+		for _, a := range attachments {
+			root.parts = append(root.parts, attachmentPart(a))
+		}
+	}
+
+	var err error
+	switch {
+	case keys != nil:
+		root, err = m.pgp.encrypt(root, keys)
+	case m.signer != nil:
+		root, err = m.signer.sign(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(h.fields(to, "\r\n"))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	writeHeaders(buf, root.headers())
+	if err = root.writeBody(buf); err != nil {
+		return nil, err
+	}
+	return normalizeCRLF(buf.Bytes()), nil
+}
+
+//messageBuffers are the buffers of buildPlainMessage. Buffers grown past
+//maxPooledMessageBuffer aren't put back, so a rare huge message doesn't
+//stay in memory.
+var messageBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+const maxPooledMessageBuffer = 1 << 20
+
+//buildPlainMessage is buildMessage for a plain text body alone, which most
+//messages are. The header is used verbatim and the body base64 encoded
+//in RFC 2045 sized lines; the message is written with
+//CRLFs right away into a pooled buffer instead of being concatenated and
+//normalized afterwards. Header values are sanitized and the MIME and
+//Miscellaneous blocks were normalized, so the result is the same.
+func buildPlainMessage(h *Header, to string, text []byte) []byte {
+	buf := messageBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledMessageBuffer {
+			messageBuffers.Put(buf)
+		}
+	}()
+	buf.WriteString(h.fields(to, "\r\n"))
+	for _, block := range []string{h.MIME, h.Miscellaneous} {
+		for block != "" {
+			line := block
+			if i := strings.IndexByte(block, '\n'); i >= 0 {
+				line, block = block[:i], block[i+1:]
+			} else {
+				block = ""
+			}
+			buf.WriteString(line)
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	writeBase64(buf, text)
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+//normalizeCRLF ends every line of msg in CRLF, as SMTP requires, turning
+//bare LFs and CRs into CRLFs. Lines starting with a dot are stuffed by the
+//SMTP DATA writer, not here, as sendmail and SES take the message as is.
+func normalizeCRLF(msg []byte) []byte {
+	bare := 0
+	for i, b := range msg {
+		if (b == '\n' && (i == 0 || msg[i-1] != '\r')) || (b == '\r' && (i+1 == len(msg) || msg[i+1] != '\n')) {
+			bare++
+		}
+	}
+	if bare == 0 {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+bare)
+	for i, b := range msg {
+		switch {
+		case b == '\r' && i+1 < len(msg) && msg[i+1] == '\n':
+			out = append(out, b)
+		case b == '\r', b == '\n' && (i == 0 || msg[i-1] != '\r'):
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"testing"
+)
+
+//benchHeader is a typical notification header
+func benchHeader() *Header {
+	return &Header{
+		From:      "NTC Docs <docs@example.com>",
+		Subject:   "New request from ACME Corporation about product X-100",
+		MIME:      "Content-Type: text/plain; charset=\"utf-8\"\nContent-Transfer-Encoding: base64",
+		MessageID: "<abc.123@example.com>",
+		ReplyTo:   "support@example.com",
+	}
+}
+
+//benchText is a body of about 1 KB
+var benchText = bytes.Repeat([]byte("Hello there, this is the body of the notification.\n"), 20)
+
+func BenchmarkBuildMessage(b *testing.B) {
+	m := &MailConfig{}
+	b.Run("plain", func(b *testing.B) {
+		h := benchHeader()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.buildMessage(h, "Sales <sales@example.com>", benchText, nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("alternative", func(b *testing.B) {
+		h := benchHeader()
+		h.MIME = ""
+		html := []byte("<p>" + string(benchText) + "</p>")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.buildMessage(h, "Sales <sales@example.com>", benchText, html, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNormalizeCRLF(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"a\r\nb\r\n", "a\r\nb\r\n"},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"\n.\n", "\r\n.\r\n"},
+		{"a\rb\r", "a\r\nb\r\n"},
+		{"a\r\n\nb\r\r\n", "a\r\n\r\nb\r\n\r\n"},
+		{"\r\n\n\r", "\r\n\r\n\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(normalizeCRLF([]byte(test.in))); got != test.want {
+			t.Errorf("normalizeCRLF(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+//TestDotStuffing sends a body with a lone "." line, which would end DATA
+//early if it weren't stuffed, and bare LFs
+func TestDotStuffing(t *testing.T) {
+	body := "Subject: dots\n\nfirst\n.\n.hidden\nlast\n"
+	for _, pipelining := range []bool{false, true} {
+		s := startFakeSMTP(t, pipelining, 0)
+		msg := normalizeCRLF([]byte(body))
+		if _, err := deliver(context.Background(), s.addr, "", &tls.Config{ServerName: "fake"}, nil, TLSNone, pipelining, "docs@example.com", []string{"a@example.com"}, msg); err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		if want := "Subject: dots\r\n\r\nfirst\r\n..\r\n..hidden\r\nlast\r\n"; len(s.messages) != 1 || s.messages[0] != want {
+			t.Errorf("pipelining %v: server got %q, want %q", pipelining, s.messages, want)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestBuildMessageCRLF(t *testing.T) {
+	h := benchHeader()
+	h.MIME = ""
+	h.Miscellaneous = "X-A: 1\nX-B: 2"
+	text := []byte("first\n.\nlast\n")
+	for _, html := range [][]byte{nil, []byte("<p>first</p>\n<p>.</p>\n")} {
+		msg, err := (&MailConfig{}).buildMessage(h, "sales@example.com", text, html, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, normalizeCRLF(msg)) {
+			t.Errorf("message has bare line breaks: %q", msg)
+		}
+	}
+}
+
+func TestBuildPlainMessageLines(t *testing.T) {
+	text := bytes.Repeat([]byte("The quarterly report is attached. "), 64)
+	msg := buildPlainMessage(benchHeader(), "sales@example.com", text)
+	body := msg[bytes.Index(msg, []byte("\r\n\r\n"))+4:]
+	lines := bytes.SplitAfter(body, []byte("\r\n"))
+	if len(lines) < 2 || len(lines[len(lines)-1]) != 0 {
+		t.Fatalf("body isn't split in CRLF lines: %q", body)
+	}
+	for i, line := range lines[:len(lines)-1] {
+		if len(line) > base64LineLength+2 {
+			t.Errorf("body line %d is %d long", i+1, len(line)-2)
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.ReplaceAll(body, []byte("\r\n"), nil)))
+	if err != nil || !bytes.Equal(decoded, text) {
+		t.Errorf("body decodes to %q (%v)", decoded, err)
+	}
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metricKind string
+
+const (
+	counterMetric   metricKind = "counter"
+	gaugeMetric     metricKind = "gauge"
+	histogramMetric metricKind = "histogram"
+)
+
+type metricSeries struct {
+	name   string
+	labels string
+	value  float64
+}
+
+//histogramSeries is a histogram with one set of labels. counts are
+//cumulative, one per bucket of the metric.
+type histogramSeries struct {
+	name   string
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//metricsRegistry keeps counters, gauges and histograms and serves them in
+//the Prometheus text exposition format
+type metricsRegistry struct {
+	mu         sync.Mutex
+	kinds      map[string]metricKind
+	help       map[string]string
+	series     map[string]*metricSeries
+	buckets    map[string][]float64
+	histograms map[string]*histogramSeries
+	//enabled is set at startup if metrics are served, observe does
+	//nothing otherwise
+	enabled bool
+}
+
+//metrics is the process wide registry every component reports to
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		kinds:      make(map[string]metricKind),
+		help:       make(map[string]string),
+		series:     make(map[string]*metricSeries),
+		buckets:    make(map[string][]float64),
+		histograms: make(map[string]*histogramSeries),
+	}
+}
+
+//describe registers a metric so it's exposed with its type and help text
+func (r *metricsRegistry) describe(name string, kind metricKind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds[name] = kind
+	r.help[name] = help
+}
+
+//describeHistogram registers a histogram with the upper bounds of its
+//buckets, in increasing order
+func (r *metricsRegistry) describeHistogram(name, help string, buckets []float64) {
+	r.describe(name, histogramMetric, help)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buckets[name] = buckets
+}
+
+//formatLabels turns key, value pairs into a Prometheus label set
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//get returns the series of name with the given labels. r.mu must be held.
+func (r *metricsRegistry) get(name string, labels []string) *metricSeries {
+	l := formatLabels(labels)
+	s, ok := r.series[name+l]
+	if !ok {
+		s = &metricSeries{name: name, labels: l}
+		r.series[name+l] = s
+	}
+	return s
+}
+
+//add increases the metric by v. labels are key, value pairs.
+func (r *metricsRegistry) add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, labels).value += v
+}
+
+func (r *metricsRegistry) inc(name string, labels ...string) {
+	r.add(name, 1, labels...)
+}
+
+//set sets a gauge to v. labels are key, value pairs.
+func (r *metricsRegistry) set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, labels).value = v
+}
+
+//observe records v in a histogram. labels are key, value pairs.
+func (r *metricsRegistry) observe(name string, v float64, labels ...string) {
+	if !r.enabled {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := name + formatLabels(labels)
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &histogramSeries{name: name, labels: labels, counts: make([]uint64, len(r.buckets[name]))}
+		r.histograms[key] = h
+	}
+	for i, bound := range r.buckets[name] {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+//writeHistogram writes the bucket, sum and count samples of h
+func (r *metricsRegistry) writeHistogram(w io.Writer, h *histogramSeries) {
+	for i, bound := range r.buckets[h.name] {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(h.labels[:len(h.labels):len(h.labels)], "le", fmt.Sprint(bound))), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(h.labels[:len(h.labels):len(h.labels)], "le", "+Inf")), h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels), h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels), h.count)
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byName := make(map[string][]*metricSeries)
+	for _, s := range r.series {
+		byName[s.name] = append(byName[s.name], s)
+	}
+	histograms := make(map[string][]*histogramSeries)
+	for _, h := range r.histograms {
+		histograms[h.name] = append(histograms[h.name], h)
+	}
+	names := make([]string, 0, len(byName)+len(histograms))
+	for name := range byName {
+		names = append(names, name)
+	}
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		if help, ok := r.help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		if kind, ok := r.kinds[name]; ok {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		}
+		if hs, ok := histograms[name]; ok {
+			sort.Slice(hs, func(i, j int) bool { return formatLabels(hs[i].labels) < formatLabels(hs[j].labels) })
+			for _, h := range hs {
+				r.writeHistogram(w, h)
+			}
+			continue
+		}
+		series := byName[name]
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+		for _, s := range series {
+			fmt.Fprintf(w, "%s%s %g\n", s.name, s.labels, s.value)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"reflect"
+	"strings"
+)
+
+//mustacheTemplate is a Mustache template: variables, sections, inverted
+//sections and comments. Partials and set delimiters aren't supported.
+//Names are looked up like Go templates do, as fields, methods without
+//arguments and map keys, with dots for nested values and "." for the
+//current one.
+type mustacheTemplate struct {
+	name string
+	//html escapes the values of {{name}}, {{{name}}} and {{&name}} are
+	//never escaped
+	html  bool
+	nodes []mustacheNode
+}
+
+//mustacheNode is literal text, or a tag with its name and, for sections,
+//the nodes within
+type mustacheNode struct {
+	//kind is 0 for text, 'v' for a variable, '&' for an unescaped one,
+	//'#' for a section and '^' for an inverted section
+	kind  byte
+	text  string
+	nodes []mustacheNode
+}
+
+func parseMustache(name, src string, escapeHTML bool) (*mustacheTemplate, error) {
+	root := &mustacheNode{}
+	stack := []*mustacheNode{root}
+	add := func(n mustacheNode) {
+		top := stack[len(stack)-1]
+		top.nodes = append(top.nodes, n)
+	}
+	pos := 0
+	for {
+		i := strings.Index(src[pos:], "{{")
+		if i < 0 {
+			if pos < len(src) {
+				add(mustacheNode{text: src[pos:]})
+			}
+			break
+		}
+		start := pos + i
+		line := strings.Count(src[:start], "\n") + 1
+		open, closing := "{{", "}}"
+		if strings.HasPrefix(src[start:], "{{{") {
+			open, closing = "{{{", "}}}"
+		}
+		j := strings.Index(src[start+len(open):], closing)
+		if j < 0 {
+			return nil, fmt.Errorf("template: %s:%d: unclosed tag", name, line)
+		}
+		tag := strings.TrimSpace(src[start+len(open) : start+len(open)+j])
+		end := start + len(open) + j + len(closing)
+		var sigil byte
+		if open == "{{{" {
+			sigil = '&'
+		} else if tag != "" && strings.IndexByte("#^/!&>=", tag[0]) >= 0 {
+			sigil = tag[0]
+			tag = strings.TrimSpace(tag[1:])
+		}
+
+		text := src[pos:start]
+		if sigil == '#' || sigil == '^' || sigil == '/' || sigil == '!' {
+			//a tag alone on its line takes the line with it
+			lineStart := strings.LastIndexByte(src[:start], '\n') + 1
+			lineEnd := strings.IndexByte(src[end:], '\n')
+			rest := src[end:]
+			if lineEnd >= 0 {
+				rest = src[end : end+lineEnd]
+			}
+			if lineStart >= pos && strings.Trim(src[lineStart:start], " \t") == "" && strings.Trim(rest, " \t\r") == "" {
+				text = src[pos:lineStart]
+				end += len(rest)
+				if lineEnd >= 0 {
+					end++
+				}
+			}
+		}
+		if text != "" {
+			add(mustacheNode{text: text})
+		}
+
+		if tag == "" && sigil != '!' {
+			return nil, fmt.Errorf("template: %s:%d: empty tag", name, line)
+		}
+		switch sigil {
+		case '!':
+		case '>', '=':
+			return nil, fmt.Errorf("template: %s:%d: partials and set delimiters are not supported", name, line)
+		case '#', '^':
+			add(mustacheNode{kind: sigil, text: tag})
+			top := stack[len(stack)-1]
+			stack = append(stack, &top.nodes[len(top.nodes)-1])
+		case '/':
+			if len(stack) == 1 || stack[len(stack)-1].text != tag {
+				return nil, fmt.Errorf("template: %s:%d: unexpected {{/%s}}", name, line, tag)
+			}
+			stack = stack[:len(stack)-1]
+		case '&':
+			add(mustacheNode{kind: '&', text: tag})
+		default:
+			add(mustacheNode{kind: 'v', text: tag})
+		}
+		pos = end
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("template: %s: unclosed section {{#%s}}", name, stack[len(stack)-1].text)
+	}
+	return &mustacheTemplate{name: name, html: escapeHTML, nodes: root.nodes}, nil
+}
+
+//Execute renders the template for data, the outermost context
+func (t *mustacheTemplate) Execute(w io.Writer, data interface{}) error {
+	return t.render(w, t.nodes, []interface{}{data})
+}
+
+//render renders nodes for the context stack, innermost last
+func (t *mustacheTemplate) render(w io.Writer, nodes []mustacheNode, stack []interface{}) error {
+	for _, n := range nodes {
+		var err error
+		switch n.kind {
+		case 0:
+			_, err = io.WriteString(w, n.text)
+		case 'v', '&':
+			s := formatMustacheValue(lookupMustache(stack, n.text))
+			if n.kind == 'v' && t.html {
+				s = html.EscapeString(s)
+			}
+			_, err = io.WriteString(w, s)
+		case '#':
+			v := lookupMustache(stack, n.text)
+			rv := indirectValue(reflect.ValueOf(v))
+			switch {
+			case rv.IsValid() && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array):
+				for i := 0; i < rv.Len() && err == nil; i++ {
+					err = t.render(w, n.nodes, append(stack, rv.Index(i).Interface()))
+				}
+			case isTruthy(rv):
+				err = t.render(w, n.nodes, append(stack, v))
+			}
+		case '^':
+			if !isTruthy(indirectValue(reflect.ValueOf(lookupMustache(stack, n.text)))) {
+				err = t.render(w, n.nodes, stack)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//lookupMustache resolves name against the innermost context that has its
+//first part. Unknown names are nil, rendering as nothing.
+func lookupMustache(stack []interface{}, name string) interface{} {
+	if name == "." {
+		return stack[len(stack)-1]
+	}
+	parts := strings.Split(name, ".")
+	for i := len(stack) - 1; i >= 0; i-- {
+		v, ok := mustacheField(stack[i], parts[0])
+		if !ok {
+			continue
+		}
+		for _, part := range parts[1:] {
+			if v, ok = mustacheField(v, part); !ok {
+				return nil
+			}
+		}
+		return v
+	}
+	return nil
+}
+
+//mustacheField returns the exported field, method result or map entry
+//name of v
+func mustacheField(v interface{}, name string) (interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	if m := reflect.ValueOf(v).MethodByName(name); m.IsValid() {
+		mt := m.Type()
+		if mt.NumIn() == 0 && (mt.NumOut() == 1 || (mt.NumOut() == 2 && mt.Out(1) == reflect.TypeOf((*error)(nil)).Elem())) {
+			out := m.Call(nil)
+			if len(out) == 2 && !out[1].IsNil() {
+				return nil, false
+			}
+			return out[0].Interface(), true
+		}
+	}
+	rv := indirectValue(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Struct:
+		f, ok := rv.Type().FieldByName(name)
+		if !ok || f.PkgPath != "" {
+			return nil, false
+		}
+		return rv.FieldByIndex(f.Index).Interface(), true
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		e := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !e.IsValid() {
+			return nil, false
+		}
+		return e.Interface(), true
+	}
+	return nil, false
+}
+
+//indirectValue follows pointers and interfaces, returning the zero Value
+//for nil
+func indirectValue(rv reflect.Value) reflect.Value {
+	for rv.IsValid() && (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+//isTruthy reports whether a section for rv is rendered: it's not nil,
+//false, zero or empty
+func isTruthy(rv reflect.Value) bool {
+	if !rv.IsValid() {
+		return false
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return rv.Len() > 0
+	case reflect.Struct:
+		return true
+	}
+	return !rv.IsZero()
+}
+
+func formatMustacheValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+//Notifier types, see NotifierConfig.Type
+const (
+	NotifierSlack     = "slack"
+	NotifierPagerDuty = "pagerduty"
+)
+
+//Notifier severities, see NotifierConfig.Severity
+const (
+	//SeverityFailure notifies of failed sends
+	SeverityFailure = "failure"
+	//SeverityWarning also notifies of sends that were degraded to plain
+	//text, deferred for some recipients or not sent as all were suppressed
+	SeverityWarning = "warning"
+	//SeverityAll notifies of every outcome
+	SeverityAll = "all"
+)
+
+const (
+	defaultNotifierTimeout = 10 * time.Second
+	defaultPagerDutyURL    = "https://events.pagerduty.com/v2/enqueue"
+	//notificationBacklog is how many notifications may wait to be posted
+	//before new ones are dropped
+	notificationBacklog = 100
+)
+
+func init() {
+	metrics.describe("notifications_total", counterMetric, "Outcomes handed to notifiers, by notifier and result")
+}
+
+//Notifier is told of the outcome of every request sent. Its errors are
+//only logged, they don't change the outcome.
+type Notifier interface {
+	OnOutcome(req *EmailSendRequest, outcome EmailSendOutcome) error
+}
+
+//NotifierConfig posts the outcomes of requests to an alerting service
+type NotifierConfig struct {
+	//Type is "slack", posting to an incoming webhook, or "pagerduty",
+	//triggering an Events API v2 alert
+	Type string `yaml:"Type"`
+	//URL is the Slack webhook, or overrides the PagerDuty endpoint
+	URL string `yaml:"URL"`
+	//RoutingKey is the integration key of the PagerDuty service
+	RoutingKey string `yaml:"RoutingKey"`
+	//Severity is the least severe outcome notified of, "failure" by
+	//default, "warning" or "all"
+	Severity string        `yaml:"Severity"`
+	Timeout  time.Duration `yaml:"Timeout"`
+}
+
+func (c *NotifierConfig) validate() error {
+	switch c.Severity {
+	case "":
+		c.Severity = SeverityFailure
+	case SeverityFailure, SeverityWarning, SeverityAll:
+	default:
+		return fmt.Errorf("unknown notifier severity %q", c.Severity)
+	}
+	switch c.Type {
+	case NotifierSlack:
+		if c.URL == "" {
+			return errors.New("the slack notifier needs a URL")
+		}
+	case NotifierPagerDuty:
+		if c.RoutingKey == "" {
+			return errors.New("the pagerduty notifier needs a RoutingKey")
+		}
+		if c.URL == "" {
+			c.URL = defaultPagerDutyURL
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %q", c.Type)
+	}
+	if u, err := url.Parse(c.URL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("invalid %s notifier URL", c.Type)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultNotifierTimeout
+	}
+	return nil
+}
+
+//severity returns how severe outcome is, "" if it's a plain success
+func severity(outcome EmailSendOutcome) string {
+	switch {
+	case outcome.Error != nil:
+		return SeverityFailure
+	case outcome.Degraded || len(outcome.Deferred) > 0 || outcome.Suppressed:
+		return SeverityWarning
+	}
+	return ""
+}
+
+//notifies reports whether outcome is severe enough for c
+func (c *NotifierConfig) notifies(outcome EmailSendOutcome) bool {
+	switch c.Severity {
+	case SeverityAll:
+		return true
+	case SeverityWarning:
+		return severity(outcome) != ""
+	}
+	return severity(outcome) == SeverityFailure
+}
+
+//summary describes outcome in a line, without the personal data of the
+//request
+func summary(req *EmailSendRequest, outcome EmailSendOutcome) string {
+	switch {
+	case outcome.Error != nil:
+		category := CategoryInternal
+		var sendErr *SendError
+		if errors.As(outcome.Error, &sendErr) {
+			category = sendErr.Category
+		}
+		return fmt.Sprintf("Request %s failed (%s): %v", req.ID, category, outcome.Error)
+	case outcome.Queued:
+		return fmt.Sprintf("Request %s was queued", req.ID)
+	case outcome.Suppressed:
+		return fmt.Sprintf("Request %s was not sent, all its recipients are suppressed", req.ID)
+	case outcome.Degraded:
+		return fmt.Sprintf("Request %s was sent as plain text only to %d recipients", req.ID, len(outcome.Deliveries))
+	case len(outcome.Deferred) > 0:
+		return fmt.Sprintf("Request %s was sent to %d recipients and deferred for %d", req.ID, len(outcome.Deliveries), len(outcome.Deferred))
+	}
+	return fmt.Sprintf("Request %s was sent to %d recipients in %s", req.ID, len(outcome.Deliveries), outcome.Elapsed.Round(time.Millisecond))
+}
+
+//postJSON posts v to endpoint, failing on any status but 2xx
+func postJSON(client *http.Client, endpoint string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the notifier answered %s", resp.Status)
+	}
+	return nil
+}
+
+//slackNotifier posts to a Slack incoming webhook
+type slackNotifier struct {
+	config *NotifierConfig
+	client *http.Client
+}
+
+func (n *slackNotifier) OnOutcome(req *EmailSendRequest, outcome EmailSendOutcome) error {
+	if !n.config.notifies(outcome) {
+		return nil
+	}
+	return postJSON(n.client, n.config.URL, map[string]string{"text": summary(req, outcome)})
+}
+
+//pagerDutyNotifier triggers PagerDuty alerts, deduplicated by request
+type pagerDutyNotifier struct {
+	config *NotifierConfig
+	client *http.Client
+	source string
+}
+
+func (n *pagerDutyNotifier) OnOutcome(req *EmailSendRequest, outcome EmailSendOutcome) error {
+	if !n.config.notifies(outcome) {
+		return nil
+	}
+	level := "info"
+	switch severity(outcome) {
+	case SeverityFailure:
+		level = "error"
+	case SeverityWarning:
+		level = "warning"
+	}
+	return postJSON(n.client, n.config.URL, map[string]interface{}{
+		"routing_key":  n.config.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    req.ID,
+		"payload": map[string]string{
+			"summary":  summary(req, outcome),
+			"source":   n.source,
+			"severity": level,
+		},
+	})
+}
+
+//notification is an outcome waiting to be posted. req is a copy, the
+//emailer reuses its request.
+type notification struct {
+	req     EmailSendRequest
+	outcome EmailSendOutcome
+}
+
+//notifierChain posts outcomes to its notifiers in the background, in
+//order, so a slow notifier never holds up sending
+type notifierChain struct {
+	notifiers []Notifier
+	names     []string
+	queue     chan notification
+}
+
+//newNotifierChain validates configs and returns their chain, nil without
+//any
+func newNotifierChain(configs []NotifierConfig) (*notifierChain, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	source, _ := os.Hostname()
+	if source == "" {
+		source = "docs-email-sender"
+	}
+	c := &notifierChain{queue: make(chan notification, notificationBacklog)}
+	for i := range configs {
+		config := &configs[i]
+		if err := config.validate(); err != nil {
+			return nil, fmt.Errorf("notifier %d: %w", i+1, err)
+		}
+		client := &http.Client{Timeout: config.Timeout}
+		switch config.Type {
+		case NotifierSlack:
+			c.notifiers = append(c.notifiers, &slackNotifier{config: config, client: client})
+		case NotifierPagerDuty:
+			c.notifiers = append(c.notifiers, &pagerDutyNotifier{config: config, client: client, source: source})
+		}
+		c.names = append(c.names, fmt.Sprintf("%d-%s", i+1, config.Type))
+	}
+	return c, nil
+}
+
+//notify queues outcome for the notifiers, dropping it if they are too far
+//behind. It's a no-op on a nil chain.
+func (c *notifierChain) notify(req *EmailSendRequest, outcome EmailSendOutcome) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.queue <- notification{req: *req, outcome: outcome}:
+	default:
+		errorLogger.Printf("Dropping the notification of request %s, the notifiers are behind", req.ID)
+		metrics.inc("notifications_total", "notifier", "all", "result", "dropped")
+	}
+}
+
+//reply hands outcome to the requester and the notifiers, and ends the span
+//of the request
+func (m *MailConfig) reply(req *EmailSendRequest, outcome EmailSendOutcome) {
+	outcome = req.reply(outcome)
+	req.span.finish(outcome.Error)
+	m.notifiers.notify(req, outcome)
+}
+
+//run posts queued notifications to every notifier
+func (c *notifierChain) run() {
+	for n := range c.queue {
+		for i, notifier := range c.notifiers {
+			result := "ok"
+			if err := notifier.OnOutcome(&n.req, n.outcome); err != nil {
+				errorLogger.Printf("Notifying %s of request %s: %v", c.names[i], n.req.ID, err)
+				result = "error"
+			}
+			metrics.inc("notifications_total", "notifier", c.names[i], "result", result)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+//submitPaused queues data without waiting for it to be sent, which only
+//happens once sending is resumed. The outcome is recorded in the store
+//when it's ready.
+func (s *server) submitPaused(data EmailSendRequest) EmailSendOutcome {
+	result := make(chan EmailSendOutcome, 1)
+	data.Result = result
+	//nobody is waiting, but the request mustn't count as abandoned
+	data.Done = nil
+	if !s.queue.tryEnqueue(data) {
+		return EmailSendOutcome{Error: &SendError{Category: CategoryUnavailable, Err: ErrQueueFull}}
+	}
+	infoLogger.Printf("Sending is paused, queued request %s", data.ID)
+	go func() {
+		s.finishQueued(data, <-result)
+	}()
+	return EmailSendOutcome{Queued: true}
+}
+
+//finishQueued records the outcome of a request that was answered as
+//queued once it's ready
+func (s *server) finishQueued(data EmailSendRequest, outcome EmailSendOutcome) {
+	s.store.Record(data, outcome)
+	if s.status != nil {
+		s.status.finish(data.ID, outcome, nil)
+	}
+}
+
+//pauseHandler stops sending until resumeHandler is called. Requests keep
+//being accepted and queued meanwhile.
+func (s *server) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.queue.pause()
+	infoLogger.Println("Sending paused")
+	audit("sending_paused", "", nil)
+	w.Write([]byte("Sending paused"))
+}
+
+//resumeHandler resumes sending, draining the requests queued meanwhile
+func (s *server) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.queue.resume()
+	infoLogger.Println("Sending resumed")
+	audit("sending_resumed", "", nil)
+	w.Write([]byte("Sending resumed"))
+}
+
+//healthStatus is the body of the health endpoint
+type healthStatus struct {
+	Status string `json:"status"`
+	Paused bool   `json:"paused"`
+	//Render is why the deep check failed to render or assemble a message
+	Render string `json:"render,omitempty"`
+}
+
+//healthHandler reports that the server is up and whether sending is
+//paused. With deep=1 it also renders the templates and assembles the
+//messages, answering 503 if that fails.
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok", Paused: s.queue.paused()}
+	code := http.StatusOK
+	if deep, _ := strconv.ParseBool(r.URL.Query().Get("deep")); deep {
+		if err := s.config.EmailConfig.checkRender(s.config.Digest); err != nil {
+			errorLogger.Printf("Deep health check failed: %v", err)
+			status.Status, status.Render = "failing", err.Error()
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+//PGPConfig encrypts the messages of recipients that have a PGP public key
+//as PGP/MIME. Recipients without one get the usual message. The headers,
+//Subject included, stay readable.
+type PGPConfig struct {
+	//KeyringFile is a keyring, armored or not, whose keys apply to the
+	//addresses of their user IDs
+	KeyringFile string `yaml:"KeyringFile"`
+	//Keys maps recipient addresses to armored public keys, taking
+	//precedence over KeyringFile
+	Keys map[string]string `yaml:"Keys"`
+	//SigningKeyFile, if set, is the armored private key encrypted messages
+	//are signed with, in place of S/MIME
+	SigningKeyFile       string `yaml:"SigningKeyFile"`
+	SigningKeyPassphrase string `yaml:"SigningKeyPassphrase"`
+}
+
+type pgpEncryptor struct {
+	//keys are by lower case address
+	keys   map[string]*openpgp.Entity
+	signer *openpgp.Entity
+}
+
+//load reads the keys, making sure each can be encrypted to
+func (c *PGPConfig) load() (*pgpEncryptor, error) {
+	p := &pgpEncryptor{keys: make(map[string]*openpgp.Entity)}
+	if c.KeyringFile != "" {
+		keyring, err := readKeyring(c.KeyringFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", c.KeyringFile, err)
+		}
+		for _, e := range keyring {
+			for _, id := range e.Identities {
+				if id.UserId.Email != "" {
+					p.keys[strings.ToLower(id.UserId.Email)] = e
+				}
+			}
+		}
+	}
+	for addr, key := range c.Keys {
+		keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("reading the key of %s: %w", addr, err)
+		}
+		p.keys[strings.ToLower(addr)] = keyring[0]
+	}
+	if c.SigningKeyFile != "" {
+		f, err := os.Open(c.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		keyring, err := openpgp.ReadArmoredKeyRing(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", c.SigningKeyFile, err)
+		}
+		p.signer = keyring[0]
+		if p.signer.PrivateKey == nil {
+			return nil, fmt.Errorf("%s holds no private key", c.SigningKeyFile)
+		}
+		if p.signer.PrivateKey.Encrypted {
+			if err = p.signer.PrivateKey.Decrypt([]byte(c.SigningKeyPassphrase)); err != nil {
+				return nil, fmt.Errorf("decrypting %s: %w", c.SigningKeyFile, err)
+			}
+		}
+	}
+	for addr, e := range p.keys {
+		//fails on keys without a usable encryption subkey, e.g. expired ones
+		w, err := openpgp.Encrypt(ioutil.Discard, openpgp.EntityList{e}, nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("the key of %s: %w", addr, err)
+		}
+		w.Close()
+	}
+	return p, nil
+}
+
+func readKeyring(name string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(content, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+//keysFor returns the keys of the addresses in to if all of them have one,
+//nil otherwise. It's nil-safe, returning nil with PGP off.
+func (p *pgpEncryptor) keysFor(to string) openpgp.EntityList {
+	if p == nil {
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(to)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	var keys openpgp.EntityList
+	for _, addr := range addrs {
+		e, ok := p.keys[strings.ToLower(addr.Address)]
+		if !ok {
+			return nil
+		}
+		keys = append(keys, e)
+	}
+	return keys
+}
+
+//encryptsAny reports whether any of recipients has a key, whose messages
+//then can't be shared with the others
+func (p *pgpEncryptor) encryptsAny(recipients map[string]Recipient) bool {
+	for _, r := range recipients {
+		if p.keysFor(r.Address) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//encrypt wraps content in a multipart/encrypted part holding it encrypted
+//to keys, and signed if a signing key is configured, as RFC 3156 has it
+func (p *pgpEncryptor) encrypt(content *mimePart, keys openpgp.EntityList) (*mimePart, error) {
+	raw, err := content.render()
+	if err != nil {
+		return nil, err
+	}
+
+	armored := new(bytes.Buffer)
+	aw, err := armor.Encode(armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, p.signer, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("PGP encryption: %w", err)
+	}
+	if _, err = pw.Write(raw); err != nil {
+		return nil, fmt.Errorf("PGP encryption: %w", err)
+	}
+	if err = pw.Close(); err != nil {
+		return nil, fmt.Errorf("PGP encryption: %w", err)
+	}
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+	armored.WriteString("\r\n")
+
+	encrypted := newMultipart("encrypted",
+		rawPart("application/pgp-encrypted", nil, []byte("Version: 1\r\n")),
+		rawPart(`application/octet-stream; name="encrypted.asc"`, textproto.MIMEHeader{
+			"Content-Disposition": {`inline; filename="encrypted.asc"`},
+		}, armored.Bytes()),
+	)
+	encrypted.contentType += `; protocol="application/pgp-encrypted"`
+	return encrypted, nil
+}
+
+//rawPart returns a part whose body goes out as is, for 7bit content
+func rawPart(contentType string, header textproto.MIMEHeader, body []byte) *mimePart {
+	buf := new(bytes.Buffer)
+	h := textproto.MIMEHeader{"Content-Type": {contentType}}
+	for k, v := range header {
+		h[k] = v
+	}
+	writeHeaders(buf, h)
+	buf.Write(body)
+	return &mimePart{raw: buf.Bytes()}
+}
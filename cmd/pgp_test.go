@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+//newTestEntity returns a new key pair for addr. Its self-signature lists
+//SHA-256, keys without hash preferences are taken to want RIPEMD-160
+//only, which Go doesn't link by default.
+func newTestEntity(t *testing.T, name, addr string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", addr, &packet.Config{DefaultHash: crypto.SHA256, RSABits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+//readMultipart returns the media type of msg's body and its parts, with
+//their content type and body
+func readMultipart(t *testing.T, msg []byte) (string, []*multipart.Part, [][]byte) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	var parts []*multipart.Part
+	var bodies [][]byte
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			return mediaType, parts, bodies
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, bodies = append(parts, p), append(bodies, body)
+	}
+}
+
+func TestPGPRoundTrip(t *testing.T) {
+	recipient := newTestEntity(t, "Sales", "sales@example.com")
+	signer := newTestEntity(t, "Docs", "docs@example.com")
+	m := &MailConfig{pgp: &pgpEncryptor{
+		keys:   map[string]*openpgp.Entity{"sales@example.com": recipient},
+		signer: signer,
+	}}
+	text := []byte("The serial number is 1234.\n")
+	msg, err := m.buildMessage(benchHeader(), "Sales <Sales@example.com>", text, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(msg, []byte(base64.StdEncoding.EncodeToString(text))) {
+		t.Fatal("the body went out in the clear")
+	}
+
+	mediaType, parts, bodies := readMultipart(t, msg)
+	if mediaType != "multipart/encrypted" || len(parts) != 2 {
+		t.Fatalf("got %s with %d parts, want multipart/encrypted with 2", mediaType, len(parts))
+	}
+	if ct := parts[0].Header.Get("Content-Type"); ct != "application/pgp-encrypted" {
+		t.Errorf("the control part is %s", ct)
+	}
+	block, err := armor.Decode(bytes.NewReader(bodies[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{recipient, signer}, nil, nil)
+	if err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	decrypted, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.IsSigned || md.SignedBy == nil || md.SignedBy.PublicKey.KeyId != signer.PrimaryKey.KeyId || md.SignatureError != nil {
+		t.Errorf("the message isn't signed by the signing key: %v", md.SignatureError)
+	}
+
+	inner, err := mail.ReadMessage(bytes.NewReader(decrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := inner.Header.Get("Content-Type"); ct != `text/plain; charset="utf-8"` {
+		t.Errorf("the encrypted part is %s", ct)
+	}
+	body, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, inner.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, text) {
+		t.Errorf("decrypted body %q, want %q", body, text)
+	}
+}
+
+func TestPGPWithoutKey(t *testing.T) {
+	recipient := newTestEntity(t, "Sales", "sales@example.com")
+	m := &MailConfig{pgp: &pgpEncryptor{keys: map[string]*openpgp.Entity{"sales@example.com": recipient}}}
+	msg, err := m.buildMessage(benchHeader(), "sales@example.com, support@example.com", []byte("hello\n"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(msg, []byte("multipart/encrypted")) {
+		t.Error("a message to a recipient without a key was encrypted")
+	}
+}
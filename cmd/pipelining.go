@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+func init() {
+	metrics.describe("smtp_pipelined_transactions_total", counterMetric, "Mail transactions whose MAIL, RCPT and DATA commands were pipelined")
+}
+
+//errLineBreak mirrors net/smtp refusing addresses that would smuggle in
+//commands of their own
+var errLineBreak = errors.New("smtp: A line must not contain CR or LF")
+
+//startPipelined sends MAIL, every RCPT and DATA in one go, as RFC 2920
+//allows a server advertising PIPELINING, and then reads their replies in
+//order. It returns what the lock-step commands would have: the writer for
+//the message if any recipient was accepted, the refused recipients, and
+//the refusal of MAIL or DATA, or of the last recipient if all were.
+func (s *smtpSession) startPipelined(from string, to []string) (io.WriteCloser, map[string]error, error) {
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return nil, nil, errLineBreak
+		}
+	}
+	c := s.client
+	mail := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		mail += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		mail += " SMTPUTF8"
+	}
+	w := c.Text.W
+	fmt.Fprintf(w, "%s\r\n", mail)
+	for _, rcpt := range to {
+		fmt.Fprintf(w, "RCPT TO:<%s>\r\n", rcpt)
+	}
+	w.WriteString("DATA\r\n")
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	metrics.inc("smtp_pipelined_transactions_total", "server", s.server)
+
+	//every reply has to be read, whatever came before, to stay in step
+	//with the server
+	_, _, mailErr := c.Text.ReadResponse(250)
+	rejected := make(map[string]error)
+	var rcptErr error
+	for _, rcpt := range to {
+		_, _, err := c.Text.ReadResponse(25)
+		var tpErr *textproto.Error
+		if err != nil && !errors.As(err, &tpErr) {
+			return nil, nil, err
+		}
+		if err != nil {
+			rejected[rcpt], rcptErr = err, err
+		}
+	}
+	_, _, dataErr := c.Text.ReadResponse(354)
+	var tpErr *textproto.Error
+	for _, err := range []error{mailErr, dataErr} {
+		if err != nil && !errors.As(err, &tpErr) {
+			return nil, nil, err
+		}
+	}
+
+	err := mailErr
+	switch {
+	case err != nil:
+	case len(rejected) == len(to):
+		err = rcptErr
+	default:
+		err = dataErr
+	}
+	if err != nil {
+		if dataErr == nil {
+			//the server takes a message nobody gets, end it right away
+			d := &dataWriter{c.Text.DotWriter(), c.Text}
+			if closeErr := d.Close(); closeErr != nil && !errors.As(closeErr, &tpErr) {
+				return nil, nil, closeErr
+			}
+		}
+		return nil, nil, err
+	}
+	return &dataWriter{c.Text.DotWriter(), c.Text}, rejected, nil
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessage = []byte("Subject: test\r\n\r\nHello\r\n")
+
+func deliverTo(ctx context.Context, s *fakeSMTP, pipelining bool, from string, to ...string) error {
+	_, err := deliver(ctx, s.addr, "", &tls.Config{ServerName: "fake"}, nil, TLSNone, pipelining, from, to, testMessage)
+	return err
+}
+
+func TestStartPipelined(t *testing.T) {
+	s := startFakeSMTP(t, true, 0)
+	err := deliverTo(context.Background(), s, true, "docs@example.com", "a@example.com", "nobody@example.com", "b@example.com")
+	var rejErr *rejectedRecipientsError
+	if !errors.As(err, &rejErr) {
+		t.Fatalf("got %v, want the refused recipient reported", err)
+	}
+	if len(rejErr.rejected) != 1 || rejErr.rejected["nobody@example.com"] == nil {
+		t.Errorf("got rejected %v, want just nobody@example.com", rejErr.rejected)
+	}
+	commands := "MAIL FROM:<docs@example.com> BODY=8BITMIME\r\n" +
+		"RCPT TO:<a@example.com>\r\n" +
+		"RCPT TO:<nobody@example.com>\r\n" +
+		"RCPT TO:<b@example.com>\r\n" +
+		"DATA\r\n"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := false
+	for _, read := range s.reads {
+		sent = sent || read == commands
+	}
+	if !sent {
+		t.Errorf("MAIL, RCPT and DATA weren't sent in one write, the server read %q", s.reads)
+	}
+	if len(s.messages) != 1 || s.messages[0] != string(testMessage) {
+		t.Errorf("server got messages %q, want the one sent", s.messages)
+	}
+}
+
+func TestStartPipelinedRefusals(t *testing.T) {
+	s := startFakeSMTP(t, true, 0)
+	ctx, pool := withSessionPool(context.Background())
+	defer pool.close()
+	tests := []struct {
+		from string
+		to   []string
+		code int
+	}{
+		{"docs@example.com", []string{"nobody@example.com", "nobody-else@example.com"}, 550},
+		{"bad-sender@example.com", []string{"a@example.com"}, 550},
+	}
+	for _, test := range tests {
+		err := deliverTo(ctx, s, true, test.from, test.to...)
+		var tpErr *textproto.Error
+		if !errors.As(err, &tpErr) || tpErr.Code != test.code {
+			t.Errorf("%s to %q: got %v, want a %d reply", test.from, test.to, err, test.code)
+		}
+	}
+	//the session must still be in step with the server
+	if err := deliverTo(ctx, s, true, "docs@example.com", "a@example.com"); err != nil {
+		t.Fatalf("sending after the refusals: %v", err)
+	}
+	if conns, _, _ := s.stats(); conns != 1 {
+		t.Errorf("the refusals took %d connections, want 1", conns)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 1 {
+		t.Errorf("server got %d messages, want 1", len(s.messages))
+	}
+}
+
+func TestStartPipelinedLineBreak(t *testing.T) {
+	s := startFakeSMTP(t, true, 0)
+	if err := deliverTo(context.Background(), s, true, "docs@example.com", "a@example.com\r\nRSET"); !errors.Is(err, errLineBreak) {
+		t.Errorf("got %v, want %v", err, errLineBreak)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, read := range s.reads {
+		if strings.Contains(read, "RCPT") {
+			t.Errorf("the address was sent: %q", read)
+		}
+	}
+}
+
+func TestStartLockStep(t *testing.T) {
+	s := startFakeSMTP(t, true, 0)
+	if err := deliverTo(context.Background(), s, false, "docs@example.com", "a@example.com", "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, read := range s.reads {
+		if strings.Contains(read, "MAIL") && strings.Contains(read, "RCPT") {
+			t.Errorf("commands were pipelined with pipelining disabled: %q", read)
+		}
+	}
+}
+
+//BenchmarkStartTransaction compares pipelined transactions to lock-step
+//ones over a connection with a round trip time of 1ms
+func BenchmarkStartTransaction(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		pipelining bool
+	}{{"lock-step", false}, {"pipelined", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := startFakeSMTP(b, true, time.Millisecond)
+			ctx, pool := withSessionPool(context.Background())
+			defer pool.close()
+			to := []string{"a@example.com", "b@example.com", "c@example.com"}
+			//open the session before measuring
+			if err := deliverTo(ctx, s, bench.pipelining, "docs@example.com", to...); err != nil {
+				b.Fatal(err)
+			}
+			_, _, before := s.stats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := deliverTo(ctx, s, bench.pipelining, "docs@example.com", to...); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			_, _, after := s.stats()
+			b.ReportMetric(float64(after-before)/float64(b.N), "roundtrips/op")
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Priority orders requests waiting in the queue
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
+
+const (
+	defaultQueueSize         = 100
+	defaultHighPriorityBurst = 10
+)
+
+func (p Priority) String() string {
+	if p == PriorityHigh {
+		return "high"
+	}
+	return "normal"
+}
+
+func parsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", s)
+}
+
+//QueueConfig sizes the queue in front of the emailer workers
+type QueueConfig struct {
+	//Size is the capacity of each priority level
+	Size int `yaml:"Size"`
+	//HighPriorityBurst is how many high priority requests are dispatched
+	//in a row before a waiting normal priority request gets its turn
+	HighPriorityBurst int `yaml:"HighPriorityBurst"`
+	//MaxAge, if set, is how long a request may wait in the queue. Workers
+	//drop older requests instead of sending them.
+	MaxAge time.Duration `yaml:"MaxAge"`
+	//DeadLetterFile, if set, receives the requests dropped that way
+	DeadLetterFile string `yaml:"DeadLetterFile"`
+	//Redis, if set, holds the queue in place of memory so several
+	//instances can share it
+	Redis *RedisQueueConfig `yaml:"Redis"`
+}
+
+//ErrQueueFull is returned when a request can't be queued while sending
+//is paused
+var ErrQueueFull = errors.New("email queue is full")
+
+func init() {
+	metrics.describe("email_queue_depth", gaugeMetric, "Requests waiting for a worker per priority")
+	metrics.describe("email_sending_paused", gaugeMetric, "1 while sending is paused")
+}
+
+//requestQueue holds requests on their way to the workers, in memory or
+//shared through Redis
+type requestQueue interface {
+	//enqueue adds req to the queue, blocking while it's full
+	enqueue(req EmailSendRequest)
+	//tryEnqueue adds req to the queue unless it's full
+	tryEnqueue(req EmailSendRequest) bool
+	pause()
+	resume()
+	paused() bool
+	stalled(timeout time.Duration) bool
+	//depth returns the number of requests waiting by priority
+	depth() map[Priority]int
+	//dispatch feeds the queued requests to the workers reading out,
+	//forever
+	dispatch(out chan<- EmailSendRequest)
+}
+
+//emailQueue holds requests by priority until a worker picks them up
+type emailQueue struct {
+	//lastHandoff is when a worker last took a request, in Unix nanoseconds
+	lastHandoff int64
+	//holding is 1 while dispatch waits for a worker to take a request
+	holding int32
+	queues  [2]chan EmailSendRequest
+	burst   int
+
+	mu sync.Mutex
+	//running is closed unless sending is paused
+	running chan struct{}
+}
+
+func newEmailQueue(config QueueConfig) *emailQueue {
+	size, burst := config.Size, config.HighPriorityBurst
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if burst <= 0 {
+		burst = defaultHighPriorityBurst
+	}
+	q := &emailQueue{burst: burst, lastHandoff: time.Now().UnixNano(), running: make(chan struct{})}
+	close(q.running)
+	metrics.set("email_sending_paused", 0)
+	for i := range q.queues {
+		q.queues[i] = make(chan EmailSendRequest, size)
+	}
+	return q
+}
+
+func (q *emailQueue) updateDepth(p Priority) {
+	metrics.set("email_queue_depth", float64(len(q.queues[p])), "priority", p.String())
+}
+
+//enqueue adds req to the queue of its priority, blocking while it's full
+func (q *emailQueue) enqueue(req EmailSendRequest) {
+	req.EnqueuedAt = time.Now()
+	q.put(req)
+}
+
+//put adds req to the local queue of its priority, blocking while it's full
+func (q *emailQueue) put(req EmailSendRequest) {
+	q.queues[req.Priority] <- req
+	q.updateDepth(req.Priority)
+}
+
+//tryEnqueue adds req to the queue of its priority unless it's full
+func (q *emailQueue) tryEnqueue(req EmailSendRequest) bool {
+	req.EnqueuedAt = time.Now()
+	select {
+	case q.queues[req.Priority] <- req:
+		q.updateDepth(req.Priority)
+		return true
+	default:
+		return false
+	}
+}
+
+//pause stops handing requests to the workers, they keep queuing up
+func (q *emailQueue) pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.running:
+		q.running = make(chan struct{})
+		metrics.set("email_sending_paused", 1)
+	default:
+	}
+}
+
+//resume lets the workers drain the queue again
+func (q *emailQueue) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.running:
+	default:
+		close(q.running)
+		metrics.set("email_sending_paused", 0)
+	}
+}
+
+//gate returns a channel that is closed while sending isn't paused
+func (q *emailQueue) gate() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running
+}
+
+func (q *emailQueue) paused() bool {
+	select {
+	case <-q.gate():
+		return false
+	default:
+		return true
+	}
+}
+
+func (q *emailQueue) depth() map[Priority]int {
+	depth := make(map[Priority]int, len(q.queues))
+	for p, queue := range q.queues {
+		depth[Priority(p)] = len(queue)
+	}
+	return depth
+}
+
+//next takes the request to dispatch next: high priority first, unless
+//burst of them went out in a row and a normal one is waiting
+func (q *emailQueue) next(streak *int) EmailSendRequest {
+	high, normal := q.queues[PriorityHigh], q.queues[PriorityNormal]
+	var req EmailSendRequest
+	if *streak < q.burst {
+		select {
+		case req = <-high:
+			*streak++
+			return req
+		default:
+		}
+	}
+	select {
+	case req = <-normal:
+		*streak = 0
+		return req
+	default:
+	}
+	select {
+	case req = <-high:
+		*streak++
+	case req = <-normal:
+		*streak = 0
+	}
+	return req
+}
+
+//dispatch feeds queued requests to the workers reading out, forever. out
+//should be unbuffered so requests stay in the queue until a worker is free.
+func (q *emailQueue) dispatch(out chan<- EmailSendRequest) {
+	streak := 0
+	for {
+		<-q.gate()
+		req := q.next(&streak)
+		q.updateDepth(req.Priority)
+		atomic.StoreInt32(&q.holding, 1)
+		//sending may have been paused while waiting for req
+		<-q.gate()
+		out <- req
+		atomic.StoreInt32(&q.holding, 0)
+		atomic.StoreInt64(&q.lastHandoff, time.Now().UnixNano())
+	}
+}
+
+//stalled reports whether requests are waiting and no worker took one for
+//longer than timeout, which is expected while sending is paused
+func (q *emailQueue) stalled(timeout time.Duration) bool {
+	if q.paused() {
+		return false
+	}
+	waiting := atomic.LoadInt32(&q.holding) == 1
+	for _, queue := range q.queues {
+		waiting = waiting || len(queue) > 0
+	}
+	last := time.Unix(0, atomic.LoadInt64(&q.lastHandoff))
+	return waiting && time.Since(last) > timeout
+}
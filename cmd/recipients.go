@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultRecipientSourceTimeout = 10 * time.Second
+
+//RecipientSourceConfig points to an external list of recipients, in the
+//same format as MailConfig.Recipients, that is re-read every Interval.
+//Exactly one of URL and File should be set.
+type RecipientSourceConfig struct {
+	URL      string        `yaml:"URL"`
+	File     string        `yaml:"File"`
+	Interval time.Duration `yaml:"Interval"`
+	Timeout  time.Duration `yaml:"Timeout"`
+}
+
+func init() {
+	metrics.describe("recipient_source_refreshes_total", counterMetric, "Recipient source refreshes by result")
+	metrics.describe("recipient_source_recipients", gaugeMetric, "Recipients in the last good list")
+}
+
+//recipientStore holds the current recipients, which may be replaced while
+//emails are being sent. The map itself is never modified once stored.
+type recipientStore struct {
+	mu         sync.RWMutex
+	recipients map[string]Recipient
+}
+
+func (s *recipientStore) get() map[string]Recipient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recipients
+}
+
+func (s *recipientStore) set(recipients map[string]Recipient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recipients = recipients
+}
+
+//currentRecipients returns the recipients emails should be sent to now
+func (m *MailConfig) currentRecipients() map[string]Recipient {
+	if m.recipients == nil {
+		return m.Recipients
+	}
+	return m.recipients.get()
+}
+
+//selectRecipients returns the current recipients, or only the one with
+//the given key if it's set
+func (m *MailConfig) selectRecipients(key string) map[string]Recipient {
+	recipients := m.currentRecipients()
+	if key == "" {
+		return recipients
+	}
+	selected := make(map[string]Recipient)
+	if r, ok := recipients[key]; ok {
+		selected[key] = r
+	}
+	return selected
+}
+
+//recipientAddresses returns the addresses of the current recipients
+func (m *MailConfig) recipientAddresses() []string {
+	var to []string
+	for _, r := range m.currentRecipients() {
+		to = append(to, r.Address)
+	}
+	return to
+}
+
+func (c *RecipientSourceConfig) String() string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return c.File
+}
+
+//fetch reads and validates the recipient list
+func (c *RecipientSourceConfig) fetch() (map[string]Recipient, error) {
+	content, err := fetchSource(c.URL, c.File, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make(map[string]Recipient)
+	if err = yaml.Unmarshal(content, &recipients); err != nil {
+		return nil, err
+	}
+	return recipients, validateRecipients(recipients)
+}
+
+//fetchSource reads url, or file if url is empty
+func fetchSource(url, file string, timeout time.Duration) ([]byte, error) {
+	if url == "" {
+		return ioutil.ReadFile(file)
+	}
+	if timeout <= 0 {
+		timeout = defaultRecipientSourceTimeout
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func validateRecipients(recipients map[string]Recipient) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients")
+	}
+	for key, r := range recipients {
+		if _, err := mail.ParseAddress(r.Address); err != nil {
+			return fmt.Errorf("recipient %q: %w", key, err)
+		}
+		if err := validateDomain(r.Address); err != nil {
+			return fmt.Errorf("recipient %q: %w", key, err)
+		}
+	}
+	if err := validateHeaderOverrides(recipients); err != nil {
+		return err
+	}
+	return validateContentPreferences(recipients)
+}
+
+//refreshRecipients replaces the recipients with a freshly fetched list,
+//keeping the last good list if that fails
+func (m *MailConfig) refreshRecipients() {
+	src := m.RecipientSource
+	recipients, err := src.fetch()
+	if err != nil {
+		metrics.inc("recipient_source_refreshes_total", "result", "failure")
+		errorLogger.Printf("Refreshing recipients from %s failed, keeping last good list: %v", src, err)
+		return
+	}
+	m.recipients.set(recipients)
+	metrics.inc("recipient_source_refreshes_total", "result", "success")
+	metrics.set("recipient_source_recipients", float64(len(recipients)))
+	infoLogger.Printf("Refreshed %d recipients from %s", len(recipients), src)
+}
+
+//watchRecipientSource refreshes the recipients every Interval, forever
+func (m *MailConfig) watchRecipientSource() {
+	m.refreshRecipients()
+	if m.RecipientSource.Interval <= 0 {
+		return
+	}
+	for range time.Tick(m.RecipientSource.Interval) {
+		m.refreshRecipients()
+	}
+}
+
+//RecipientSelectionConfig lets requests pick their recipients by key in
+//the recipients field, repeated or comma separated
+type RecipientSelectionConfig struct {
+	//Keys are the recipients that may be picked, all of them if empty
+	Keys []string `yaml:"Keys"`
+	//Lenient drops unknown keys instead of rejecting the request, as long
+	//as a known one is left
+	Lenient bool `yaml:"Lenient"`
+	//SingleMessage sends the picked recipients one message addressed to
+	//all of them, rather than a message each
+	SingleMessage bool `yaml:"SingleMessage"`
+}
+
+//parse returns the distinct keys of values that may be picked, in order
+func (c *RecipientSelectionConfig) parse(values []string, recipients map[string]Recipient) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, key := range strings.Split(value, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := recipients[key]; !ok || !c.selectable(key) {
+				if c.Lenient {
+					continue
+				}
+				return nil, fmt.Errorf("unknown recipient %s", key)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no known recipient picked")
+	}
+	return keys, nil
+}
+
+func (c *RecipientSelectionConfig) selectable(key string) bool {
+	if len(c.Keys) == 0 {
+		return true
+	}
+	for _, k := range c.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+//pickRecipients returns the current recipients of keys, skipping those
+//removed since the request was accepted
+func (m *MailConfig) pickRecipients(keys []string) map[string]Recipient {
+	recipients := m.currentRecipients()
+	picked := make(map[string]Recipient, len(keys))
+	for _, key := range keys {
+		if r, ok := recipients[key]; ok {
+			picked[key] = r
+		}
+	}
+	return picked
+}
+
+//singleMessage reports whether the recipients of req get one message
+func (m *MailConfig) singleMessage(req *EmailSendRequest) bool {
+	if m.SingleTransaction {
+		return true
+	}
+	return len(req.Recipients) > 1 && m.RecipientSelection != nil && m.RecipientSelection.SingleMessage
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+//tokenRecipientKey stands for the recipient of a recipient token where
+//recipients are keyed
+const tokenRecipientKey = "token"
+
+//defaultRecipientTokenTTL is how long tokens minted by
+///admin/recipient-token are valid unless asked otherwise, up to
+//MaxTTL which defaults to defaultRecipientTokenMaxTTL
+const (
+	defaultRecipientTokenTTL    = time.Hour
+	defaultRecipientTokenMaxTTL = 24 * time.Hour
+)
+
+//RecipientTokenConfig lets a request name its own recipient in the
+//recipientToken field, with a token minted by MintRecipientToken proving
+//the address was authorized earlier, e.g. by a backend calling
+///admin/recipient-token. Tokens can be reused until they expire.
+type RecipientTokenConfig struct {
+	//Secret signs the tokens
+	Secret string `yaml:"Secret"`
+	//MaxTTL caps the lifetime of the tokens minted by
+	///admin/recipient-token, 24 hours by default
+	MaxTTL time.Duration `yaml:"MaxTTL"`
+}
+
+//Errors of an invalid recipient token
+var (
+	errMalformedToken = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid signature")
+	errTokenExpired   = errors.New("token expired")
+)
+
+//recipientClaims is the signed payload of a recipient token
+type recipientClaims struct {
+	Address string `json:"a"`
+	Name    string `json:"n,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+func (c *RecipientTokenConfig) validate() error {
+	if c.Secret == "" {
+		return errors.New("recipient tokens need a Secret")
+	}
+	if c.MaxTTL <= 0 {
+		c.MaxTTL = defaultRecipientTokenMaxTTL
+	}
+	return nil
+}
+
+func signRecipientToken(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//MintRecipientToken returns a token allowing requests to be sent to name
+//and address until expires, for a server configured with secret
+func MintRecipientToken(secret, address, name string, expires time.Time) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	if err = validateDomain(parsed.Address); err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(recipientClaims{Address: parsed.Address, Name: name, Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + signRecipientToken(secret, payload), nil
+}
+
+//verify returns the recipient of token if it's signed with the Secret and
+//hasn't expired at now
+func (c *RecipientTokenConfig) verify(token string, now time.Time) (*Recipient, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return nil, errMalformedToken
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signRecipientToken(c.Secret, payload))) {
+		return nil, errTokenSignature
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	var claims recipientClaims
+	if err = json.Unmarshal(raw, &claims); err != nil || claims.Address == "" {
+		return nil, errMalformedToken
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, errTokenExpired
+	}
+	return &Recipient{Name: claims.Name, Address: claims.Address}, nil
+}
+
+//recipientTokenResponse is the body of /admin/recipient-token
+type recipientTokenResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+//recipientTokenHandler mints a token for the address and optional name
+//form fields, valid for ttl (a duration, an hour by default) up to MaxTTL
+func (s *server) recipientTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := s.config.RecipientTokens
+	ttl := defaultRecipientTokenTTL
+	if ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	if raw := r.FormValue("ttl"); raw != "" {
+		var err error
+		if ttl, err = time.ParseDuration(raw); err != nil || ttl <= 0 {
+			http.Error(w, "Invalid request: ttl must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > c.MaxTTL {
+		http.Error(w, fmt.Sprintf("Invalid request: ttl is longer than %s", c.MaxTTL), http.StatusBadRequest)
+		return
+	}
+	resp := recipientTokenResponse{Expires: time.Now().Add(ttl).Truncate(time.Second)}
+	token, err := MintRecipientToken(c.Secret, r.FormValue("address"), r.FormValue("name"), resp.Expires)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Token = token
+	audit("recipient_token_minted", "", map[string]interface{}{"address": r.FormValue("address"), "expires": resp.Expires})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,518 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisKeyPrefix = "docs-email-sender:"
+	defaultRedisTimeout   = 5 * time.Second
+	//redisPollInterval is how long blocking pops wait before looking again,
+	//e.g. for a high priority request or an abandoned one
+	redisPollInterval = time.Second
+	//redisResultTTL is how long an outcome waits to be picked up, and an
+	//abandoned request is remembered
+	redisResultTTL = time.Hour
+	//redisMaxConns bounds the connections of an instance. Two of them are
+	//held by the blocking pops of the requests and of their outcomes.
+	redisMaxConns = 8
+)
+
+//RedisQueueConfig shares the queue between instances through Redis.
+//Requests are pushed to a list per priority, taken by the workers of any
+//instance and moved to a processing list of their instance until their
+//outcome is sent back. Requests an instance was processing when it
+//stopped are queued again when it starts.
+type RedisQueueConfig struct {
+	//Address is host:port, or the path of a unix socket
+	Address  string `yaml:"Address"`
+	Password string `yaml:"Password"`
+	DB       int    `yaml:"DB"`
+	//KeyPrefix starts every key, "docs-email-sender:" by default
+	KeyPrefix string `yaml:"KeyPrefix"`
+	//InstanceID names the processing list of this instance and must stay
+	//the same across restarts, the hostname by default
+	InstanceID string        `yaml:"InstanceID"`
+	Timeout    time.Duration `yaml:"Timeout"`
+}
+
+func init() {
+	metrics.describe("redis_queue_errors_total", counterMetric, "Failed Redis queue operations")
+	metrics.describe("redis_queue_recovered_total", counterMetric, "Requests requeued from the processing list at startup")
+}
+
+//redisError is an error reply of Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+//redisClient speaks enough RESP for the queue, over a pool of at most
+//redisMaxConns connections since blocking commands hold theirs
+type redisClient struct {
+	config RedisQueueConfig
+	idle   chan *redisConn
+	//slots holds a value for each connection in use
+	slots chan struct{}
+}
+
+func newRedisClient(config RedisQueueConfig) *redisClient {
+	return &redisClient{config: config, idle: make(chan *redisConn, redisMaxConns), slots: make(chan struct{}, redisMaxConns)}
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.config.Address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.config.Address, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if c.config.Password != "" {
+		if _, err = rc.do(c.config.Timeout, "AUTH", c.config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.config.DB != 0 {
+		if _, err = rc.do(c.config.Timeout, "SELECT", strconv.Itoa(c.config.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+//do runs a command, waiting for block longer than the timeout for the
+//reply of blocking ones
+func (c *redisClient) do(block time.Duration, args ...string) (interface{}, error) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			metrics.inc("redis_queue_errors_total")
+			return nil, err
+		}
+	}
+	reply, err := conn.do(c.config.Timeout+block, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		metrics.inc("redis_queue_errors_total")
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (conn *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+//read returns a reply as a string, an int64, a []interface{} or nil, or
+//a redisError
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+//redisQueue moves requests through Redis on their way to the workers of
+//local. Digests stay in local, as do requests Redis fails to take.
+type redisQueue struct {
+	local   *emailQueue
+	workers int
+	client  *redisClient
+	prefix  string
+	//processing holds the requests taken by this instance until they're
+	//acknowledged
+	processing string
+	//results takes the outcomes of the requests queued by this instance
+	results string
+
+	mu sync.Mutex
+	//waiting are the requests queued by this instance by ID, until their
+	//outcome comes back or their requester stops waiting
+	waiting map[string]EmailSendRequest
+}
+
+//redisOutcome is an EmailSendOutcome on its way back to the instance that
+//queued the request
+type redisOutcome struct {
+	ID         string
+	Error      string           `json:",omitempty"`
+	Category   ErrorCategory    `json:",omitempty"`
+	Limit      *LimitError      `json:",omitempty"`
+	Deliveries []DeliveryReport `json:",omitempty"`
+	Deferred   []string         `json:",omitempty"`
+	Batches    int
+	Degraded   bool
+	Elapsed    time.Duration
+	Bounces    []BounceReport `json:",omitempty"`
+	Suppressed bool           `json:",omitempty"`
+}
+
+func (c *RedisQueueConfig) open(local *emailQueue, workers int) (*redisQueue, error) {
+	if c.Address == "" {
+		return nil, errors.New("the Redis queue needs an Address")
+	}
+	config := *c
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = defaultRedisKeyPrefix
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRedisTimeout
+	}
+	if config.InstanceID == "" {
+		var err error
+		if config.InstanceID, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	q := &redisQueue{
+		local:      local,
+		workers:    workers,
+		client:     newRedisClient(config),
+		prefix:     config.KeyPrefix,
+		processing: config.KeyPrefix + "processing:" + config.InstanceID,
+		results:    config.KeyPrefix + "results:" + config.InstanceID,
+		waiting:    make(map[string]EmailSendRequest),
+	}
+	if _, err := q.client.do(0, "PING"); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *redisQueue) queueKey(p Priority) string {
+	return q.prefix + "queue:" + p.String()
+}
+
+//enqueue queues req in Redis, or locally if it's a digest or Redis fails
+func (q *redisQueue) enqueue(req EmailSendRequest) {
+	req.EnqueuedAt = time.Now()
+	if !q.push(req) {
+		q.local.put(req)
+	}
+}
+
+func (q *redisQueue) tryEnqueue(req EmailSendRequest) bool {
+	req.EnqueuedAt = time.Now()
+	if q.push(req) {
+		return true
+	}
+	return q.local.tryEnqueue(req)
+}
+
+func (q *redisQueue) pause()                             { q.local.pause() }
+func (q *redisQueue) resume()                            { q.local.resume() }
+func (q *redisQueue) paused() bool                       { return q.local.paused() }
+func (q *redisQueue) stalled(timeout time.Duration) bool { return q.local.stalled(timeout) }
+func (q *redisQueue) depth() map[Priority]int            { return q.local.depth() }
+
+//dispatch feeds the requests of all instances to the workers reading out
+//and hands the outcomes of those queued here to their requesters, forever
+func (q *redisQueue) dispatch(out chan<- EmailSendRequest) {
+	go q.feed()
+	go q.listen()
+	q.local.dispatch(out)
+}
+
+//push queues req for any instance, its outcome being forwarded to
+//req.Result by listen, and reports whether it did
+func (q *redisQueue) push(req EmailSendRequest) bool {
+	if req.digest != nil {
+		return false
+	}
+	req.ResultQueue = q.results
+	raw, err := json.Marshal(req)
+	if err == nil {
+		//the outcome may come back before LPUSH returns
+		q.mu.Lock()
+		q.waiting[req.ID] = req
+		q.mu.Unlock()
+		if _, err = q.client.do(0, "LPUSH", q.queueKey(req.Priority), string(raw)); err != nil {
+			q.mu.Lock()
+			delete(q.waiting, req.ID)
+			q.mu.Unlock()
+		}
+	}
+	if err != nil {
+		errorLogger.Printf("Queuing request %s locally, Redis failed: %v", req.ID, err)
+		return false
+	}
+	return true
+}
+
+//listen pops the outcomes of the requests queued by this instance and
+//hands them to their requesters, forever. Requests whose requester stopped
+//waiting are marked abandoned, so that the instance taking them skips
+//them.
+func (q *redisQueue) listen() {
+	for {
+		q.sweep()
+		reply, err := q.client.do(redisPollInterval, "BLPOP", q.results, strconv.Itoa(int(redisPollInterval.Seconds())))
+		if err != nil {
+			errorLogger.Printf("Waiting for request outcomes: %v", err)
+			time.Sleep(redisPollInterval)
+			continue
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			continue
+		}
+		var wire redisOutcome
+		if err = json.Unmarshal([]byte(fmt.Sprint(items[1])), &wire); err != nil {
+			errorLogger.Printf("Reading a request outcome: %v", err)
+			continue
+		}
+		q.mu.Lock()
+		req, ok := q.waiting[wire.ID]
+		delete(q.waiting, wire.ID)
+		q.mu.Unlock()
+		if !ok {
+			//queued before a restart, or abandoned in the meantime
+			continue
+		}
+		outcome := EmailSendOutcome{
+			Deliveries: wire.Deliveries,
+			Deferred:   wire.Deferred,
+			Batches:    wire.Batches,
+			Degraded:   wire.Degraded,
+			Elapsed:    wire.Elapsed,
+			Bounces:    wire.Bounces,
+			Suppressed: wire.Suppressed,
+		}
+		switch {
+		case wire.Limit != nil:
+			outcome.Error = &SendError{Category: wire.Category, Err: wire.Limit}
+		case wire.Error != "":
+			outcome.Error = &SendError{Category: wire.Category, Err: errors.New(wire.Error)}
+		}
+		//a requester slow to take its outcome mustn't hold up the others
+		go func() {
+			select {
+			case req.Result <- outcome:
+			case <-req.Done:
+			}
+		}()
+	}
+}
+
+//sweep stops waiting for the requests whose requester left, and marks
+//them abandoned
+func (q *redisQueue) sweep() {
+	var abandoned []string
+	q.mu.Lock()
+	for id, req := range q.waiting {
+		if req.abandoned() {
+			abandoned = append(abandoned, id)
+			delete(q.waiting, id)
+		}
+	}
+	q.mu.Unlock()
+	for _, id := range abandoned {
+		q.client.do(0, "SET", q.prefix+"abandoned:"+id, "1", "EX", strconv.Itoa(int(redisResultTTL.Seconds())))
+	}
+}
+
+//recover queues again the requests this instance was processing when it
+//last stopped, ahead of the others
+func (q *redisQueue) recover() error {
+	reply, err := q.client.do(0, "LRANGE", q.processing, "0", "-1")
+	if err != nil {
+		return err
+	}
+	items, _ := reply.([]interface{})
+	for _, item := range items {
+		raw := fmt.Sprint(item)
+		var req EmailSendRequest
+		if err = json.Unmarshal([]byte(raw), &req); err != nil {
+			errorLogger.Printf("Dropping unreadable request from %s: %v", q.processing, err)
+		} else if _, err = q.client.do(0, "RPUSH", q.queueKey(req.Priority), raw); err != nil {
+			return err
+		} else {
+			metrics.inc("redis_queue_recovered_total")
+		}
+		if _, err = q.client.do(0, "LREM", q.processing, "1", raw); err != nil {
+			return err
+		}
+	}
+	if len(items) > 0 {
+		infoLogger.Printf("Requeued %d requests left in %s", len(items), q.processing)
+	}
+	return nil
+}
+
+//pop moves the next request to the processing list, high priority first,
+//and returns it or "" if none came in time
+func (q *redisQueue) pop() (string, error) {
+	reply, err := q.client.do(0, "RPOPLPUSH", q.queueKey(PriorityHigh), q.processing)
+	if err == nil && reply == nil {
+		reply, err = q.client.do(redisPollInterval, "BRPOPLPUSH", q.queueKey(PriorityNormal), q.processing, strconv.Itoa(int(redisPollInterval.Seconds())))
+	}
+	if err != nil || reply == nil {
+		return "", err
+	}
+	return fmt.Sprint(reply), nil
+}
+
+//feed hands the requests of all instances to the local queue, as long as
+//one of its workers is free and sending isn't paused, and sends their
+//outcomes back
+func (q *redisQueue) feed() {
+	if err := q.recover(); err != nil {
+		errorLogger.Printf("Recovering %s: %v", q.processing, err)
+	}
+	slots := make(chan struct{}, q.workers)
+	for {
+		<-q.local.gate()
+		slots <- struct{}{}
+		raw, err := q.pop()
+		if err != nil {
+			errorLogger.Printf("Taking a request from Redis: %v", err)
+			time.Sleep(redisPollInterval)
+		}
+		if raw == "" {
+			<-slots
+			continue
+		}
+		var req EmailSendRequest
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.UseNumber()
+		if err = dec.Decode(&req); err != nil {
+			errorLogger.Printf("Dropping unreadable request from Redis: %v", err)
+			q.ack(raw)
+			<-slots
+			continue
+		}
+		if abandoned, _ := q.client.do(0, "EXISTS", q.prefix+"abandoned:"+req.ID); abandoned == int64(1) {
+			infoLogger.Printf("Skipping request %s, it was abandoned while queued", req.ID)
+			q.ack(raw)
+			<-slots
+			continue
+		}
+		result := make(chan EmailSendOutcome, 1)
+		req.Result = result
+		q.local.put(req)
+		go func() {
+			q.publish(req, <-result)
+			q.ack(raw)
+			<-slots
+		}()
+	}
+}
+
+//publish sends outcome back to the instance waiting for it
+func (q *redisQueue) publish(req EmailSendRequest, outcome EmailSendOutcome) {
+	wire := redisOutcome{
+		ID:         req.ID,
+		Deliveries: outcome.Deliveries,
+		Deferred:   outcome.Deferred,
+		Batches:    outcome.Batches,
+		Degraded:   outcome.Degraded,
+		Elapsed:    outcome.Elapsed,
+		Bounces:    outcome.Bounces,
+		Suppressed: outcome.Suppressed,
+	}
+	if outcome.Error != nil {
+		wire.Error = outcome.Error.Error()
+		wire.Category = classifyError(outcome.Error)
+		var limitErr *LimitError
+		if errors.As(outcome.Error, &limitErr) {
+			wire.Limit = limitErr
+		}
+	}
+	raw, err := json.Marshal(wire)
+	if err == nil {
+		key := req.ResultQueue
+		if key == "" {
+			//queued by an instance waiting on a list per request
+			key = q.prefix + "result:" + req.ID
+		}
+		if _, err = q.client.do(0, "RPUSH", key, string(raw)); err == nil {
+			_, err = q.client.do(0, "EXPIRE", key, strconv.Itoa(int(redisResultTTL.Seconds())))
+		}
+	}
+	if err != nil {
+		errorLogger.Printf("Sending back the outcome of request %s: %v", req.ID, err)
+	}
+}
+
+//ack removes a request done with from the processing list
+func (q *redisQueue) ack(raw string) {
+	if _, err := q.client.do(0, "LREM", q.processing, "1", raw); err != nil {
+		errorLogger.Printf("Removing a request from %s: %v", q.processing, err)
+	}
+}
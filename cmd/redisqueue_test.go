@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeRedis serves the list commands of the queue from memory, and counts
+//its connections
+type fakeRedis struct {
+	mu       sync.Mutex
+	lists    map[string][]string
+	keys     map[string]bool
+	conns    int
+	maxConns int
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &fakeRedis{lists: make(map[string][]string), keys: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r, l.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	r.mu.Lock()
+	r.conns++
+	if r.conns > r.maxConns {
+		r.maxConns = r.conns
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.conns--
+		r.mu.Unlock()
+		conn.Close()
+	}()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte(r.run(args))); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+//pop takes the last item of list, waiting up to timeout seconds for one
+func (r *fakeRedis) pop(list string, last bool, timeout string) (string, bool) {
+	seconds, _ := strconv.Atoi(timeout)
+	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+	for {
+		r.mu.Lock()
+		if items := r.lists[list]; len(items) > 0 {
+			var item string
+			if last {
+				item, r.lists[list] = items[len(items)-1], items[:len(items)-1]
+			} else {
+				item, r.lists[list] = items[0], items[1:]
+			}
+			r.mu.Unlock()
+			return item, true
+		}
+		r.mu.Unlock()
+		if !time.Now().Before(deadline) {
+			return "", false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (r *fakeRedis) run(args []string) string {
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "LPUSH":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.lists[args[1]] = append([]string{args[2]}, r.lists[args[1]]...)
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+	case "RPUSH":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.lists[args[1]] = append(r.lists[args[1]], args[2])
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+	case "RPOPLPUSH", "BRPOPLPUSH":
+		timeout := "0"
+		if args[0] == "BRPOPLPUSH" {
+			timeout = args[3]
+		}
+		item, ok := r.pop(args[1], true, timeout)
+		if !ok {
+			return "$-1\r\n"
+		}
+		r.run([]string{"LPUSH", args[2], item})
+		return bulk(item)
+	case "BLPOP":
+		item, ok := r.pop(args[1], false, args[2])
+		if !ok {
+			return "*-1\r\n"
+		}
+		return "*2\r\n" + bulk(args[1]) + bulk(item)
+	case "LREM":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		items := r.lists[args[1]]
+		for i, item := range items {
+			if item == args[3] {
+				r.lists[args[1]] = append(items[:i:i], items[i+1:]...)
+				return ":1\r\n"
+			}
+		}
+		return ":0\r\n"
+	case "LRANGE":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		items := r.lists[args[1]]
+		reply := fmt.Sprintf("*%d\r\n", len(items))
+		for _, item := range items {
+			reply += bulk(item)
+		}
+		return reply
+	case "SET":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.keys[args[1]] = true
+		return "+OK\r\n"
+	case "EXISTS":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.keys[args[1]] {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EXPIRE":
+		return ":1\r\n"
+	}
+	return "-ERR unknown command " + args[0] + "\r\n"
+}
+
+func TestRedisQueueOutcomes(t *testing.T) {
+	fake, addr := startFakeRedis(t)
+	local := newEmailQueue(QueueConfig{})
+	q, err := (&RedisQueueConfig{Address: addr, InstanceID: "test"}).open(local, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan EmailSendRequest)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for req := range out {
+				req.Result <- EmailSendOutcome{Batches: 1, Deferred: []string{req.ID}}
+			}
+		}()
+	}
+	go q.dispatch(out)
+
+	const requests = 50
+	results := make([]chan EmailSendOutcome, requests)
+	for i := range results {
+		results[i] = make(chan EmailSendOutcome)
+		q.enqueue(EmailSendRequest{ID: strconv.Itoa(i), Result: results[i], Done: make(chan struct{})})
+	}
+	for i, result := range results {
+		select {
+		case outcome := <-result:
+			if outcome.Error != nil || len(outcome.Deferred) != 1 || outcome.Deferred[0] != strconv.Itoa(i) {
+				t.Fatalf("request %d got %+v", i, outcome)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no outcome for request %d", i)
+		}
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.maxConns > redisMaxConns {
+		t.Errorf("%d requests held %d connections, want at most %d", requests, fake.maxConns, redisMaxConns)
+	}
+}
+
+func TestRedisQueueAbandoned(t *testing.T) {
+	fake, addr := startFakeRedis(t)
+	local := newEmailQueue(QueueConfig{})
+	local.pause()
+	q, err := (&RedisQueueConfig{Address: addr, InstanceID: "test"}).open(local, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan EmailSendRequest)
+	go q.dispatch(out)
+	done := make(chan struct{})
+	q.enqueue(EmailSendRequest{ID: "gone", Result: make(chan EmailSendOutcome), Done: done})
+	close(done)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fake.mu.Lock()
+		marked := fake.keys[q.prefix+"abandoned:gone"]
+		fake.mu.Unlock()
+		if marked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the abandoned request wasn't marked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.mu.Lock()
+	waiting := len(q.waiting)
+	q.mu.Unlock()
+	if waiting != 0 {
+		t.Errorf("still waiting for %d requests", waiting)
+	}
+
+	local.resume()
+	select {
+	case req := <-out:
+		t.Fatalf("abandoned request %s reached a worker", req.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
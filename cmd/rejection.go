@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//RejectionConfig shapes the responses clientHandler rejects requests
+//with, i.e. those with a 4xx status
+type RejectionConfig struct {
+	//Responses overrides the response of a status, e.g. 413 or 422
+	Responses map[int]RejectionResponse `yaml:"Responses"`
+	//NegotiateFormat answers with JSON or an HTML page when the Accept
+	//header prefers them to plain text
+	NegotiateFormat bool `yaml:"NegotiateFormat"`
+}
+
+//RejectionResponse replaces the message of a rejection, or redirects the
+//client elsewhere
+type RejectionResponse struct {
+	Message string `yaml:"Message"`
+	//Redirect, if set, is where the client is sent with a 303 in place of
+	//an error response
+	Redirect string `yaml:"Redirect"`
+}
+
+//RejectionBody is the JSON body of a rejection
+type RejectionBody struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+var rejectionPage = template.Must(template.New("rejection").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.Text}}</title></head>
+<body><p>{{.Message}}</p></body>
+</html>
+`))
+
+func (c *RejectionConfig) validate() error {
+	for status, resp := range c.Responses {
+		if status < 400 || status > 499 {
+			return fmt.Errorf("%d is not a client error status", status)
+		}
+		if resp.Redirect != "" {
+			if _, err := url.Parse(resp.Redirect); err != nil {
+				return fmt.Errorf("the redirect of %d: %w", status, err)
+			}
+		}
+	}
+	return nil
+}
+
+//reject answers r with status and message, as configured in Rejections.
+//Without them it's http.Error.
+func (s *server) reject(w http.ResponseWriter, r *http.Request, message string, status int) {
+	c := s.config.Rejections
+	if c == nil {
+		http.Error(w, message, status)
+		return
+	}
+	resp := c.Responses[status]
+	if resp.Redirect != "" {
+		http.Redirect(w, r, resp.Redirect, http.StatusSeeOther)
+		return
+	}
+	if resp.Message != "" {
+		message = resp.Message
+	}
+	format := "text/plain"
+	if c.NegotiateFormat {
+		format = preferredType(r.Header.Get("Accept"), "text/plain", "application/json", "text/html")
+	}
+	switch format {
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(RejectionBody{Status: status, Error: message})
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		rejectionPage.Execute(w, map[string]interface{}{"Status": status, "Text": http.StatusText(status), "Message": message})
+	default:
+		http.Error(w, message, status)
+	}
+}
+
+//preferredType returns the one of offers accept ranks highest, the first
+//of them on ties or without an Accept header
+func preferredType(accept string, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for i, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if accept == "" && i == 0 {
+			q = 1
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+//acceptQuality returns the q value accept gives mediaType, from its most
+//specific matching range
+func acceptQuality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case rng == mediaType:
+			s = 2
+		case strings.HasSuffix(rng, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rng, "*")):
+			s = 1
+		case rng == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, p := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	return q
+}
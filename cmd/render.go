@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//errRenderTimeout is returned when a template runs past RenderTimeout
+var errRenderTimeout = errors.New("template rendering timed out")
+
+//HTML failure modes, see MailConfig.HTMLFailureMode
+const (
+	HTMLFailureFail    = "fail"
+	HTMLFailureDegrade = "degrade"
+)
+
+func init() {
+	metrics.describe("html_render_degraded_total", counterMetric, "Messages sent as plain text only because the HTML body failed to render")
+}
+
+func validateHTMLFailureMode(mode string) error {
+	switch mode {
+	case "", HTMLFailureFail, HTMLFailureDegrade:
+		return nil
+	}
+	return fmt.Errorf("unknown HTML failure mode %q", mode)
+}
+
+//templateExecutor is met by both text and html templates
+type templateExecutor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+//renderWriter collects template output, failing writes past the size cap
+//or once rendering was given up on
+type renderWriter struct {
+	buf     bytes.Buffer
+	max     int
+	stopped int32
+}
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.stopped) != 0 {
+		return 0, errRenderTimeout
+	}
+	if size := w.buf.Len() + len(p); w.max > 0 && size > w.max {
+		return 0, &LimitError{"MaxRenderBytes", int64(w.max), int64(size)}
+	}
+	return w.buf.Write(p)
+}
+
+//renderError reports a failed rendering as a template error, unless it
+//hit a size limit
+func renderError(name string, err error) error {
+	err = fmt.Errorf("rendering %s: %w", name, err)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+	return &SendError{Category: CategoryTemplate, Err: err}
+}
+
+//render executes t on data within RenderTimeout and MaxRenderBytes. After
+//a timeout the template keeps running in the background until its next
+//write, so a worker is never held up by it.
+func (l *MessageLimits) render(name string, t templateExecutor, data interface{}) ([]byte, error) {
+	w := &renderWriter{max: l.MaxRenderBytes}
+	if l.RenderTimeout <= 0 {
+		if err := t.Execute(w, data); err != nil {
+			return nil, renderError(name, err)
+		}
+		return w.buf.Bytes(), nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Execute(w, data)
+	}()
+	timer := time.NewTimer(l.RenderTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, renderError(name, err)
+		}
+		return w.buf.Bytes(), nil
+	case <-timer.C:
+		atomic.StoreInt32(&w.stopped, 1)
+		return nil, renderError(name, fmt.Errorf("%w after %s", errRenderTimeout, l.RenderTimeout))
+	}
+}
+
+//healthCheckRequest is the canned request the deep health check renders
+var healthCheckRequest = EmailSendRequest{
+	ID:            "healthcheck",
+	IPAddress:     "127.0.0.1:0",
+	FirstName:     "Health",
+	LastName:      "Check",
+	ProductSerial: "0000",
+	ProductModel:  "HEALTHCHECK",
+	PhoneNumber:   "+10000000000",
+	CompanyName:   "Health Check",
+	EmailAddress:  "healthcheck@example.invalid",
+	Description:   "Deep health check",
+	Data:          map[string]interface{}{},
+}
+
+//checkRender renders the current templates, and digest's if set, for
+//healthCheckRequest and assembles the message to every recipient, without
+//sending anything
+func (m *MailConfig) checkRender(digest *DigestConfig) error {
+	req := healthCheckRequest
+	templates := m.templates.get()
+	text, err := m.Limits.render("body", templates.text, req)
+	if err != nil {
+		return err
+	}
+	var html []byte
+	if templates.html != nil {
+		if html, err = m.Limits.render("HTML body", templates.html, req); err != nil {
+			return err
+		}
+	}
+	if text, html, err = m.addFooter(templates, &req, text, html); err != nil {
+		return err
+	}
+	if _, err = m.renderInvite(templates, &req); err != nil {
+		return err
+	}
+	recipients := m.currentRecipients()
+	if len(recipients) == 0 {
+		recipients = map[string]Recipient{"": {Address: req.EmailAddress}}
+	}
+	for key, r := range recipients {
+		recipientText, recipientHTML := r.bodies(text, html)
+		if _, err = m.buildMessage(m.headerFor(r), r.Address, recipientText, recipientHTML, nil); err != nil {
+			return fmt.Errorf("assembling the message to %s: %w", key, err)
+		}
+	}
+	if digest != nil {
+		now := time.Now()
+		batch := &digestBatch{Items: []EmailSendRequest{req}, Since: now, Until: now}
+		if _, err = m.Limits.render("digest", digest.template, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+//ErrServiceUnavailable is returned without contacting the relay while the
+//circuit breaker is open
+var ErrServiceUnavailable = errors.New("service unavailable: SMTP circuit breaker is open")
+
+//RetryConfig controls how often a failed send is retried. Delays grow
+//exponentially from InitialDelay up to MaxDelay, with random jitter.
+type RetryConfig struct {
+	Attempts     int           `yaml:"Attempts"`
+	InitialDelay time.Duration `yaml:"InitialDelay"`
+	MaxDelay     time.Duration `yaml:"MaxDelay"`
+}
+
+//BreakerConfig configures the circuit breaker around the relay. After
+//FailureThreshold consecutive failures sends fail fast for Cooldown, then
+//a single probe is let through. A zero threshold disables the breaker.
+type BreakerConfig struct {
+	FailureThreshold int           `yaml:"FailureThreshold"`
+	Cooldown         time.Duration `yaml:"Cooldown"`
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func init() {
+	metrics.describe("smtp_circuit_breaker_state", gaugeMetric, "0 closed, 1 open, 2 half-open")
+	metrics.describe("smtp_circuit_breaker_rejections_total", counterMetric, "Sends failed fast by an open breaker")
+	metrics.describe("smtp_send_retries_total", counterMetric, "Retried SMTP sends")
+	metrics.describe("smtp_connect_retries_total", counterMetric, "Sends retried as the server couldn't be reached")
+}
+
+//connectError is a failure to reach the server at all, so nothing was
+//sent yet
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return "connecting: " + e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+type circuitBreaker struct {
+	config BreakerConfig
+	//name labels the breaker in metrics
+	name string
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, config BreakerConfig) *circuitBreaker {
+	b := &circuitBreaker{config: config, name: name}
+	b.setState(breakerClosed)
+	return b
+}
+
+//setState changes the state. b.mu must be held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	metrics.set("smtp_circuit_breaker_state", float64(state), "server", b.name)
+}
+
+//allow reports whether a send may be attempted now
+func (b *circuitBreaker) allow() bool {
+	if b.config.FailureThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.Cooldown {
+			break
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		//a probe is already in flight
+	default:
+		return true
+	}
+	metrics.inc("smtp_circuit_breaker_rejections_total", "server", b.name)
+	return false
+}
+
+//record feeds the result of an attempted send to the breaker
+func (b *circuitBreaker) record(err error) {
+	if b.config.FailureThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !isTemporary(err) || isGreylisted(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+//isTemporary reports whether err may go away on retry. Permanent (5xx)
+//SMTP replies and policy violations are not worth retrying and say nothing
+//about relay health.
+func isTemporary(err error) bool {
+	if errors.Is(err, errSTARTTLSUnavailable) || errors.Is(err, errAUTHUnavailable) {
+		return false
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code < 500
+	}
+	var backendErr interface{ temporary() bool }
+	if errors.As(err, &backendErr) {
+		return backendErr.temporary()
+	}
+	return true
+}
+
+//backoff returns the delay before retry number attempt (0 based), using
+//"equal jitter": half the exponential delay plus a random share of the rest
+func (c *RetryConfig) backoff(attempt int) time.Duration {
+	delay := c.InitialDelay << uint(attempt)
+	if delay <= 0 || (c.MaxDelay > 0 && delay > c.MaxDelay) {
+		delay = c.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+//whileUnreachable runs send, retrying it for as long as the server named
+//name can't be reached, up to c.Attempts times or until ctx is done. A
+//relay that comes up shortly after us, e.g. in the next container to
+//start, is waited for rather than failing the first sends.
+func (c *RetryConfig) whileUnreachable(ctx context.Context, name string, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := send()
+		var connErr *connectError
+		if !errors.As(err, &connErr) || attempt >= c.Attempts {
+			return err
+		}
+		metrics.inc("smtp_connect_retries_total", "server", name)
+		errorLogger.Printf("Connecting to %s failed (attempt %d/%d), retrying: %v", name, attempt+1, c.Attempts+1, err)
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+//withRetry runs send through the breaker, retrying temporary failures
+//according to the retry policy until ctx is done. Greylisting isn't
+//retried right away, that would only get us greylisted again.
+func (c *RetryConfig) withRetry(ctx context.Context, b *circuitBreaker, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		if !b.allow() {
+			return ErrServiceUnavailable
+		}
+		err := send()
+		b.record(err)
+		if err == nil || !isTemporary(err) || isGreylisted(err) || attempt >= c.Attempts {
+			return err
+		}
+		metrics.inc("smtp_send_retries_total", "server", b.name)
+		errorLogger.Printf("Send attempt %d/%d failed, retrying: %v", attempt+1, c.Attempts+1, err)
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetryStopsWhenContextDone(t *testing.T) {
+	c := &RetryConfig{Attempts: 5, InitialDelay: time.Minute, MaxDelay: time.Minute}
+	b := newCircuitBreaker("test", BreakerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sendErr := errors.New("connection reset")
+	sends := 0
+	start := time.Now()
+	err := c.withRetry(ctx, b, func() error {
+		sends++
+		return sendErr
+	})
+	if err != sendErr {
+		t.Errorf("got %v, want the last send error", err)
+	}
+	if sends != 1 {
+		t.Errorf("got %d sends, want 1", sends)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %v, the backoff ignored the context", elapsed)
+	}
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//defaultNotFoundMessage is the 404 body unless NotFoundMessage is set
+const defaultNotFoundMessage = "Not Found"
+
+//rootHandler serves the paths no other handler is registered for: the
+//client handler's if BaseURL is "/", a short note at "/" otherwise, and
+//404 for everything else
+func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == s.config.BaseURL:
+		s.clientHandler(w, r)
+	case r.URL.Path == "/":
+		fmt.Fprintf(w, "docs-email-sender is running, requests are accepted at %s\n", s.config.BaseURL)
+	default:
+		s.notFound(w, r)
+	}
+}
+
+//notFound answers a request for an unknown path
+func (s *server) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.config.LogNotFound {
+		debugLogger.Printf("No handler for %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	}
+	message := s.config.NotFoundMessage
+	if message == "" {
+		message = defaultNotFoundMessage
+	}
+	http.Error(w, strings.TrimSuffix(message, "\n"), http.StatusNotFound)
+}
+
+//route is an endpoint, pattern being an http.ServeMux pattern
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	//setting is the config setting a configured pattern comes from, ""
+	//for built-in ones
+	setting string
+}
+
+//routes returns the endpoints enabled by the config
+func (s *server) routes() []route {
+	var routes []route
+	add := func(pattern string, handler http.HandlerFunc) {
+		routes = append(routes, route{pattern: pattern, handler: handler})
+	}
+	if s.config.BaseURL != "/" {
+		routes = append(routes, route{s.config.BaseURL, s.clientHandler, "BaseURL"})
+	}
+	if s.config.MetricsPath != "" {
+		routes = append(routes, route{s.config.MetricsPath, metrics.ServeHTTP, "MetricsPath"})
+	}
+	add("/", s.rootHandler)
+	if s.config.EmailConfig.Tracking != nil {
+		add(trackOpenPath, s.trackOpenHandler)
+		add(trackClickPath, s.trackClickHandler)
+	}
+	if s.config.EmailConfig.sentLog != nil && s.config.AdminToken != "" {
+		add("/sent", s.requireAdmin(s.config.EmailConfig.sentLog.ServeHTTP))
+	}
+	add("/healthz", s.healthHandler)
+	add("/schema", s.schemaHandler)
+	if s.status != nil {
+		add(statusPath, s.statusHandler)
+	}
+	if s.config.AdminToken != "" {
+		add("/debug/headers", s.requireAdmin(s.debugHeadersHandler))
+		add("/admin/reload-templates", s.requireAdmin(s.reloadTemplatesHandler))
+		add("/admin/", s.requireAdmin(s.adminPageHandler))
+		add("/admin/recipients", s.requireAdmin(s.recipientsHandler))
+		add("/admin/pause", s.requireAdmin(s.pauseHandler))
+		if s.config.RecipientTokens != nil {
+			add("/admin/recipient-token", s.requireAdmin(s.recipientTokenHandler))
+		}
+		add("/admin/resume", s.requireAdmin(s.resumeHandler))
+		add("/stats", s.requireAdmin(s.statsHandler))
+		if s.config.EmailConfig.VERP != nil && s.config.EmailConfig.suppressions != nil {
+			add("/admin/bounces", s.requireAdmin(s.bounceHandler))
+		}
+	}
+	return routes
+}
+
+//checkRoutes lists the configured patterns of routes that take requests
+//meant for another endpoint: those registered twice, and those under the
+//subtree of a built-in endpoint, e.g. "/admin/x". Built-in endpoints
+//nest on purpose, and everything falls back on "/".
+func checkRoutes(routes []route) error {
+	var conflicts []string
+	for i, a := range routes {
+		for _, b := range routes[i+1:] {
+			if a.setting == "" && b.setting == "" {
+				continue
+			}
+			under := func(p, subtree route) bool {
+				return subtree.setting == "" && subtree.pattern != "/" && strings.HasSuffix(subtree.pattern, "/") && strings.HasPrefix(p.pattern, subtree.pattern)
+			}
+			if a.pattern == b.pattern || under(a, b) || under(b, a) {
+				conflicts = append(conflicts, fmt.Sprintf("%s %q collides with %s", describeRoute(a), a.pattern, describeRoute(b)))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting paths: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+func describeRoute(r route) string {
+	if r.setting != "" {
+		return r.setting
+	}
+	return "the built-in endpoint " + r.pattern
+}
+
+//registerRoutes checks the routes and registers them with the default
+//ServeMux
+func (s *server) registerRoutes() error {
+	routes := s.routes()
+	if err := checkRoutes(routes); err != nil {
+		return err
+	}
+	for _, r := range routes {
+		http.HandleFunc(r.pattern, r.handler)
+	}
+	return nil
+}
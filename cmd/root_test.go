@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ServerConfig
+		//conflict is what the error names, "" if there is none
+		conflict string
+	}{
+		{"defaults", ServerConfig{BaseURL: "/"}, ""},
+		{"own base URL", ServerConfig{BaseURL: "/contact", MetricsPath: "/metrics"}, ""},
+		{"base URL on a built-in", ServerConfig{BaseURL: "/healthz"}, `BaseURL "/healthz" collides with the built-in endpoint /healthz`},
+		{"metrics on the base URL", ServerConfig{BaseURL: "/send", MetricsPath: "/send"}, `BaseURL "/send" collides with MetricsPath`},
+		{"under a built-in subtree", ServerConfig{BaseURL: "/", MetricsPath: "/admin/metrics", AdminToken: "secret"}, `MetricsPath "/admin/metrics" collides with the built-in endpoint /admin/`},
+		{"admin subtree off", ServerConfig{BaseURL: "/", MetricsPath: "/admin/metrics"}, ""},
+		{"own subtree", ServerConfig{BaseURL: "/api/", MetricsPath: "/api/metrics"}, ""},
+	}
+	for _, test := range tests {
+		s := &server{config: test.config}
+		err := checkRoutes(s.routes())
+		switch {
+		case test.conflict == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.conflict != "" && (err == nil || !strings.Contains(err.Error(), test.conflict)):
+			t.Errorf("%s: got %v, want %s", test.name, err, test.conflict)
+		}
+	}
+}
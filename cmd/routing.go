@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//RoutingConfig sends each request to a single recipient picked by the
+//first matching rule, e.g. descriptions mentioning billing to finance
+type RoutingConfig struct {
+	Rules []RoutingRule `yaml:"Rules"`
+	//Default is the recipient key used when no rule matches. If it's empty
+	//such requests go to all recipients.
+	Default string `yaml:"Default"`
+}
+
+//RoutingRule matches an EmailSendRequest field (e.g. "Description") or a
+//key of its data. Exactly one of Contains, matched case-insensitively,
+//and Regex should be set.
+type RoutingRule struct {
+	Field     string `yaml:"Field"`
+	Contains  string `yaml:"Contains"`
+	Regex     string `yaml:"Regex"`
+	Recipient string `yaml:"Recipient"`
+
+	regex *regexp.Regexp
+}
+
+//compile validates the rules and compiles their regular expressions.
+//Recipient keys are only checked against a static recipient list.
+func (c *RoutingConfig) compile(recipients map[string]Recipient) error {
+	known := func(key string) bool {
+		_, ok := recipients[key]
+		return recipients == nil || ok
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Field == "" {
+			return fmt.Errorf("routing rule %d has no field", i+1)
+		}
+		if (rule.Contains == "") == (rule.Regex == "") {
+			return fmt.Errorf("routing rule %d needs exactly one of Contains and Regex", i+1)
+		}
+		if !known(rule.Recipient) {
+			return fmt.Errorf("routing rule %d: unknown recipient %q", i+1, rule.Recipient)
+		}
+		if rule.Regex != "" {
+			var err error
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("routing rule %d: %w", i+1, err)
+			}
+		}
+	}
+	if c.Default != "" && !known(c.Default) {
+		return errors.New("unknown default routing recipient " + c.Default)
+	}
+	return nil
+}
+
+func (rule *RoutingRule) matches(req *EmailSendRequest) bool {
+	value := req.field(rule.Field)
+	if rule.regex != nil {
+		return rule.regex.MatchString(value)
+	}
+	return strings.Contains(strings.ToLower(value), strings.ToLower(rule.Contains))
+}
+
+//route returns the key of the recipient req goes to, empty for all of them
+func (c *RoutingConfig) route(req *EmailSendRequest) string {
+	for i := range c.Rules {
+		if rule := &c.Rules[i]; rule.matches(req) {
+			infoLogger.Printf("Routing request %s to %s, rule %d matched its %s", req.ID, rule.Recipient, i+1, rule.Field)
+			return rule.Recipient
+		}
+	}
+	if c.Default != "" {
+		infoLogger.Printf("Routing request %s to default recipient %s, no rule matched", req.ID, c.Default)
+	}
+	return c.Default
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"text/template"
+	"unicode/utf8"
+)
+
+//requestSchemaVersion is bumped whenever fields are removed or change
+//meaning, adding fields keeps it
+const requestSchemaVersion = 1
+
+//FieldRule constrains a request field, see ServerConfig.RequestFields
+type FieldRule struct {
+	Required bool `yaml:"Required"`
+	//MaxLength is the maximum number of characters, 0 for no limit
+	MaxLength int `yaml:"MaxLength"`
+}
+
+//schemaField describes a field clientHandler accepts
+type schemaField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	MaxLength   int    `json:"maxLength,omitempty"`
+	AdminOnly   bool   `json:"adminOnly,omitempty"`
+}
+
+//requestFields are the form fields clientHandler reads
+var requestFields = []schemaField{
+	{Name: "firstName", Type: "string", Description: "Submitter's first name"},
+	{Name: "lastName", Type: "string", Description: "Submitter's last name"},
+	{Name: "productSerial", Type: "string", Description: "Serial number of the product"},
+	{Name: "productModel", Type: "string", Description: "Model of the product"},
+	{Name: "phoneNumber", Type: "string", Description: "Submitter's phone number"},
+	{Name: "company", Type: "string", Description: "Submitter's company"},
+	{Name: "email", Type: "email", Description: "Submitter's email address"},
+	{Name: "description", Type: "string", Description: "Description of the issue"},
+	{Name: "priority", Type: "enum(normal,high)", Description: "Queue priority, normal by default"},
+	{Name: "inReplyTo", Type: "message-id", Description: "Message-ID of the message this one replies to"},
+	{Name: "references", Type: "message-ids", Description: "Message-IDs of the thread, space separated"},
+	{Name: "data", Type: "json-object", Description: "Free-form data available to templates as .Data"},
+	{Name: "attachments", Type: "files", Description: "Attached files, multipart/form-data only"},
+	{Name: "attachmentURL", Type: "urls", Description: "URLs of documents to attach, repeated"},
+	{Name: "fromBrand", Type: "string", Description: "Key of the brand to send as"},
+	{Name: "recipient", Type: "string", Description: "Key of the only recipient to send to", AdminOnly: true},
+	{Name: "recipients", Type: "strings", Description: "Keys of the recipients to send to, repeated or comma separated"},
+	{Name: "recipientToken", Type: "string", Description: "Signed token naming the only recipient to send to"},
+	{Name: "category", Type: "string", Description: "Category forwarded to the provider, if tagging is configured"},
+	{Name: "tags", Type: "strings", Description: "Tags forwarded to the provider, comma separated"},
+}
+
+//requestSchema is the body of /schema
+type requestSchema struct {
+	Version            int           `json:"version"`
+	Fields             []schemaField `json:"fields"`
+	Templates          []string      `json:"templates"`
+	MaxRequestBytes    int64         `json:"maxRequestBytes"`
+	MaxAttachments     int           `json:"maxAttachments,omitempty"`
+	MaxAttachmentBytes int64         `json:"maxAttachmentBytes,omitempty"`
+}
+
+//validateFieldRules rejects rules for unknown fields, or fields that
+//aren't text
+func validateFieldRules(rules map[string]FieldRule) error {
+	for name, rule := range rules {
+		known := false
+		for _, f := range requestFields {
+			known = known || f.Name == name
+		}
+		if !known || name == "attachments" {
+			return fmt.Errorf("no text field %q to apply a rule to", name)
+		}
+		if rule.MaxLength < 0 {
+			return fmt.Errorf("field %q: negative MaxLength", name)
+		}
+	}
+	return nil
+}
+
+//checkFields applies the RequestFields rules to the form of r
+func (s *server) checkFields(r *http.Request) error {
+	for name, rule := range s.config.RequestFields {
+		v := r.FormValue(name)
+		if rule.Required && v == "" {
+			return fmt.Errorf("%s is required", name)
+		}
+		if n := utf8.RuneCountInString(v); rule.MaxLength > 0 && n > rule.MaxLength {
+			return fmt.Errorf("%s is longer than %d characters", name, rule.MaxLength)
+		}
+	}
+	return nil
+}
+
+//templateNames lists the templates of t, including those it defines
+func (t *templateSet) templateNames() []string {
+	var names []string
+	for _, tmpl := range []templateExecutor{t.text, t.html, t.textFooter, t.htmlFooter} {
+		switch tmpl := tmpl.(type) {
+		case *template.Template:
+			for _, defined := range tmpl.Templates() {
+				names = append(names, defined.Name())
+			}
+		case *htmltemplate.Template:
+			for _, defined := range tmpl.Templates() {
+				names = append(names, defined.Name())
+			}
+		case *mustacheTemplate:
+			names = append(names, tmpl.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//schemaHandler describes the fields the client handler accepts, so
+//frontends can discover them
+func (s *server) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limits := s.config.EmailConfig.Limits
+	schema := requestSchema{
+		Version:            requestSchemaVersion,
+		Templates:          s.config.EmailConfig.templates.get().templateNames(),
+		MaxRequestBytes:    s.config.MaxRequestBytes,
+		MaxAttachments:     limits.MaxAttachments,
+		MaxAttachmentBytes: limits.MaxAttachmentBytes,
+	}
+	for _, f := range requestFields {
+		rule := s.config.RequestFields[f.Name]
+		f.Required, f.MaxLength = rule.Required, rule.MaxLength
+		schema.Fields = append(schema.Fields, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schema)
+}
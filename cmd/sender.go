@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+)
+
+//Sender backends, see SenderConfig.Backend
+const (
+	BackendSMTP     = "smtp"
+	BackendSES      = "ses"
+	BackendSendmail = "sendmail"
+)
+
+//Message is an assembled message ready to be handed to a Sender
+type Message struct {
+	//From is the envelope sender, the sender's address if empty
+	From string
+	//To are the envelope recipients, which may differ from the To header
+	To []string
+	//Data is the complete RFC 5322 message, headers included
+	Data []byte
+	//Identity, if set, is the sender identity to authenticate as. Servers
+	//with credentials of their own, and so no identities, ignore it.
+	Identity *SenderIdentity
+}
+
+//Sender delivers messages through one backend. Send returns how the
+//message was transported, which ends up in the delivery reports.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) (string, error)
+}
+
+//newSender returns the Sender for the configured backend
+func (s *SenderConfig) newSender() Sender {
+	switch s.backend() {
+	case BackendSES:
+		return &sesSender{config: s.SES, from: s.envelopeAddress()}
+	case BackendSendmail:
+		return &sendmailSender{config: s.Sendmail, from: s.envelopeAddress()}
+	}
+	return &smtpSender{config: s, auth: s.auth()}
+}
+
+//backend returns the configured backend, defaulting to BackendSMTP
+func (s *SenderConfig) backend() string {
+	if s.Backend == "" {
+		return BackendSMTP
+	}
+	return s.Backend
+}
+
+//serverName names the server of the backend in logs and metrics
+func (s *SenderConfig) serverName() string {
+	switch {
+	case s.backend() == BackendSES && s.SES != nil:
+		return s.SES.host()
+	case s.backend() == BackendSendmail:
+		return BackendSendmail
+	}
+	return s.Host
+}
+
+func (s *SenderConfig) validateBackend() error {
+	switch s.backend() {
+	case BackendSMTP, BackendSendmail:
+		return nil
+	case BackendSES:
+		if s.SES == nil {
+			return fmt.Errorf("backend %q needs SES settings", BackendSES)
+		}
+		return s.SES.validate()
+	}
+	return fmt.Errorf("unknown sender backend %q", s.Backend)
+}
+
+//smtpSender sends through an SMTP relay, or directly to MX hosts
+type smtpSender struct {
+	config *SenderConfig
+	auth   smtp.Auth
+}
+
+func (s *smtpSender) Send(ctx context.Context, msg *Message) (string, error) {
+	config, auth := s.config, s.auth
+	if msg.Identity != nil && config.hasIdentities() {
+		config = config.withIdentity(msg.Identity)
+		auth = config.auth()
+	}
+	from := msg.From
+	if from == "" {
+		from = config.envelopeAddress()
+	}
+	return config.send(ctx, auth, from, msg.To, msg.Data)
+}
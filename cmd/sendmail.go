@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSendmailPath    = "/usr/sbin/sendmail"
+	defaultSendmailTimeout = time.Minute
+	//sendmailTransport is reported as the TLS status of local deliveries,
+	//the MTA decides how the message leaves the host
+	sendmailTransport = "local"
+	//exTempFail is the sysexits.h code sendmail uses for temporary failures
+	exTempFail = 75
+)
+
+//SendmailConfig configures handing messages to a sendmail compatible
+//binary. Recipients are passed as arguments unless UseHeaders is set,
+//in which case the binary reads them from the headers (-t) and BCCs are
+//lost.
+type SendmailConfig struct {
+	Path       string        `yaml:"Path"`
+	Args       []string      `yaml:"Args"`
+	UseHeaders bool          `yaml:"UseHeaders"`
+	Timeout    time.Duration `yaml:"Timeout"`
+}
+
+//sendmailError is a failed run of the sendmail binary
+type sendmailError struct {
+	err    error
+	code   int
+	stderr string
+}
+
+func (e *sendmailError) Error() string {
+	if e.stderr == "" {
+		return "sendmail: " + e.err.Error()
+	}
+	return fmt.Sprintf("sendmail: %v: %s", e.err, e.stderr)
+}
+
+func (e *sendmailError) Unwrap() error {
+	return e.err
+}
+
+func (e *sendmailError) temporary() bool {
+	return e.code == exTempFail
+}
+
+type sendmailSender struct {
+	config SendmailConfig
+	from   string
+}
+
+func (s *sendmailSender) Send(ctx context.Context, msg *Message) (string, error) {
+	path := s.config.Path
+	if path == "" {
+		path = defaultSendmailPath
+	}
+	timeout := s.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultSendmailTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	from := msg.From
+	if from == "" {
+		from = s.from
+	}
+	//-i keeps a lone dot from ending the message early
+	args := append([]string{"-i", "-f", from}, s.config.Args...)
+	if s.config.UseHeaders {
+		args = append(args, "-t")
+	} else {
+		args = append(append(args, "--"), msg.To...)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(msg.Data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		sendErr := &sendmailError{err: err, stderr: strings.TrimSpace(stderr.String())}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			sendErr.code = exitErr.ExitCode()
+		}
+		return "", sendErr
+	}
+	return sendmailTransport, nil
+}
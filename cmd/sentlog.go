@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//SentLogEntry records a single message handed to the relay. Bodies are
+//left out on purpose.
+type SentLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	MessageID string    `json:"messageId,omitempty"`
+	Status    string    `json:"status"`
+	TLS       string    `json:"tls,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+//sentLog is a fixed size ring buffer of the most recent sends
+type sentLog struct {
+	mu      sync.Mutex
+	entries []SentLogEntry
+	next    int
+	full    bool
+}
+
+func newSentLog(size int) *sentLog {
+	if size <= 0 {
+		return nil
+	}
+	return &sentLog{entries: make([]SentLogEntry, size)}
+}
+
+//record adds an entry, evicting the oldest one if the log is full. It's a
+//no-op on a nil log.
+func (l *sentLog) record(requestID, recipient, subject, messageID, tlsStatus string, err error) {
+	if l == nil {
+		return
+	}
+	e := SentLogEntry{
+		Time:      time.Now(),
+		RequestID: requestID,
+		Recipient: recipient,
+		Subject:   subject,
+		MessageID: messageID,
+		Status:    "sent",
+		TLS:       tlsStatus,
+	}
+	if err != nil {
+		e.Status = "failed"
+		e.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+//list returns the entries oldest first
+func (l *sentLog) list() []SentLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]SentLogEntry(nil), l.entries[:l.next]...)
+	}
+	return append(append([]SentLogEntry(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *sentLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.list())
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//shutdownTimeout bounds how long SIGTERM or SIGINT wait for requests in
+//flight
+const shutdownTimeout = 30 * time.Second
+
+//serve runs srv on ln. It returns nil once SIGTERM or SIGINT shut it
+//down gracefully.
+func serve(srv *http.Server, ln net.Listener) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-stop:
+		infoLogger.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+//serviceName is the name the service is registered under
+const serviceName = "docs-email-sender"
+
+//serviceStopTimeout bounds how long a stop request waits for requests in
+//flight
+const serviceStopTimeout = 30 * time.Second
+
+//windowsService runs the server under the service control manager
+type windowsService struct {
+	srv *http.Server
+	ln  net.Listener
+}
+
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() { done <- ws.srv.Serve(ws.ln) }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			errorLogger.Printf("Server stopped: %v", err)
+			return false, 1
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+				if err := ws.srv.Shutdown(ctx); err != nil {
+					errorLogger.Printf("Stopping server: %v", err)
+				}
+				cancel()
+				return false, 0
+			}
+		}
+	}
+}
+
+//serve runs srv on ln, under the service control manager when started as
+//a Windows service. It returns nil once the service is stopped.
+func serve(srv *http.Server, ln net.Listener) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return srv.Serve(ln)
+	}
+	return svc.Run(serviceName, &windowsService{srv: srv, ln: ln})
+}
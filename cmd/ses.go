@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	sesService        = "ses"
+	sesSendEmailPath  = "/v2/email/outbound-emails"
+	defaultSESTimeout = 30 * time.Second
+	//sesTransport is reported as the TLS status of API deliveries
+	sesTransport = "https"
+)
+
+//SESConfig configures sending through the Amazon SES v2 API. Endpoint
+//overrides the regional endpoint, e.g. for a VPC endpoint.
+type SESConfig struct {
+	Region          string        `yaml:"Region"`
+	AccessKeyID     string        `yaml:"AccessKeyID"`
+	SecretAccessKey string        `yaml:"SecretAccessKey"`
+	Endpoint        string        `yaml:"Endpoint"`
+	Timeout         time.Duration `yaml:"Timeout"`
+}
+
+func (c *SESConfig) validate() error {
+	if c.Region == "" || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("SES needs Region, AccessKeyID and SecretAccessKey")
+	}
+	if c.Endpoint != "" {
+		if _, err := url.Parse(c.Endpoint); err != nil {
+			return fmt.Errorf("SES endpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *SESConfig) host() string {
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err == nil {
+			return u.Host
+		}
+	}
+	return fmt.Sprintf("email.%s.amazonaws.com", c.Region)
+}
+
+func (c *SESConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return "https://" + c.host()
+}
+
+//apiError is a failed HTTP API call
+type apiError struct {
+	Status int
+	Body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API returned %d: %s", e.Status, e.Body)
+}
+
+//temporary reports whether the call may succeed if repeated
+func (e *apiError) temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+//sesSender sends the raw message with the SES v2 SendEmail call
+type sesSender struct {
+	config *SESConfig
+	from   string
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses []string `json:"ToAddresses"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			//Data is base64 encoded by encoding/json
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+}
+
+//Send ignores msg.From, SES picks the envelope sender itself
+func (s *sesSender) Send(ctx context.Context, msg *Message) (string, error) {
+	var body sesSendEmailRequest
+	body.FromEmailAddress = s.from
+	body.Destination.ToAddresses = msg.To
+	body.Content.Raw.Data = msg.Data
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.endpoint()+sesSendEmailPath, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.config.sign(req, payload, time.Now().UTC())
+
+	timeout := s.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultSESTimeout
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &apiError{Status: resp.StatusCode, Body: string(bytes.TrimSpace(respBody))}
+	}
+	return sesTransport, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//sign adds an AWS Signature Version 4 Authorization header to req, which
+//carries payload and has no query string
+func (c *SESConfig) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	host := req.URL.Host
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	const signedHeaders = "content-type;host;x-amz-date"
+	canonicalRequest := req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		"\n" +
+		"content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + host + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		signedHeaders + "\n" +
+		sha256Hex(payload)
+	scope := date + "/" + c.Region + "/" + sesService + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, sesService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+//quitTimeout bounds how long a server may take to answer QUIT
+const quitTimeout = 10 * time.Second
+
+func init() {
+	metrics.describe("smtp_connections_reused_total", counterMetric, "SMTP transactions run on a connection opened for an earlier message")
+}
+
+//smtpSession is an open connection to an SMTP server, past STARTTLS and
+//AUTH, that mail transactions can be run on
+type smtpSession struct {
+	conn   net.Conn
+	client *smtp.Client
+	//status is the negotiated TLS status
+	status string
+	server string
+	closed bool
+	//broken is set once the connection is in an unknown state, e.g. after
+	//an I/O error halfway through DATA, and must not be used again
+	broken bool
+	//pipelining is set if transactions are pipelined, see
+	//SenderConfig.DisablePipelining
+	pipelining bool
+}
+
+//openSession dials addr and negotiates STARTTLS and AUTH. Transactions
+//are pipelined if pipelining is set and the server offers it.
+func openSession(ctx context.Context, addr string, tlsConfig *tls.Config, auth smtp.Auth, policy string, pipelining bool) (*smtpSession, error) {
+	serverName := tlsConfig.ServerName
+	metrics.inc("smtp_connection_attempts_total", "server", serverName)
+	started := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &connectError{err}
+	}
+	s := &smtpSession{conn: conn, server: serverName}
+	stop := s.watch(ctx)
+	defer stop()
+	host, _, _ := net.SplitHostPort(addr)
+	if s.client, err = smtp.NewClient(conn, host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	metrics.add("smtp_open_connections", 1, "server", serverName)
+	recordPhase(ctx, phaseConnect, started)
+	started = time.Now()
+	defer recordPhase(ctx, phaseAuth, started)
+	if s.status, err = negotiate(s.client, addr, tlsConfig, auth, policy); err != nil {
+		//a refused AUTH leaves the session usable enough to say goodbye
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			s.quit()
+		} else {
+			s.close()
+		}
+		return nil, err
+	}
+	//the extensions offered after STARTTLS are the ones that count
+	if ok, _ := s.client.Extension("PIPELINING"); ok && pipelining {
+		s.pipelining = true
+	}
+	return s, nil
+}
+
+//watch bounds the session's I/O by ctx until the returned function is
+//called: the connection is closed as soon as ctx is done, so a server
+//stalling at any point can't hold on to us
+func (s *smtpSession) watch(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		s.conn.SetDeadline(time.Time{})
+	}
+}
+
+//transact runs one mail transaction. Recipients the server refuses don't
+//spoil it for the others, see rejectedRecipientsError. The message only
+//counts as sent once the server accepted the end of DATA.
+func (s *smtpSession) transact(ctx context.Context, from string, to []string, msg []byte) (err error) {
+	defer recordPhase(ctx, phaseData, time.Now())
+	stop := s.watch(ctx)
+	defer stop()
+	defer func() {
+		//a reply leaves the session in a known state, anything else such
+		//as a failed write may have left the server mid-command
+		var tpErr *textproto.Error
+		var rejErr *rejectedRecipientsError
+		if err != nil && !errors.As(err, &tpErr) && !errors.As(err, &rejErr) {
+			s.broken = true
+		}
+	}()
+	start := s.start
+	if s.pipelining {
+		start = s.startPipelined
+	}
+	//w dot-stuffs lines starting with a dot, so none ends DATA early
+	w, rejected, err := start(from, to)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		//without the terminating dot the server discards what it got
+		return fmt.Errorf("writing message data: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("ending message data: %w", err)
+	}
+	if len(rejected) > 0 {
+		return &rejectedRecipientsError{rejected}
+	}
+	return nil
+}
+
+//start runs MAIL, RCPT and DATA one after the other, returning the
+//writer for the message and the refused recipients
+func (s *smtpSession) start(from string, to []string) (io.WriteCloser, map[string]error, error) {
+	c := s.client
+	if err := c.Mail(from); err != nil {
+		return nil, nil, err
+	}
+	rejected := make(map[string]error)
+	var err error
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			//a refused recipient doesn't spoil the transaction for the
+			//others, anything else does
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				return nil, nil, err
+			}
+			rejected[rcpt] = err
+		}
+	}
+	if len(rejected) == len(to) {
+		return nil, nil, err
+	}
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &dataWriter{c.Text.DotWriter(), c.Text}, rejected, nil
+}
+
+//dataWriter is the body of a transaction: the message is accepted once
+//the reply to the terminating dot is. Unlike the writer of net/smtp it
+//doesn't wait for a reply if ending the data failed, the server is still
+//waiting for more of it.
+type dataWriter struct {
+	io.WriteCloser
+	text *textproto.Conn
+}
+
+func (d *dataWriter) Close() error {
+	if err := d.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_, _, err := d.text.ReadResponse(250)
+	return err
+}
+
+//reset readies a session for the next transaction, failing if the server
+//dropped the connection meanwhile
+func (s *smtpSession) reset(ctx context.Context) error {
+	stop := s.watch(ctx)
+	defer stop()
+	return s.client.Reset()
+}
+
+//quit ends the session politely, closing the connection either way
+func (s *smtpSession) quit() error {
+	if s.closed {
+		return nil
+	}
+	s.conn.SetDeadline(time.Now().Add(quitTimeout))
+	err := s.client.Quit()
+	s.close()
+	return err
+}
+
+func (s *smtpSession) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.client.Close()
+	metrics.add("smtp_open_connections", -1, "server", s.server)
+}
+
+type sessionPoolKey struct{}
+
+//sessionPool keeps the connections opened while handling one request, so
+//all of its messages to the same server go through a single connection
+type sessionPool struct {
+	mu       sync.Mutex
+	sessions map[string]*smtpSession
+}
+
+//withSessionPool returns a context whose SMTP connections are kept open
+//until the pool is closed
+func withSessionPool(ctx context.Context) (context.Context, *sessionPool) {
+	p := &sessionPool{sessions: make(map[string]*smtpSession)}
+	return context.WithValue(ctx, sessionPoolKey{}, p), p
+}
+
+//sessionPoolFrom returns the pool of ctx, or nil if connections are not
+//to be kept open
+func sessionPoolFrom(ctx context.Context) *sessionPool {
+	p, _ := ctx.Value(sessionPoolKey{}).(*sessionPool)
+	return p
+}
+
+//take removes the session for key from the pool and returns it, if any
+func (p *sessionPool) take(key string) *smtpSession {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.sessions[key]
+	delete(p.sessions, key)
+	return s
+}
+
+//release hands s back to the pool after a transaction that ended with
+//err, or ends the session if there is no pool or s is broken. It returns
+//err: once the transaction is over a failed QUIT doesn't change whether
+//the message was sent.
+func (p *sessionPool) release(key string, s *smtpSession, err error) error {
+	if s.broken {
+		s.close()
+		return err
+	}
+	if p == nil {
+		s.quit()
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old := p.sessions[key]; old != nil {
+		//another connection was opened meanwhile, keep just one
+		old.quit()
+	}
+	p.sessions[key] = s
+	return err
+}
+
+//close ends all sessions in the pool
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.sessions {
+		s.quit()
+		delete(p.sessions, key)
+	}
+}
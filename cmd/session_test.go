@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+func TestSessionPoolReuse(t *testing.T) {
+	s := startFakeSMTP(t, false, 0)
+	ctx, pool := withSessionPool(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := deliverTo(ctx, s, false, "docs@example.com", "a@example.com"); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if conns, quits, _ := s.stats(); conns != 1 || quits != 0 {
+		t.Errorf("got %d connections and %d QUITs before closing the pool, want 1 and 0", conns, quits)
+	}
+	pool.close()
+	if _, quits, _ := s.stats(); quits != 1 {
+		t.Errorf("got %d QUITs after closing the pool, want 1", quits)
+	}
+	if len(pool.sessions) != 0 {
+		t.Errorf("%d sessions left in the closed pool", len(pool.sessions))
+	}
+}
+
+func TestSessionWithoutPool(t *testing.T) {
+	s := startFakeSMTP(t, false, 0)
+	for i := 0; i < 2; i++ {
+		if err := deliverTo(context.Background(), s, false, "docs@example.com", "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns, quits, _ := s.stats(); conns != 2 || quits != 2 {
+		t.Errorf("got %d connections and %d QUITs, want a session per message", conns, quits)
+	}
+}
+
+func TestSessionPoolDiscardsBroken(t *testing.T) {
+	s := startFakeSMTP(t, false, 0)
+	ctx, pool := withSessionPool(context.Background())
+	defer pool.close()
+	if err := deliverTo(ctx, s, false, "docs@example.com", "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	//the server drops the connection halfway through the transaction
+	if err := deliverTo(ctx, s, false, "docs@example.com", "hangup@example.com"); err == nil {
+		t.Fatal("the dropped connection went unnoticed")
+	}
+	if len(pool.sessions) != 0 {
+		t.Fatalf("the broken session went back to the pool")
+	}
+	if err := deliverTo(ctx, s, false, "docs@example.com", "a@example.com"); err != nil {
+		t.Fatalf("sending after the broken session: %v", err)
+	}
+	if conns, _, _ := s.stats(); conns != 2 {
+		t.Errorf("got %d connections, want a new one after the broken session", conns)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 2 {
+		t.Errorf("server got %d messages, want 2", len(s.messages))
+	}
+}
+
+var errInjected = errors.New("injected write error")
+
+//failingConn fails the writes of data containing failOn
+type failingConn struct {
+	net.Conn
+	failOn []byte
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if bytes.Contains(p, c.failOn) {
+		return 0, errInjected
+	}
+	return c.Conn.Write(p)
+}
+
+//TestTransactDataWriteError fails the write of the message data, after
+//the server accepted DATA
+func TestTransactDataWriteError(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		s := startFakeSMTP(t, true, 0)
+		conn, err := net.Dial("tcp", s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fc := &failingConn{Conn: conn, failOn: []byte("Subject:")}
+		client, err := smtp.NewClient(fc, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := &smtpSession{conn: fc, client: client, server: "fake", pipelining: pipelining}
+		ctx, pool := withSessionPool(context.Background())
+
+		err = pool.release("fake", session, session.transact(ctx, "docs@example.com", []string{"a@example.com"}, testMessage))
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("pipelining %v: got %v, want the write error", pipelining, err)
+		}
+		if classifyError(err) == CategoryRejected {
+			t.Errorf("pipelining %v: a write error is classified as a rejection", pipelining)
+		}
+		if !session.broken || !session.closed {
+			t.Errorf("pipelining %v: the session left mid-DATA wasn't closed", pipelining)
+		}
+		if len(pool.sessions) != 0 {
+			t.Errorf("pipelining %v: the session left mid-DATA went back to the pool", pipelining)
+		}
+		pool.close()
+		s.mu.Lock()
+		if len(s.messages) != 0 {
+			t.Errorf("pipelining %v: the server took %d messages", pipelining, len(s.messages))
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSessionPoolPerServer(t *testing.T) {
+	relay, archive := startFakeSMTP(t, false, 0), startFakeSMTP(t, false, 0)
+	ctx, pool := withSessionPool(context.Background())
+	defer pool.close()
+	//the notification and acknowledgement go through the relay, the copy
+	//to the archive server
+	for _, s := range []*fakeSMTP{relay, relay, archive} {
+		if err := deliverTo(ctx, s, false, "docs@example.com", "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns, _, _ := relay.stats(); conns != 1 {
+		t.Errorf("got %d connections to the relay, want 1", conns)
+	}
+	if conns, _, _ := archive.stats(); conns != 1 {
+		t.Errorf("got %d connections to the archive server, want 1", conns)
+	}
+	if len(pool.sessions) != 2 {
+		t.Errorf("the pool holds %d sessions, want one per server", len(pool.sessions))
+	}
+}
+
+//BenchmarkRequestMessages sends the messages of a request, the
+//notification, acknowledgement and archive copy, through one relay 1ms
+//away, with a session each or sharing one. A shared session trades the
+//greeting and EHLO of each message for a RSET; without TLS, as here, that
+//is the whole gain, a STARTTLS handshake per message would widen it.
+func BenchmarkRequestMessages(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		shared bool
+	}{{"separate", false}, {"shared", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := startFakeSMTP(b, false, time.Millisecond)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ctx, pool := context.Background(), (*sessionPool)(nil)
+				if bench.shared {
+					ctx, pool = withSessionPool(ctx)
+				}
+				for _, to := range []string{"sales@example.com", "ada@example.com", "archive@example.com"} {
+					if err := deliverTo(ctx, s, false, "docs@example.com", to); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if pool != nil {
+					pool.close()
+				}
+			}
+			b.StopTimer()
+			conns, _, roundTrips := s.stats()
+			b.ReportMetric(float64(conns)/float64(b.N), "conns/op")
+			b.ReportMetric(float64(roundTrips)/float64(b.N), "roundtrips/op")
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/textproto"
+
+	"go.mozilla.org/pkcs7"
+)
+
+//SMIMEConfig enables S/MIME signing of every message with the given PEM
+//encoded certificate and private key
+type SMIMEConfig struct {
+	CertificateFile string `yaml:"CertificateFile"`
+	KeyFile         string `yaml:"KeyFile"`
+}
+
+type smimeSigner struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.PrivateKey
+}
+
+//load reads the signing certificate, any intermediates following it in
+//CertificateFile, and the key
+func (c *SMIMEConfig) load() (*smimeSigner, error) {
+	pair, err := tls.LoadX509KeyPair(c.CertificateFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &smimeSigner{key: pair.PrivateKey}
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			s.cert = cert
+		} else {
+			s.chain = append(s.chain, cert)
+		}
+	}
+	return s, nil
+}
+
+//sign wraps content in a multipart/signed part carrying a detached
+//PKCS #7 signature over its exact rendering
+func (s *smimeSigner) sign(content *mimePart) (*mimePart, error) {
+	raw, err := content.render()
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := pkcs7.NewSignedData(raw)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err = sd.AddSignerChain(s.cert, s.key, s.chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("S/MIME signing: %w", err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("S/MIME signing: %w", err)
+	}
+
+	signed := newMultipart("signed", &mimePart{raw: raw}, &mimePart{
+		contentType: `application/pkcs7-signature; name="smime.p7s"`,
+		header: textproto.MIMEHeader{
+			"Content-Disposition": {`attachment; filename="smime.p7s"`},
+		},
+		body: signature,
+	})
+	signed.contentType += `; protocol="application/pkcs7-signature"; micalg=sha-256`
+	return signed, nil
+}
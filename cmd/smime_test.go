@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func newTestSigner(t *testing.T) *smimeSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "docs@example.com"},
+		EmailAddresses: []string{"docs@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &smimeSigner{cert: cert, key: key}
+}
+
+//signedContent splits a multipart/signed message into the exact bytes
+//the signature covers, as RFC 1847 delimits them, and the signature
+func signedContent(t *testing.T, msg []byte) ([]byte, []byte) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" {
+		t.Fatalf("got Content-Type %q, want multipart/signed with a PKCS #7 signature", m.Header.Get("Content-Type"))
+	}
+	delimiter := []byte("--" + params["boundary"] + "\r\n")
+	body := msg[bytes.Index(msg, []byte("\r\n\r\n"))+4:]
+	if !bytes.HasPrefix(body, delimiter) {
+		t.Fatalf("the body doesn't start with the boundary: %q", body)
+	}
+	body = body[len(delimiter):]
+	end := bytes.Index(body, append([]byte("\r\n"), delimiter...))
+	if end < 0 {
+		t.Fatal("no second part")
+	}
+	content := body[:end]
+
+	_, parts, bodies := readMultipart(t, msg)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	if ct := parts[1].Header.Get("Content-Type"); ct != `application/pkcs7-signature; name="smime.p7s"` {
+		t.Errorf("the signature part is %s", ct)
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.Replace(bodies[1], []byte("\r\n"), nil, -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, signature
+}
+
+func TestSMIMESignature(t *testing.T) {
+	signer := newTestSigner(t)
+	m := &MailConfig{signer: signer}
+	msg, err := m.buildMessage(benchHeader(), "sales@example.com", []byte("hello\n"), []byte("<p>hello</p>"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, signature := signedContent(t, msg)
+
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7.Content = content
+	if err = p7.Verify(); err != nil {
+		t.Fatalf("the signature doesn't verify: %v", err)
+	}
+	if signerCert := p7.GetOnlySigner(); signerCert == nil || !signerCert.Equal(signer.cert) {
+		t.Error("the message isn't signed with the configured certificate")
+	}
+	if !bytes.Contains(content, []byte("multipart/alternative")) {
+		t.Errorf("the signature doesn't cover the message content: %q", content)
+	}
+
+	//a single changed byte must break the signature
+	tampered := append([]byte(nil), content...)
+	tampered[len(tampered)-3] ^= 1
+	p7.Content = tampered
+	if err = p7.Verify(); err == nil {
+		t.Error("a tampered message verifies")
+	}
+}
+
+//TestSMIMEOpenSSL checks the signature with openssl, as mail clients
+//would, if it's installed
+func TestSMIMEOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl isn't installed")
+	}
+	m := &MailConfig{signer: newTestSigner(t)}
+	msg, err := m.buildMessage(benchHeader(), "sales@example.com", []byte("hello\n"), nil, []Attachment{{Filename: "a.txt", ContentType: "text/plain", Data: []byte("data")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eml := filepath.Join(t.TempDir(), "signed.eml")
+	if err = ioutil.WriteFile(eml, msg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	//-noverify skips the chain, the certificate is self-signed
+	if out, err := exec.Command(openssl, "smime", "-verify", "-noverify", "-in", eml, "-out", os.DevNull).CombinedOutput(); err != nil {
+		t.Fatalf("openssl smime -verify: %v\n%s", err, out)
+	}
+}
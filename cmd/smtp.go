@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+)
+
+//TLS policies, see SenderConfig.TLSPolicy
+const (
+	TLSRequired      = "required"
+	TLSOpportunistic = "opportunistic"
+	TLSNone          = "none"
+)
+
+//directDeliveryPort is the port MX hosts accept mail on
+const directDeliveryPort = 25
+
+//tlsNone is the TLS status of a plaintext delivery
+const tlsNone = "none"
+
+//directSessions caches the TLS sessions of DirectDelivery, which presents
+//no client certificate
+var directSessions = tls.NewLRUClientSessionCache(0)
+
+func init() {
+	metrics.describe("smtp_tls_handshakes_total", counterMetric, "STARTTLS handshakes per server, full or resumed")
+}
+
+//errSTARTTLSUnavailable is returned under TLSRequired if the server
+//doesn't offer STARTTLS
+var errSTARTTLSUnavailable = errors.New("server does not support STARTTLS")
+
+//errAUTHUnavailable is returned if credentials are configured but the
+//server doesn't offer AUTH, e.g. as STARTTLS was stripped on the way
+var errAUTHUnavailable = errors.New("server does not support AUTH")
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("TLS(0x%04x)", version)
+}
+
+//tlsPolicy returns the configured policy, defaulting to TLSOpportunistic
+func (s *SenderConfig) tlsPolicy() string {
+	if s.TLSPolicy == "" {
+		return TLSOpportunistic
+	}
+	return s.TLSPolicy
+}
+
+//validate checks the enumerated settings of a sender
+func (s *SenderConfig) validate() error {
+	if err := s.validateBackend(); err != nil {
+		return err
+	}
+	if err := validateTLSPolicy(s.TLSPolicy); err != nil {
+		return err
+	}
+	if err := validateAuthMechanism(s.AuthMechanism); err != nil {
+		return err
+	}
+	if err := validateDomain(s.Address); err != nil {
+		return err
+	}
+	return s.validateIdentities()
+}
+
+//loadClientCertificate loads the certificate the sender presents to the
+//server during the TLS handshake, if one is configured. It also sets up
+//the session cache, shared by all connections to the server.
+func (s *SenderConfig) loadClientCertificate() error {
+	s.sessionCache = tls.NewLRUClientSessionCache(0)
+	if s.ClientCertificateFile == "" && s.ClientKeyFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.ClientCertificateFile, s.ClientKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading client certificate for %s: %w", s.Host, err)
+	}
+	s.clientCert = &cert
+	return nil
+}
+
+//identity tells apart the credentials connections to the server are
+//authenticated with
+func (s *SenderConfig) identity() string {
+	return s.Address + "|" + s.AuthMechanism + "|" + s.ClientCertificateFile
+}
+
+//tlsConfig returns the TLS settings for connections to the server
+func (s *SenderConfig) tlsConfig() *tls.Config {
+	config := &tls.Config{ServerName: s.Host, ClientSessionCache: s.sessionCache}
+	if s.clientCert != nil {
+		config.Certificates = []tls.Certificate{*s.clientCert}
+	}
+	return config
+}
+
+func validateTLSPolicy(policy string) error {
+	switch policy {
+	case "", TLSRequired, TLSOpportunistic, TLSNone:
+		return nil
+	}
+	return fmt.Errorf("unknown TLS policy %q", policy)
+}
+
+//send delivers msg to the relay, or straight to the recipients' MX hosts
+//with DirectDelivery. It returns the negotiated TLS status.
+func (s *SenderConfig) send(ctx context.Context, auth smtp.Auth, from string, to []string, msg []byte) (string, error) {
+	if s.DirectDelivery {
+		return s.sendDirect(ctx, from, to, msg)
+	}
+	return deliver(ctx, fmt.Sprintf("%s:%d", s.Host, s.Port), s.identity(), s.tlsConfig(), auth, s.tlsPolicy(), !s.DisablePipelining, from, to, msg)
+}
+
+//sendDirect delivers msg to the MX hosts of each recipient domain,
+//trying them in order of preference
+func (s *SenderConfig) sendDirect(ctx context.Context, from string, to []string, msg []byte) (string, error) {
+	return deliverByDomain(to, func(domain string, rcpts []string) (string, error) {
+		hosts, err := mxHosts(domain)
+		if err != nil {
+			return "", err
+		}
+		var status string
+		for _, host := range hosts {
+			addr := net.JoinHostPort(host, fmt.Sprint(directDeliveryPort))
+			status, err = s.deliverDirect(ctx, addr, &tls.Config{ServerName: host, ClientSessionCache: directSessions}, from, rcpts, msg)
+			if err == nil || !isTemporary(err) {
+				break
+			}
+		}
+		return status, err
+	})
+}
+
+//deliverByDomain sends to the recipients of each domain in turn, in the
+//order of the domains, with send. Once any domain took the message the
+//recipients of the failed ones are reported in a rejectedRecipientsError,
+//which isn't retried: retrying would send it to the others again. The TLS
+//status is "none" if any domain took the message in plaintext.
+func deliverByDomain(to []string, send func(domain string, rcpts []string) (string, error)) (string, error) {
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, addr := range to {
+		domain := addr[strings.LastIndex(addr, "@")+1:]
+		if byDomain[domain] == nil {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], addr)
+	}
+	sort.Strings(domains)
+
+	status := ""
+	accepted := false
+	rejected := make(map[string]error)
+	var failed []error
+	for _, domain := range domains {
+		rcpts := byDomain[domain]
+		domainStatus, err := send(domain, rcpts)
+		var rejErr *rejectedRecipientsError
+		switch {
+		case errors.As(err, &rejErr):
+			for rcpt, rcptErr := range rejErr.rejected {
+				rejected[rcpt] = rcptErr
+			}
+		case err != nil:
+			err = fmt.Errorf("delivering to %s: %w", domain, err)
+			for _, rcpt := range rcpts {
+				rejected[rcpt] = err
+			}
+			failed = append(failed, err)
+			continue
+		}
+		accepted = true
+		if status == "" || domainStatus == tlsNone {
+			status = domainStatus
+		}
+	}
+	if !accepted && len(failed) > 0 {
+		//nobody got the message, so it may as well be retried
+		for _, err := range failed {
+			if isTemporary(err) {
+				return "", err
+			}
+		}
+		return "", failed[0]
+	}
+	if len(rejected) > 0 {
+		return status, &rejectedRecipientsError{rejected}
+	}
+	return status, nil
+}
+
+//deliverDirect delivers to the MX host at addr. Under TLSOpportunistic a
+//failed handshake falls back to a plaintext connection, as MX hosts often
+//have certificates that don't verify and nothing is authenticated.
+func (s *SenderConfig) deliverDirect(ctx context.Context, addr string, tlsConfig *tls.Config, from string, to []string, msg []byte) (string, error) {
+	policy := s.tlsPolicy()
+	status, err := deliver(ctx, addr, "", tlsConfig, nil, policy, !s.DisablePipelining, from, to, msg)
+	var handshakeErr *tlsHandshakeError
+	if policy == TLSOpportunistic && errors.As(err, &handshakeErr) {
+		errorLogger.Printf("WARNING: STARTTLS with %s failed, downgrading to plaintext: %v", addr, err)
+		return deliver(ctx, addr, "", tlsConfig, nil, TLSNone, !s.DisablePipelining, from, to, msg)
+	}
+	return status, err
+}
+
+//mxHosts returns the mail exchangers of domain by preference, or the
+//domain itself if it has no MX records
+func mxHosts(domain string) ([]string, error) {
+	mxs, err := net.LookupMX(domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+//rejectedRecipientsError reports the recipients a server refused while
+//accepting the message for the others
+type rejectedRecipientsError struct {
+	rejected map[string]error
+}
+
+func (e *rejectedRecipientsError) Error() string {
+	rcpts := make([]string, 0, len(e.rejected))
+	for rcpt := range e.rejected {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	for i, rcpt := range rcpts {
+		rcpts[i] = fmt.Sprintf("%s: %v", rcpt, e.rejected[rcpt])
+	}
+	return fmt.Sprintf("%d recipients rejected: %s", len(rcpts), strings.Join(rcpts, "; "))
+}
+
+//temporary is false as retrying would send the message to the accepted
+//recipients again
+func (e *rejectedRecipientsError) temporary() bool {
+	return false
+}
+
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return "STARTTLS: " + e.err.Error()
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+//negotiate runs STARTTLS as policy dictates and authenticates with auth,
+//if it isn't nil. It returns the TLS status of the session.
+func negotiate(c *smtp.Client, addr string, tlsConfig *tls.Config, auth smtp.Auth, policy string) (string, error) {
+	status := tlsNone
+	if policy != TLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return "", &tlsHandshakeError{err}
+			}
+			state, _ := c.TLSConnectionState()
+			status = tlsVersionName(state.Version)
+			handshake := "full"
+			if state.DidResume {
+				handshake = "resumed"
+			}
+			metrics.inc("smtp_tls_handshakes_total", "server", tlsConfig.ServerName, "handshake", handshake)
+		} else if policy == TLSRequired {
+			return "", errSTARTTLSUnavailable
+		} else {
+			errorLogger.Printf("WARNING: %s does not support STARTTLS, sending in plaintext", addr)
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return "", errAUTHUnavailable
+		}
+		if err := c.Auth(auth); err != nil {
+			return "", err
+		}
+	}
+	return status, nil
+}
+
+//deliver runs one SMTP transaction against addr, negotiating STARTTLS as
+//policy dictates, on a connection kept open in the context's session pool
+//for the same server and identity if there is one. A failed handshake
+//fails the transaction, whatever the policy.
+func deliver(ctx context.Context, addr, identity string, tlsConfig *tls.Config, auth smtp.Auth, policy string, pipelining bool, from string, to []string, msg []byte) (status string, err error) {
+	serverName := tlsConfig.ServerName
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("SMTP transaction with %s aborted: %w (%v)", addr, ctx.Err(), err)
+		}
+		if err != nil {
+			metrics.inc("smtp_connection_failures_total", "server", serverName)
+		} else {
+			metrics.inc("smtp_connection_successes_total", "server", serverName)
+		}
+	}()
+
+	pool := sessionPoolFrom(ctx)
+	key := addr + "|" + policy + "|" + identity
+	s := pool.take(key)
+	if s != nil && s.reset(ctx) == nil {
+		metrics.inc("smtp_connections_reused_total", "server", serverName)
+	} else {
+		if s != nil {
+			//the server hung up on the idle connection
+			s.close()
+		}
+		if s, err = openSession(ctx, addr, tlsConfig, auth, policy, pipelining); err != nil {
+			return "", err
+		}
+	}
+	err = pool.release(key, s, s.transact(ctx, from, to, msg))
+	var rejErr *rejectedRecipientsError
+	if err != nil && !errors.As(err, &rejErr) {
+		return "", err
+	}
+	return s.status, err
+}
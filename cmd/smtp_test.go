@@ -0,0 +1,445 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/smtp"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeSMTP is an SMTP server for tests. It accepts any MAIL and RCPT but
+//for these:
+//
+//	MAIL FROM a "bad-sender" address   550 5.7.1
+//	RCPT TO a "nobody" address         550 5.1.1
+//	RCPT TO a "hangup" address         the connection is dropped
+//
+//It offers STARTTLS if tls is set, and accepts any AUTH.
+//Replies are flushed once the client sent all it had, after rtt, so each
+//round trip the client waits for costs rtt.
+type fakeSMTP struct {
+	addr       string
+	pipelining bool
+	rtt        time.Duration
+	tls        *tls.Config
+
+	mu sync.Mutex
+	//extensions are offered besides 8BITMIME and PIPELINING
+	extensions []string
+	//reads are the chunks read from clients, as they were written unless
+	//the network split them
+	reads []string
+	//messages are the message data received, as they were sent in DATA
+	messages []string
+	//plaintext counts the messages received without TLS, auths the
+	//successful AUTH commands
+	plaintext  int
+	auths      int
+	conns      int
+	quits      int
+	roundTrips int
+}
+
+func startFakeSMTP(t testing.TB, pipelining bool, rtt time.Duration) *fakeSMTP {
+	return (&fakeSMTP{pipelining: pipelining, rtt: rtt}).start(t)
+}
+
+//start serves s on a new port until the test ends
+func (s *fakeSMTP) start(t testing.TB) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+//recordingReader records the chunks read from the client
+type recordingReader struct {
+	net.Conn
+	s *fakeSMTP
+}
+
+func (r recordingReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.s.mu.Lock()
+		r.s.reads = append(r.s.reads, string(p[:n]))
+		r.s.mu.Unlock()
+	}
+	return n, err
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	r, w := bufio.NewReader(recordingReader{conn, s}), bufio.NewWriter(conn)
+	flush := func() {
+		if r.Buffered() > 0 {
+			return
+		}
+		time.Sleep(s.rtt)
+		s.mu.Lock()
+		s.roundTrips++
+		s.mu.Unlock()
+		w.Flush()
+	}
+	w.WriteString("220 fake ESMTP\r\n")
+	flush()
+	mail, rcpts, secure := false, 0, false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			w.WriteString("250-fake\r\n250-8BITMIME\r\n")
+			if s.pipelining {
+				w.WriteString("250-PIPELINING\r\n")
+			}
+			if s.tls != nil && !secure {
+				w.WriteString("250-STARTTLS\r\n")
+			}
+			s.mu.Lock()
+			for _, ext := range s.extensions {
+				w.WriteString("250-" + ext + "\r\n")
+			}
+			s.mu.Unlock()
+			w.WriteString("250 HELP\r\n")
+		case command == "STARTTLS" && s.tls != nil && !secure:
+			w.WriteString("220 ready\r\n")
+			w.Flush()
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			r, w, secure = bufio.NewReader(recordingReader{tlsConn, s}), bufio.NewWriter(tlsConn), true
+			mail, rcpts = false, 0
+			continue
+		case strings.HasPrefix(command, "AUTH"):
+			s.mu.Lock()
+			s.auths++
+			s.mu.Unlock()
+			w.WriteString("235 2.7.0 authenticated\r\n")
+		case strings.HasPrefix(command, "MAIL"):
+			if strings.Contains(line, "bad-sender") {
+				w.WriteString("550 5.7.1 sender refused\r\n")
+			} else {
+				mail, rcpts = true, 0
+				w.WriteString("250 ok\r\n")
+			}
+		case strings.HasPrefix(command, "RCPT"):
+			switch {
+			case strings.Contains(line, "hangup"):
+				return
+			case !mail:
+				w.WriteString("503 5.5.1 MAIL first\r\n")
+			case strings.Contains(line, "nobody"):
+				w.WriteString("550 5.1.1 no such user\r\n")
+			default:
+				rcpts++
+				w.WriteString("250 ok\r\n")
+			}
+		case command == "DATA":
+			if rcpts == 0 {
+				w.WriteString("554 5.5.1 no valid recipients\r\n")
+				break
+			}
+			w.WriteString("354 go ahead\r\n")
+			flush()
+			var data strings.Builder
+			for {
+				if line, err = r.ReadString('\n'); err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			if !secure {
+				s.plaintext++
+			}
+			s.mu.Unlock()
+			mail = false
+			w.WriteString("250 queued\r\n")
+		case command == "RSET":
+			mail, rcpts = false, 0
+			w.WriteString("250 ok\r\n")
+		case command == "QUIT":
+			s.mu.Lock()
+			s.quits++
+			s.mu.Unlock()
+			w.WriteString("221 bye\r\n")
+			w.Flush()
+			return
+		default:
+			w.WriteString("502 unknown command\r\n")
+		}
+		flush()
+	}
+}
+
+//stats returns the counters of s
+func (s *fakeSMTP) stats() (conns, quits, roundTrips int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, s.quits, s.roundTrips
+}
+
+//newTestTLS returns the server side TLS settings of a fakeSMTP, with a
+//certificate for "fake", and the pool clients verify it with
+func newTestTLS(t testing.TB) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake"},
+		DNSNames:     []string{"fake"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+//sent returns the number of messages s received, of those without TLS,
+//and of AUTH commands
+func (s *fakeSMTP) sent() (messages, plaintext, auths int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages), s.plaintext, s.auths
+}
+
+func TestTLSPolicies(t *testing.T) {
+	serverTLS, roots := newTestTLS(t)
+	tests := []struct {
+		policy           string
+		offered, trusted bool
+		status           string
+		//err is nil if the message is to be sent
+		err       func(error) bool
+		plaintext int
+	}{
+		{TLSRequired, true, true, "TLS1.3", nil, 0},
+		{TLSRequired, false, false, "", isSTARTTLSUnavailable, 0},
+		{TLSRequired, true, false, "", isHandshakeError, 0},
+		{TLSOpportunistic, true, true, "TLS1.3", nil, 0},
+		{TLSOpportunistic, false, false, tlsNone, nil, 1},
+		//a failed handshake is never downgraded on the way to a relay
+		{TLSOpportunistic, true, false, "", isHandshakeError, 0},
+		{TLSNone, true, true, tlsNone, nil, 1},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%s, offered %v, trusted %v", test.policy, test.offered, test.trusted)
+		s := &fakeSMTP{}
+		if test.offered {
+			s.tls = serverTLS
+		}
+		s.start(t)
+		clientTLS := &tls.Config{ServerName: "fake"}
+		if test.trusted {
+			clientTLS.RootCAs = roots
+		}
+		status, err := deliver(context.Background(), s.addr, "", clientTLS, nil, test.policy, false, "docs@example.com", []string{"a@example.com"}, testMessage)
+		messages, plaintext, _ := s.sent()
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: %v", name, err)
+		case test.err != nil && !test.err(err):
+			t.Errorf("%s: got error %v", name, err)
+		case status != test.status:
+			t.Errorf("%s: got TLS status %q, want %q", name, status, test.status)
+		case test.err == nil && messages != 1, test.err != nil && messages != 0:
+			t.Errorf("%s: the server got %d messages", name, messages)
+		case plaintext != test.plaintext:
+			t.Errorf("%s: %d messages were sent in plaintext, want %d", name, plaintext, test.plaintext)
+		}
+	}
+}
+
+func isSTARTTLSUnavailable(err error) bool {
+	return errors.Is(err, errSTARTTLSUnavailable)
+}
+
+func isHandshakeError(err error) bool {
+	var handshakeErr *tlsHandshakeError
+	return errors.As(err, &handshakeErr)
+}
+
+//fakeRelay returns the settings of a sender using s as its relay
+func fakeRelay(t *testing.T, s *fakeSMTP) *SenderConfig {
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+	sender := &SenderConfig{Host: host, Port: p, Address: "docs@example.com", Password: "secret", DisablePipelining: true}
+	if err := sender.loadClientCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+func TestRelayHandshakeFailure(t *testing.T) {
+	serverTLS, _ := newTestTLS(t)
+	s := (&fakeSMTP{tls: serverTLS, extensions: []string{"AUTH PLAIN"}}).start(t)
+	//the certificate doesn't verify, as when someone is in the middle
+	sender := fakeRelay(t, s)
+	_, err := sender.send(context.Background(), sender.auth(), "docs@example.com", []string{"a@example.com"}, testMessage)
+	if !isHandshakeError(err) {
+		t.Fatalf("got %v, want the handshake to fail the send", err)
+	}
+	if messages, _, auths := s.sent(); messages != 0 || auths != 0 {
+		t.Errorf("the relay got %d messages and %d AUTH commands after the failed handshake", messages, auths)
+	}
+	if conns, _, _ := s.stats(); conns != 1 {
+		t.Errorf("got %d connections, want no plaintext retry", conns)
+	}
+}
+
+func TestDirectDeliveryHandshakeFailure(t *testing.T) {
+	serverTLS, _ := newTestTLS(t)
+	for _, test := range []struct {
+		policy string
+		sent   bool
+	}{{TLSOpportunistic, true}, {TLSRequired, false}} {
+		s := (&fakeSMTP{tls: serverTLS}).start(t)
+		sender := &SenderConfig{DirectDelivery: true, TLSPolicy: test.policy}
+		status, err := sender.deliverDirect(context.Background(), s.addr, &tls.Config{ServerName: "fake"}, "docs@example.com", []string{"a@example.com"}, testMessage)
+		messages, plaintext, _ := s.sent()
+		if test.sent {
+			if err != nil || status != tlsNone || messages != 1 || plaintext != 1 {
+				t.Errorf("%s: got %q, %v and %d messages, want the message sent in plaintext", test.policy, status, err, messages)
+			}
+			continue
+		}
+		if !isHandshakeError(err) || messages != 0 {
+			t.Errorf("%s: got %v and %d messages, want the handshake to fail the send", test.policy, err, messages)
+		}
+	}
+}
+
+func TestAuthUnavailable(t *testing.T) {
+	for _, offered := range []bool{false, true} {
+		s := &fakeSMTP{}
+		if offered {
+			s.extensions = []string{"AUTH PLAIN"}
+		}
+		s.start(t)
+		auth := smtp.PlainAuth("", "docs@example.com", "secret", "127.0.0.1")
+		_, err := deliver(context.Background(), s.addr, "", &tls.Config{ServerName: "fake"}, auth, TLSNone, false, "docs@example.com", []string{"a@example.com"}, testMessage)
+		messages, _, auths := s.sent()
+		if offered {
+			if err != nil || messages != 1 || auths != 1 {
+				t.Errorf("AUTH offered: got %v, %d messages and %d AUTH commands", err, messages, auths)
+			}
+			continue
+		}
+		if !errors.Is(err, errAUTHUnavailable) || messages != 0 {
+			t.Errorf("AUTH not offered: got %v and %d messages, want the send refused", err, messages)
+		}
+		if isTemporary(err) {
+			t.Errorf("a server without AUTH is retried")
+		}
+	}
+}
+
+func TestVerifyAuthUnavailable(t *testing.T) {
+	s := startFakeSMTP(t, false, 0)
+	sender := fakeRelay(t, s)
+	sender.TLSPolicy = TLSNone
+	if err := sender.verify(); !errors.Is(err, errAUTHUnavailable) {
+		t.Errorf("got %v, want the credentials reported unchecked", err)
+	}
+	s = (&fakeSMTP{extensions: []string{"AUTH PLAIN"}}).start(t)
+	sender = fakeRelay(t, s)
+	sender.TLSPolicy = TLSNone
+	err := sender.verify()
+	if _, _, auths := s.sent(); err != nil || auths != 1 {
+		t.Errorf("got %v after %d AUTH commands, want the credentials checked", err, auths)
+	}
+}
+
+func TestDeliverByDomain(t *testing.T) {
+	errDown := errors.New("connection refused")
+	var order []string
+	send := func(domain string, rcpts []string) (string, error) {
+		order = append(order, domain)
+		switch domain {
+		case "down.example":
+			return "", errDown
+		case "picky.example":
+			return tlsNone, &rejectedRecipientsError{map[string]error{rcpts[0]: errors.New("550 5.1.1 no such user")}}
+		}
+		return "TLS1.3", nil
+	}
+
+	status, err := deliverByDomain([]string{"b@two.example", "a@down.example", "c@one.example", "d@two.example", "e@picky.example", "f@picky.example"}, send)
+	if want := []string{"down.example", "one.example", "picky.example", "two.example"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("domains were sent to in order %v, want %v", order, want)
+	}
+	var rejErr *rejectedRecipientsError
+	if !errors.As(err, &rejErr) || isTemporary(err) {
+		t.Fatalf("got %v, want a partial failure that isn't retried", err)
+	}
+	if len(rejErr.rejected) != 2 || !errors.Is(rejErr.rejected["a@down.example"], errDown) || rejErr.rejected["e@picky.example"] == nil {
+		t.Errorf("got rejected %v, want a@down.example and e@picky.example", rejErr.rejected)
+	}
+	if status != tlsNone {
+		t.Errorf("got TLS status %q, want none as picky.example got it in plaintext", status)
+	}
+
+	//as nobody got the message it can be retried
+	order = nil
+	_, err = deliverByDomain([]string{"a@down.example", "b@down.example"}, send)
+	if !errors.Is(err, errDown) || errors.As(err, &rejErr) || !isTemporary(err) {
+		t.Errorf("got %v, want the failure of down.example", err)
+	}
+	if len(order) != 1 {
+		t.Errorf("down.example was sent to %d times, want once", len(order))
+	}
+}
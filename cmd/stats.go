@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+//breakerStateNames name the circuit breaker states in /stats
+var breakerStateNames = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+//serverStats is the body of /stats
+type serverStats struct {
+	//QueueDepth counts the requests waiting per priority
+	QueueDepth map[string]int `json:"queueDepth"`
+	Workers    int            `json:"workers"`
+	//InFlightSends counts messages being handed to a relay right now
+	InFlightSends int `json:"inFlightSends"`
+	//Sent and Failed count requests since the server started
+	Sent     int64             `json:"sent"`
+	Failed   int64             `json:"failed"`
+	Breakers map[string]string `json:"breakers"`
+	Paused   bool              `json:"paused"`
+}
+
+//stateName returns the name of the breaker's state
+func (b *circuitBreaker) stateName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStateNames[b.state]
+}
+
+//statsHandler reports the state of the queue, workers and relays. Nothing
+//in it is expensive, so it can be polled often.
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	m := &s.config.EmailConfig
+	stats := serverStats{
+		QueueDepth:    make(map[string]int),
+		Workers:       s.config.Workers,
+		InFlightSends: int(atomic.LoadInt32(m.sendsInFlight)),
+		Sent:          atomic.LoadInt64(&requestsSent),
+		Failed:        atomic.LoadInt64(&requestsFailed),
+		Breakers:      make(map[string]string),
+		Paused:        s.queue.paused(),
+	}
+	for p, n := range s.queue.depth() {
+		stats.QueueDepth[p.String()] = n
+	}
+	for _, rl := range m.relays {
+		stats.Breakers[rl.name] = rl.breaker.stateName()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
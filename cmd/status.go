@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResultTTL  = 10 * time.Minute
+	defaultExpiredTTL = 24 * time.Hour
+	statusPath        = "/status/"
+	//respondAsync is the Prefer header value asking for an answer before
+	//the request is sent, see RFC 7240
+	respondAsync = "respond-async"
+)
+
+//Request states, see RequestStatus
+const (
+	StateQueued     = "queued"
+	StateSent       = "sent"
+	StateDeferred   = "deferred"
+	StateFailed     = "failed"
+	StateExpired    = "expired"
+	StateSuppressed = "suppressed"
+)
+
+//StatusConfig enables /status/{id}, which reports the outcome of the
+//request whose id was returned in the X-Request-ID header
+type StatusConfig struct {
+	//ResultTTL is how long the outcome of a finished request is kept, 10
+	//minutes by default
+	ResultTTL time.Duration `yaml:"ResultTTL"`
+	//ExpiredTTL is how long after that the id is answered with 410 Gone
+	//rather than 404, 24 hours by default
+	ExpiredTTL time.Duration `yaml:"ExpiredTTL"`
+	//Async answers every request with 202 Accepted as soon as it's valid,
+	//rather than only those with a "Prefer: respond-async" header. The
+	//Location header points to its status.
+	Async bool `yaml:"Async"`
+}
+
+//AcceptedResponse is the body of the 202 answering an async request
+type AcceptedResponse struct {
+	ID    string `json:"id"`
+	Links struct {
+		Self string `json:"self"`
+	} `json:"links"`
+}
+
+//RequestStatus is the body of /status/{id}. It leaves out recipient
+//addresses and error details, which are only for the logs.
+type RequestStatus struct {
+	ID       string        `json:"id"`
+	State    string        `json:"state"`
+	Category ErrorCategory `json:"category,omitempty"`
+	//Delivered and Deferred count the recipients by result
+	Delivered int  `json:"delivered"`
+	Deferred  int  `json:"deferred"`
+	Degraded  bool `json:"degraded,omitempty"`
+	//ElapsedMillis is how long sending took, see EmailSendOutcome.Elapsed
+	ElapsedMillis int64 `json:"elapsedMs,omitempty"`
+	//HardBounces and SoftBounces count the recipients refused by class
+	HardBounces int `json:"hardBounces,omitempty"`
+	SoftBounces int `json:"softBounces,omitempty"`
+}
+
+type trackedRequest struct {
+	status RequestStatus
+	//finished is when the outcome came in, zero while queued
+	finished time.Time
+}
+
+//statusTracker follows requests from submission until ResultTTL after
+//their outcome, and remembers their ids for ExpiredTTL after that
+type statusTracker struct {
+	resultTTL  time.Duration
+	expiredTTL time.Duration
+
+	mu       sync.Mutex
+	requests map[string]*trackedRequest
+	//expired maps the ids of evicted requests to when they were evicted
+	expired map[string]time.Time
+}
+
+func newStatusTracker(config StatusConfig) *statusTracker {
+	t := &statusTracker{
+		resultTTL:  config.ResultTTL,
+		expiredTTL: config.ExpiredTTL,
+		requests:   make(map[string]*trackedRequest),
+		expired:    make(map[string]time.Time),
+	}
+	if t.resultTTL <= 0 {
+		t.resultTTL = defaultResultTTL
+	}
+	if t.expiredTTL <= 0 {
+		t.expiredTTL = defaultExpiredTTL
+	}
+	return t
+}
+
+//start tracks a newly submitted request
+func (t *statusTracker) start(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests[id] = &trackedRequest{status: RequestStatus{ID: id, State: StateQueued}}
+}
+
+//finish records the outcome of request id. An error means the requester
+//gave up waiting for it.
+func (t *statusTracker) finish(id string, outcome EmailSendOutcome, err error) {
+	status := RequestStatus{
+		ID:        id,
+		State:     StateSent,
+		Delivered: len(outcome.Deliveries),
+		Deferred:  len(outcome.Deferred),
+		Degraded:  outcome.Degraded,
+	}
+	status.ElapsedMillis = int64(outcome.Elapsed / time.Millisecond)
+	for _, b := range outcome.Bounces {
+		if b.Class == BounceHard {
+			status.HardBounces++
+		} else {
+			status.SoftBounces++
+		}
+	}
+	if err == nil {
+		err = outcome.Error
+	}
+	switch {
+	case err != nil:
+		status.State = StateFailed
+		status.Category = newSendError(err).Category
+		if status.Category == CategoryExpired {
+			status.State = StateExpired
+		}
+	case outcome.Suppressed:
+		status.State = StateSuppressed
+	case len(outcome.Deferred) > 0:
+		status.State = StateDeferred
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests[id] = &trackedRequest{status: status, finished: time.Now()}
+}
+
+//lookup returns the status of request id, or whether it was evicted
+//already if it's unknown
+func (t *statusTracker) lookup(id string) (status *RequestStatus, gone bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.evict(time.Now())
+	if r, ok := t.requests[id]; ok {
+		s := r.status
+		return &s, false
+	}
+	_, gone = t.expired[id]
+	return nil, gone
+}
+
+//evict drops outcomes older than resultTTL and ids expired longer than
+//expiredTTL. t.mu must be held.
+func (t *statusTracker) evict(now time.Time) {
+	for id, r := range t.requests {
+		if !r.finished.IsZero() && now.Sub(r.finished) > t.resultTTL {
+			delete(t.requests, id)
+			t.expired[id] = now
+		}
+	}
+	for id, evicted := range t.expired {
+		if now.Sub(evicted) > t.expiredTTL {
+			delete(t.expired, id)
+		}
+	}
+}
+
+//run evicts old entries every minute, forever, so memory doesn't grow
+//with requests nobody asks about
+func (t *statusTracker) run() {
+	for now := range time.Tick(time.Minute) {
+		t.mu.Lock()
+		t.evict(now)
+		t.mu.Unlock()
+	}
+}
+
+//asyncRequested reports whether r is answered before it's sent, which
+//needs the status to be tracked for the outcome to be known
+func (s *server) asyncRequested(r *http.Request) bool {
+	if s.status == nil {
+		return false
+	}
+	if s.config.Status.Async {
+		return true
+	}
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			token := strings.SplitN(pref, ";", 2)[0]
+			if strings.EqualFold(strings.TrimSpace(token), respondAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//setStatusLocation points the Location header to the status of request
+//id, if it's tracked
+func (s *server) setStatusLocation(w http.ResponseWriter, id string) {
+	if s.status != nil {
+		w.Header().Set("Location", statusPath+id)
+	}
+}
+
+//writeAccepted answers an async request id with 202 Accepted, a Location
+//to poll and an AcceptedResponse
+func writeAccepted(w http.ResponseWriter, id string) {
+	var body AcceptedResponse
+	body.ID = id
+	body.Links.Self = statusPath + id
+	w.Header().Set("Location", body.Links.Self)
+	w.Header().Set("Preference-Applied", respondAsync)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(body)
+}
+
+//statusHandler serves the status of the request id in /status/{id}
+func (s *server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, statusPath)
+	status, gone := s.status.lookup(id)
+	switch {
+	case gone:
+		http.Error(w, "Gone, the outcome of this request has expired", http.StatusGone)
+		return
+	case status == nil:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
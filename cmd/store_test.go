@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//recordingStore hands what it's asked to record to records
+type recordingStore struct {
+	records chan storeRecord
+}
+
+func (s recordingStore) Record(req EmailSendRequest, outcome EmailSendOutcome) error {
+	s.records <- storeRecord{req, outcome}
+	return nil
+}
+
+//next returns the next record, failing the test if none comes
+func (s recordingStore) next(t *testing.T) storeRecord {
+	t.Helper()
+	select {
+	case r := <-s.records:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was recorded")
+	}
+	return storeRecord{}
+}
+
+func TestAsyncStoreAttachments(t *testing.T) {
+	store := recordingStore{make(chan storeRecord, 1)}
+	async := newAsyncStore(store, 1)
+	req := EmailSendRequest{ID: "a", Attachments: []Attachment{
+		{Filename: "logo.png", ContentType: "image/png", Data: testPNG},
+		{Filename: "datasheet.pdf", ContentType: "application/pdf", Data: testPDF},
+	}}
+	async.Record(req, EmailSendOutcome{})
+	r := store.next(t)
+	if len(r.req.Attachments) != 2 {
+		t.Fatalf("got %d attachments recorded, want 2", len(r.req.Attachments))
+	}
+	for i, a := range r.req.Attachments {
+		if a.Data != nil || a.Filename != req.Attachments[i].Filename || a.ContentType != req.Attachments[i].ContentType {
+			t.Errorf("attachment %d is recorded as %+v", i, a)
+		}
+	}
+	//the request being sent keeps its data
+	if !bytes.Equal(req.Attachments[0].Data, testPNG) {
+		t.Error("recording dropped the data of the attachments sent")
+	}
+}
+
+func TestSubmitRecordsAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ts := newTestServer(t, ServerConfig{}, func(EmailSendRequest) EmailSendOutcome {
+		<-release
+		return EmailSendOutcome{}
+	})
+	store := recordingStore{make(chan storeRecord, 1)}
+	ts.store = store
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ts.submit(ctx, EmailSendRequest{ID: "slow"}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the deadline to pass", err)
+	}
+	r := store.next(t)
+	if r.req.ID != "slow" || !errors.Is(r.outcome.Error, context.DeadlineExceeded) || !strings.Contains(r.outcome.Error.Error(), "abandoned") {
+		t.Errorf("request %s is recorded with %v, want it abandoned", r.req.ID, r.outcome.Error)
+	}
+}
+
+func TestRequestStoreDatabaseDown(t *testing.T) {
+	//nothing listens on port 1
+	dsn := "postgres://docs@127.0.0.1:1/docs?sslmode=disable&connect_timeout=1"
+	config := StorageConfig{DSN: dsn}
+	if _, err := config.newRequestStore(); err != nil {
+		t.Fatalf("the store failed to open with the database down: %v", err)
+	}
+	store, err := NewPostgresStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Record(EmailSendRequest{ID: "a"}, EmailSendOutcome{}); err == nil {
+		t.Fatal("recording with the database down succeeded")
+	}
+	if store.schemaReady {
+		t.Error("the table counts as created with the database down")
+	}
+}
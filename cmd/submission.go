@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//submission is how a request is serialized for MailConfig.AttachSubmission.
+//Field names follow the form fields, attachments are only listed.
+type submission struct {
+	ID            string                 `json:"id"`
+	Received      time.Time              `json:"received"`
+	Priority      string                 `json:"priority"`
+	IPAddress     string                 `json:"ipAddress"`
+	FirstName     string                 `json:"firstName"`
+	LastName      string                 `json:"lastName"`
+	ProductSerial string                 `json:"productSerial"`
+	ProductModel  string                 `json:"productModel"`
+	PhoneNumber   string                 `json:"phoneNumber"`
+	CompanyName   string                 `json:"company"`
+	EmailAddress  string                 `json:"email"`
+	Description   string                 `json:"description"`
+	InReplyTo     string                 `json:"inReplyTo,omitempty"`
+	References    []string               `json:"references,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+	Attachments   []submittedFile        `json:"attachments,omitempty"`
+}
+
+type submittedFile struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+//submissionAttachment returns the fields of req as a JSON attachment
+func submissionAttachment(req *EmailSendRequest) (Attachment, error) {
+	s := submission{
+		ID:            req.ID,
+		Received:      req.EnqueuedAt,
+		Priority:      req.Priority.String(),
+		IPAddress:     req.IPAddress,
+		FirstName:     req.FirstName,
+		LastName:      req.LastName,
+		ProductSerial: req.ProductSerial,
+		ProductModel:  req.ProductModel,
+		PhoneNumber:   req.PhoneNumber,
+		CompanyName:   req.CompanyName,
+		EmailAddress:  req.EmailAddress,
+		Description:   req.Description,
+		InReplyTo:     req.InReplyTo,
+		References:    req.References,
+		Data:          req.Data,
+	}
+	for _, a := range req.Attachments {
+		s.Attachments = append(s.Attachments, submittedFile{a.Filename, a.ContentType, len(a.Data)})
+	}
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return Attachment{}, err
+	}
+	return Attachment{
+		Filename:    "submission-" + req.ID + ".json",
+		ContentType: "application/json",
+		Data:        content,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+//SuppressionConfig keeps a list of addresses no email is sent to anymore,
+//e.g. because they hard bounced
+type SuppressionConfig struct {
+	//File holds one address per line and is appended to as addresses are
+	//suppressed
+	File string `yaml:"File"`
+	//HardBounces also suppresses recipients their server refuses with a
+	//hard bounce on send, see DomainPolicy.SuppressHardBounces
+	HardBounces bool `yaml:"HardBounces"`
+	//AllSuppressedStatus is the HTTP status answering a request that
+	//wasn't sent as all its recipients are suppressed, 200 by default.
+	//Statuses from 400 up are answered as rejections.
+	AllSuppressedStatus int `yaml:"AllSuppressedStatus"`
+}
+
+func init() {
+	metrics.describe("suppressed_addresses", gaugeMetric, "Addresses on the suppression list")
+	metrics.describe("suppressed_recipients_total", counterMetric, "Recipients skipped as suppressed")
+	metrics.describe("requests_suppressed_total", counterMetric, "Requests not sent as all their recipients are suppressed")
+}
+
+//suppressionList is the set of suppressed addresses, backed by its file
+type suppressionList struct {
+	mu        sync.Mutex
+	addresses map[string]bool
+	file      *os.File
+}
+
+func normalizeAddress(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+//openSuppressionList reads the suppressed addresses from the file,
+//creating it if needed
+func openSuppressionList(config SuppressionConfig) (*suppressionList, error) {
+	if status := config.AllSuppressedStatus; status != 0 && (status < 200 || status > 599 || http.StatusText(status) == "") {
+		return nil, fmt.Errorf("invalid AllSuppressedStatus %d", status)
+	}
+	f, err := os.OpenFile(config.File, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	l := &suppressionList{addresses: make(map[string]bool), file: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if addr := normalizeAddress(scanner.Text()); addr != "" && !strings.HasPrefix(addr, "#") {
+			l.addresses[addr] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", config.File, err)
+	}
+	metrics.set("suppressed_addresses", float64(len(l.addresses)))
+	return l, nil
+}
+
+func (l *suppressionList) contains(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addresses[normalizeAddress(addr)]
+}
+
+//add suppresses addr. It reports whether addr wasn't suppressed before.
+func (l *suppressionList) add(addr string) (bool, error) {
+	addr = normalizeAddress(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.addresses[addr] {
+		return false, nil
+	}
+	if _, err := fmt.Fprintln(l.file, addr); err != nil {
+		return false, err
+	}
+	l.addresses[addr] = true
+	metrics.set("suppressed_addresses", float64(len(l.addresses)))
+	return true, nil
+}
+
+//allSuppressedStatus returns the status answering a request whose
+//recipients are all suppressed
+func (c *SuppressionConfig) allSuppressedStatus() int {
+	if c.AllSuppressedStatus == 0 {
+		return http.StatusOK
+	}
+	return c.AllSuppressedStatus
+}
+
+//deliverable returns the recipients that aren't suppressed
+func (m *MailConfig) deliverable(recipients map[string]Recipient) map[string]Recipient {
+	if m.suppressions == nil {
+		return recipients
+	}
+	kept := make(map[string]Recipient, len(recipients))
+	for key, r := range recipients {
+		if m.suppressions.contains(r.Address) {
+			metrics.inc("suppressed_recipients_total")
+			continue
+		}
+		kept[key] = r
+	}
+	return kept
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultStallTimeout = 10 * time.Minute
+
+//SystemdConfig enables readiness and watchdog notifications for units
+//with Type=notify. Nothing is sent unless systemd set NOTIFY_SOCKET.
+type SystemdConfig struct {
+	//WatchdogInterval is how often the watchdog is pinged, half the unit's
+	//WatchdogSec by default
+	WatchdogInterval time.Duration `yaml:"WatchdogInterval"`
+	//StallTimeout is how long queued requests may wait without a worker
+	//picking any of them up before the pings stop, 10 minutes by default
+	StallTimeout time.Duration `yaml:"StallTimeout"`
+}
+
+//sdNotify sends state to the service manager, if there is one
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+//watchdogInterval returns how often to ping the watchdog, 0 if it is not
+//enabled
+func (c *SystemdConfig) watchdogInterval() time.Duration {
+	if c.WatchdogInterval > 0 {
+		return c.WatchdogInterval
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+//notifyReady tells systemd the server is listening and starts pinging
+//the watchdog
+func (s *server) notifyReady() {
+	c := s.config.Systemd
+	if err := sdNotify("READY=1"); err != nil {
+		errorLogger.Printf("Notifying systemd: %v", err)
+		return
+	}
+	if interval := c.watchdogInterval(); interval > 0 {
+		go s.watchdog(interval)
+	}
+}
+
+//watchdog pings systemd every interval for as long as the workers keep
+//taking requests off the queue, so a wedged emailer gets restarted
+func (s *server) watchdog(interval time.Duration) {
+	stall := s.config.Systemd.StallTimeout
+	if stall <= 0 {
+		stall = defaultStallTimeout
+	}
+	for range time.Tick(interval) {
+		if s.queue.stalled(stall) {
+			errorLogger.Printf("WARNING: no queued request picked up for %s, withholding watchdog ping", stall)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			errorLogger.Printf("Pinging systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//Tagging formats, see TaggingConfig.Format
+const (
+	TagFormatSendGrid = "sendgrid"
+	TagFormatSES      = "ses"
+	TagFormatList     = "list"
+	TagFormatRepeat   = "repeat"
+)
+
+//maxTags is how many values, the category included, a request may carry,
+//which is what SendGrid allows
+const maxTags = 10
+
+//tagValuePattern keeps tag values safe in any header and acceptable to
+//every provider
+var tagValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+//TaggingConfig forwards the category and tags of requests to the provider
+//in headers, so its dashboards can segment the mail. The category comes
+//first, followed by the tags.
+type TaggingConfig struct {
+	//Format is one of
+	//"sendgrid": {"category":[...]} in X-SMTPAPI
+	//"ses": "category=value, tag=true, ..." in X-SES-MESSAGE-TAGS
+	//"list": the values separated by commas in Header, e.g. X-PM-Tag
+	//"repeat": a Header per value, e.g. X-Mailgun-Tag
+	Format string `yaml:"Format"`
+	//Header overrides the header name of the format, "list" and "repeat"
+	//have none
+	Header string `yaml:"Header"`
+	//ConfigurationSet, if set, is sent in X-SES-CONFIGURATION-SET
+	ConfigurationSet string `yaml:"ConfigurationSet"`
+}
+
+//tagHeader is a header field carrying tags
+type tagHeader struct {
+	Name  string
+	Value string
+}
+
+func (c *TaggingConfig) validate() error {
+	switch c.Format {
+	case TagFormatSendGrid:
+		if c.Header == "" {
+			c.Header = "X-SMTPAPI"
+		}
+	case TagFormatSES:
+		if c.Header == "" {
+			c.Header = "X-SES-MESSAGE-TAGS"
+		}
+	case TagFormatList, TagFormatRepeat:
+		if c.Header == "" {
+			return fmt.Errorf("the %s tagging format needs a Header", c.Format)
+		}
+	default:
+		return fmt.Errorf("unknown tagging format %q", c.Format)
+	}
+	if !isHeaderName(c.Header) {
+		return fmt.Errorf("invalid tagging header %q", c.Header)
+	}
+	if c.ConfigurationSet != "" && !tagValuePattern.MatchString(c.ConfigurationSet) {
+		return fmt.Errorf("invalid configuration set %q", c.ConfigurationSet)
+	}
+	return nil
+}
+
+//isHeaderName reports whether name is a valid header field name
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+//parseTags validates the category and the comma separated tags of a
+//request
+func parseTags(category, tags string) (string, []string, error) {
+	category = strings.TrimSpace(category)
+	if category != "" && !tagValuePattern.MatchString(category) {
+		return "", nil, fmt.Errorf("invalid category %q", category)
+	}
+	var list []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		if !tagValuePattern.MatchString(tag) {
+			return "", nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		list = append(list, tag)
+	}
+	n := len(list)
+	if category != "" {
+		n++
+	}
+	if n > maxTags {
+		return "", nil, errors.New("too many tags")
+	}
+	return category, list, nil
+}
+
+//headers returns the header fields tagging req. It's nil-safe, returning
+//nothing without tagging.
+func (c *TaggingConfig) headers(req *EmailSendRequest) []tagHeader {
+	if c == nil {
+		return nil
+	}
+	var fields []tagHeader
+	if c.ConfigurationSet != "" {
+		fields = append(fields, tagHeader{"X-SES-CONFIGURATION-SET", c.ConfigurationSet})
+	}
+	values := req.Tags
+	if req.Category != "" {
+		values = append([]string{req.Category}, values...)
+	}
+	if len(values) == 0 {
+		return fields
+	}
+	switch c.Format {
+	case TagFormatSendGrid:
+		raw, _ := json.Marshal(map[string][]string{"category": values})
+		fields = append(fields, tagHeader{c.Header, string(raw)})
+	case TagFormatSES:
+		pairs := make([]string, 0, len(values))
+		if req.Category != "" {
+			pairs = append(pairs, "category="+req.Category)
+		}
+		for _, tag := range req.Tags {
+			pairs = append(pairs, tag+"=true")
+		}
+		fields = append(fields, tagHeader{c.Header, strings.Join(pairs, ", ")})
+	case TagFormatList:
+		fields = append(fields, tagHeader{c.Header, strings.Join(values, ", ")})
+	case TagFormatRepeat:
+		for _, v := range values {
+			fields = append(fields, tagHeader{c.Header, v})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sync"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+//templateSet is a compiled text template with its optional HTML
+//alternative, footers and calendar invite, as well as the sources they were compiled from
+type templateSet struct {
+	text       templateExecutor
+	html       templateExecutor
+	textFooter templateExecutor
+	htmlFooter templateExecutor
+	textSource string
+	htmlSource string
+	engine     string
+	funcs      template.FuncMap
+	calendar   *calendarTemplate
+	//allowed restricts the recipients of the body templates
+	allowed recipientAllowlist
+}
+
+//Template engines, see MailConfig.TemplateEngine
+const (
+	TemplateEngineGo       = "go"
+	TemplateEngineMustache = "mustache"
+)
+
+func validateTemplateEngine(engine string) error {
+	switch engine {
+	case "", TemplateEngineGo, TemplateEngineMustache:
+		return nil
+	}
+	return fmt.Errorf("unknown template engine %q", engine)
+}
+
+//parseTemplate compiles src with engine, escaping values for HTML if html
+//is set. funcs are made available to Go templates.
+func parseTemplate(engine string, funcs template.FuncMap, name, src string, html bool) (templateExecutor, error) {
+	switch engine {
+	case "", TemplateEngineGo:
+		if html {
+			return htmltemplate.New(name).Funcs(htmltemplate.FuncMap(funcs)).Parse(src)
+		}
+		return template.New(name).Funcs(funcs).Parse(src)
+	case TemplateEngineMustache:
+		return parseMustache(name, src, html)
+	}
+	return nil, validateTemplateEngine(engine)
+}
+
+func parseTemplates(engine string, funcs template.FuncMap, text, html string, footer *FooterConfig, calendar *CalendarConfig) (*templateSet, error) {
+	t := &templateSet{textSource: text, htmlSource: html, engine: engine, funcs: funcs}
+	var err error
+	if t.text, err = parseTemplate(engine, funcs, "Body", text, false); err != nil {
+		return nil, err
+	}
+	if html != "" {
+		if t.html, err = parseTemplate(engine, funcs, "HTMLBody", html, true); err != nil {
+			return nil, err
+		}
+	}
+	if err = t.parseFooter(footer); err != nil {
+		return nil, err
+	}
+	if err = t.parseCalendar(calendar); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//templateStore holds the current templates, which may be replaced while
+//emails are being rendered. A stored set is never modified.
+type templateStore struct {
+	mu  sync.RWMutex
+	set *templateSet
+}
+
+func (s *templateStore) get() *templateSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.set
+}
+
+func (s *templateStore) swap(set *templateSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set = set
+}
+
+//reloadTemplatesHandler recompiles the templates from the config file and
+//swaps them in, leaving everything else as it is. If they don't compile
+//the old ones stay live.
+func (s *server) reloadTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	content, err := readConfigFile(s.configFile)
+	if err != nil {
+		errorLogger.Printf("Reloading templates: %v", err)
+		http.Error(w, "Reading config file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var fresh struct {
+		EmailConfig struct {
+			TemplateText     string          `yaml:"TemplateText"`
+			HTMLTemplateText string          `yaml:"HTMLTemplateText"`
+			Footer           *FooterConfig   `yaml:"Footer"`
+			Calendar         *CalendarConfig `yaml:"Calendar"`
+			//AllowedRecipients is bound to the templates
+			AllowedRecipients []string `yaml:"AllowedRecipients"`
+		} `yaml:"EmailConfig"`
+	}
+	if err = yaml.Unmarshal(content, &fresh); err != nil {
+		http.Error(w, "Parsing config file: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	set, err := parseTemplates(s.config.EmailConfig.TemplateEngine, s.config.EmailConfig.templateFuncs, fresh.EmailConfig.TemplateText, fresh.EmailConfig.HTMLTemplateText, fresh.EmailConfig.Footer, fresh.EmailConfig.Calendar)
+	if err != nil {
+		errorLogger.Printf("Reloading templates, keeping the old ones: %v", err)
+		http.Error(w, "Compiling templates: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if set.allowed, err = parseAllowlist(fresh.EmailConfig.AllowedRecipients); err != nil {
+		errorLogger.Printf("Reloading templates, keeping the old ones: %v", err)
+		http.Error(w, "Parsing allowed recipients: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	s.config.EmailConfig.templates.swap(set)
+	infoLogger.Println("Reloaded templates from", s.configFile)
+	audit("templates_reloaded", "", nil)
+	w.Write([]byte("Templates reloaded"))
+}
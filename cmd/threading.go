@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//msgIDPattern matches a single RFC 5322 msg-id, loosely
+var msgIDPattern = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`)
+
+//parseMessageIDs parses a whitespace separated list of message-ids as
+//sent in the inReplyTo and references fields
+func parseMessageIDs(field, value string) ([]string, error) {
+	ids := strings.Fields(value)
+	for _, id := range ids {
+		if !msgIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("%s: malformed message-id %q", field, id)
+		}
+	}
+	return ids, nil
+}
+
+//newMessageID returns a unique Message-ID for a message of the request
+//with the given id, in the domain of the sender address
+func (m *MailConfig) newMessageID(requestID string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(m.Sender.Address, "@"); at >= 0 && at+1 < len(m.Sender.Address) {
+		domain = m.Sender.Address[at+1:]
+	}
+	return fmt.Sprintf("<%s.%s@%s>", requestID, newRequestID(), domain)
+}
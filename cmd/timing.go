@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"time"
+)
+
+//Delivery phases, the phase label of smtp_phase_duration_seconds
+const (
+	phaseConnect = "connect"
+	phaseAuth    = "auth"
+	phaseData    = "data"
+	phaseTotal   = "total"
+)
+
+//phaseBuckets are the upper bounds of smtp_phase_duration_seconds, in
+//seconds
+var phaseBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func init() {
+	metrics.describeHistogram("smtp_phase_duration_seconds", "Time spent in each phase of sending to a recipient", phaseBuckets)
+}
+
+//DeliveryTimings is how long sending to a recipient took, by phase. With
+//retries and failovers the phases add up over all attempts. Connect and
+//Auth are zero when the message went over a connection kept open for an
+//earlier one, and for backends other than SMTP.
+type DeliveryTimings struct {
+	//Connect covers dialing and the server's greeting
+	Connect time.Duration
+	//Auth covers STARTTLS and AUTH
+	Auth time.Duration
+	//Data covers the mail transaction, from MAIL to the end of DATA
+	Data time.Duration
+	//Total is the whole send, retries and backoff included
+	Total time.Duration
+}
+
+type timingsKey struct{}
+
+//withTimings returns a context the SMTP phases of a send are recorded in t
+//under
+func withTimings(ctx context.Context, t *DeliveryTimings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+//recordPhase adds the time since start to the phase of the timings of
+//ctx, if any, and to smtp_phase_duration_seconds
+func recordPhase(ctx context.Context, phase string, start time.Time) {
+	d := time.Since(start)
+	metrics.observe("smtp_phase_duration_seconds", d.Seconds(), "phase", phase)
+	if phase != phaseTotal {
+		//the deliver span covers the total
+		recordSpan(ctx, "smtp "+phase, start)
+	}
+	t, _ := ctx.Value(timingsKey{}).(*DeliveryTimings)
+	if t == nil {
+		return
+	}
+	switch phase {
+	case phaseConnect:
+		t.Connect += d
+	case phaseAuth:
+		t.Auth += d
+	case phaseData:
+		t.Data += d
+	case phaseTotal:
+		t.Total += d
+	}
+}
@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTracingServiceName   = "docs-email-sender"
+	defaultTracingFlushInterval = 5 * time.Second
+	defaultTracingTimeout       = 10 * time.Second
+	//tracingBatchSize is how many spans are exported at once at most
+	tracingBatchSize = 512
+	//tracingBacklog is how many ended spans may wait to be exported before
+	//new ones are dropped
+	tracingBacklog = 4096
+)
+
+//OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+func init() {
+	metrics.describe("tracing_spans_dropped_total", counterMetric, "Spans dropped as the exporter fell behind")
+	metrics.describe("tracing_export_failures_total", counterMetric, "Span batches the OTLP endpoint could not be sent")
+}
+
+//TracingConfig exports OpenTelemetry traces of requests, from clientHandler
+//through rendering to every SMTP phase, over OTLP/HTTP with JSON encoding.
+//A traceparent header on the request makes its send part of that trace.
+type TracingConfig struct {
+	//Endpoint is the OTLP/HTTP traces URL, e.g.
+	//"http://localhost:4318/v1/traces". Without a path /v1/traces is used.
+	Endpoint string `yaml:"Endpoint"`
+	//Headers are sent with every export, e.g. for authentication
+	Headers     map[string]string `yaml:"Headers"`
+	ServiceName string            `yaml:"ServiceName"`
+	//FlushInterval is how often spans are exported, every 5 seconds by
+	//default
+	FlushInterval time.Duration `yaml:"FlushInterval"`
+	Timeout       time.Duration `yaml:"Timeout"`
+}
+
+func (c *TracingConfig) validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || !u.IsAbs() {
+		return errors.New("tracing needs an absolute Endpoint URL")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+		c.Endpoint = u.String()
+	}
+	for name := range c.Headers {
+		if !isHeaderName(name) {
+			return fmt.Errorf("invalid tracing header %q", name)
+		}
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = defaultTracingServiceName
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultTracingFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTracingTimeout
+	}
+	return nil
+}
+
+//tracing exports the spans of the process, it's nil without a
+//TracingConfig and spans are no-ops then
+var tracing *tracer
+
+//spanContext identifies a span across processes, as in a traceparent
+//header
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+//traceParent formats sc as a W3C traceparent header
+func (sc spanContext) traceParent() string {
+	flags := 0
+	if sc.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", sc.traceID, sc.spanID, flags)
+}
+
+//parseTraceParent parses a W3C traceparent header
+func parseTraceParent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+//traceParentOf returns the traceparent header of the span of ctx, "" if
+//there is none
+func traceParentOf(ctx context.Context) string {
+	if sc, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		return sc.traceParent()
+	}
+	return ""
+}
+
+//withTraceParent returns ctx with the span of a traceparent header as the
+//parent of the spans started in it, ctx itself if header is invalid
+func withTraceParent(ctx context.Context, header string) context.Context {
+	if sc, ok := parseTraceParent(header); ok {
+		return context.WithValue(ctx, spanContextKey{}, sc)
+	}
+	return ctx
+}
+
+type spanAttribute struct {
+	key, value string
+}
+
+//span is a timed operation of a trace. Its methods are nil-safe, a nil span
+//records nothing.
+type span struct {
+	sc       spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttribute
+	err      error
+}
+
+//startSpan starts a span named name as a child of the span of ctx, if any,
+//and returns it with a context carrying it. It returns a nil span if
+//tracing is off or the trace isn't sampled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	return startSpanAt(ctx, name, spanKindInternal, time.Now())
+}
+
+func startSpanAt(ctx context.Context, name string, kind int, start time.Time) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	parent, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if ok && !parent.sampled {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: start}
+	s.sc.sampled = true
+	if ok {
+		s.sc.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+	}
+	rand.Read(s.sc.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s.sc), s
+}
+
+//set adds an attribute to the span
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttribute{key, value})
+	}
+}
+
+//finish ends the span, failed if err is set, and queues it for export
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	tracing.queue(s)
+}
+
+//recordSpan records a span for an operation of ctx that ran from start
+//until now
+func recordSpan(ctx context.Context, name string, start time.Time) {
+	if tracing == nil {
+		return
+	}
+	_, s := startSpanAt(ctx, name, spanKindInternal, start)
+	s.finish(nil)
+}
+
+//tracer batches ended spans and exports them to the OTLP endpoint
+type tracer struct {
+	config TracingConfig
+	client *http.Client
+	spans  chan *span
+	//done is closed by stop, stopped by run once it exported the spans
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newTracer(config TracingConfig) *tracer {
+	return &tracer{
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		spans:   make(chan *span, tracingBacklog),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (t *tracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		metrics.inc("tracing_spans_dropped_total")
+	}
+}
+
+//run exports the spans every FlushInterval, or as soon as a batch is full,
+//until stop is called
+func (t *tracer) run() {
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.done:
+			for len(t.spans) > 0 {
+				if batch = append(batch, <-t.spans); len(batch) == tracingBatchSize {
+					t.exportBatch(batch)
+					batch = nil
+				}
+			}
+			t.exportBatch(batch)
+			close(t.stopped)
+			return
+		}
+		t.exportBatch(batch)
+		batch = nil
+	}
+}
+
+//stop exports the spans still queued
+func (t *tracer) stop() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.stopped
+}
+
+//otlpAttribute and the like are the OTLP/JSON encoding of spans
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs []spanAttribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		encoded = append(encoded, otlpAttribute{a.key, map[string]string{"stringValue": a.value}})
+	}
+	return encoded
+}
+
+//exportBatch posts batch to the endpoint. Failures are counted and logged, the
+//spans are lost.
+func (t *tracer) exportBatch(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.sc.traceID[:]),
+			SpanID:     hex.EncodeToString(s.sc.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]spanAttribute{{"service.name", t.config.ServiceName}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": defaultTracingServiceName},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		metrics.inc("tracing_export_failures_total")
+		errorLogger.Printf("Exporting %d spans: %v", len(batch), err)
+	}
+}
+
+func (t *tracer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+//TrackingConfig enables open and click tracking of HTML messages. This
+//records when and from where recipients read the message and which links
+//they follow, so only enable it where recipients are informed of it.
+type TrackingConfig struct {
+	//BaseURL is the public address of this server, e.g. https://mail.example.com
+	BaseURL string `yaml:"BaseURL"`
+	//Secret signs rewritten links so /track/click can't be used as an open
+	//redirect
+	Secret string `yaml:"Secret"`
+}
+
+const (
+	trackOpenPath  = "/track/open/"
+	trackClickPath = "/track/click/"
+)
+
+//transparentGIF is a 1x1 transparent GIF
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+var hrefPattern = regexp.MustCompile(`(?i)href="(https?://[^"]+)"`)
+
+func (t *TrackingConfig) validate() error {
+	if t.BaseURL == "" || t.Secret == "" {
+		return errors.New("tracking needs both BaseURL and Secret")
+	}
+	return nil
+}
+
+func (t *TrackingConfig) sign(id, target string) string {
+	mac := hmac.New(sha256.New, []byte(t.Secret))
+	mac.Write([]byte(id + "\n" + target))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//instrument rewrites the links of an HTML body to go through /track/click
+//and adds an open tracking pixel
+func (t *TrackingConfig) instrument(body []byte, id string) []byte {
+	base := strings.TrimSuffix(t.BaseURL, "/")
+	escapedID := url.PathEscape(id)
+
+	body = hrefPattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		target := html.UnescapeString(string(hrefPattern.FindSubmatch(match)[1]))
+		q := url.Values{"u": {target}, "s": {t.sign(id, target)}}
+		return []byte(`href="` + html.EscapeString(base+trackClickPath+escapedID+"?"+q.Encode()) + `"`)
+	})
+
+	pixel := []byte(`<img src="` + html.EscapeString(base+trackOpenPath+escapedID) + `" width="1" height="1" alt="" style="display:none">`)
+	if i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); i >= 0 {
+		return append(append(append([]byte(nil), body[:i]...), pixel...), body[i:]...)
+	}
+	return append(body, pixel...)
+}
+
+//requestIDOf returns the request part of a tracking id
+func requestIDOf(id string) string {
+	return strings.SplitN(id, ".", 2)[0]
+}
+
+func (s *server) trackOpenHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, trackOpenPath)
+	audit("open", requestIDOf(id), map[string]interface{}{"trackingId": id, "ip": r.RemoteAddr})
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(transparentGIF)
+}
+
+func (s *server) trackClickHandler(w http.ResponseWriter, r *http.Request) {
+	t := s.config.EmailConfig.Tracking
+	id := strings.TrimPrefix(r.URL.Path, trackClickPath)
+	target := r.URL.Query().Get("u")
+	if !hmac.Equal([]byte(r.URL.Query().Get("s")), []byte(t.sign(id, target))) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	audit("click", requestIDOf(id), map[string]interface{}{"trackingId": id, "ip": r.RemoteAddr, "url": target})
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+//verifyTimeout bounds the whole verification of one server
+const verifyTimeout = 30 * time.Second
+
+//verify connects to the SMTP server, negotiates STARTTLS and AUTH like a
+//send would and quits without sending anything
+func (s *SenderConfig) verify() error {
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	status, err := verifySession(addr, s, s.tlsPolicy())
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", addr, err)
+	}
+	infoLogger.Printf("Verified SMTP server %s (TLS: %s)", addr, status)
+	return nil
+}
+
+func verifySession(addr string, s *SenderConfig, policy string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, verifyTimeout)
+	if err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(verifyTimeout))
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer c.Close()
+
+	status, err := negotiate(c, addr, s.tlsConfig(), s.auth(), policy)
+	if err != nil {
+		return "", err
+	}
+	return status, c.Quit()
+}
+
+//verifySenders verifies the primary and failover SMTP servers. Other
+//backends and direct delivery have no fixed server to check.
+func (m *MailConfig) verifySenders() error {
+	senders := []*SenderConfig{&m.Sender}
+	for i := range m.Failover {
+		senders = append(senders, &m.Failover[i])
+	}
+	for _, s := range senders {
+		if s.backend() != BackendSMTP || s.DirectDelivery {
+			continue
+		}
+		if err := s.verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
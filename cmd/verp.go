@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+const defaultVERPPrefix = "bounce"
+
+//VERPConfig gives every recipient its own envelope sender (Variable
+//Envelope Return Path), so a bounce tells which address bounced. Messages
+//to several recipients at once can't be told apart, so it disables
+//SingleTransaction.
+type VERPConfig struct {
+	//Domain receives the bounces, e.g. "bounces.example.com". Mail to it
+	//should be piped to the bounce endpoint.
+	Domain string `yaml:"Domain"`
+	//Prefix starts the local part of the envelope sender, "bounce" by
+	//default, giving bounce+user=example.com@Domain
+	Prefix string `yaml:"Prefix"`
+}
+
+func (c *VERPConfig) prefix() string {
+	if c.Prefix == "" {
+		return defaultVERPPrefix
+	}
+	return c.Prefix
+}
+
+func (c *VERPConfig) validate() error {
+	if c.Domain == "" {
+		return errors.New("VERP needs a Domain")
+	}
+	if strings.ContainsAny(c.Prefix, "+@") {
+		return fmt.Errorf("VERP prefix %q contains + or @", c.Prefix)
+	}
+	return nil
+}
+
+//encode returns the envelope sender for messages to rcpt
+func (c *VERPConfig) encode(rcpt string) string {
+	return c.prefix() + "+" + strings.Replace(rcpt, "@", "=", 1) + "@" + c.Domain
+}
+
+//decode returns the recipient addr was generated for by encode
+func (c *VERPConfig) decode(addr string) (string, bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || !strings.EqualFold(addr[at+1:], c.Domain) {
+		return "", false
+	}
+	local := addr[:at]
+	if !strings.HasPrefix(local, c.prefix()+"+") {
+		return "", false
+	}
+	rcpt := local[len(c.prefix())+1:]
+	eq := strings.LastIndex(rcpt, "=")
+	if eq <= 0 || eq == len(rcpt)-1 {
+		return "", false
+	}
+	return rcpt[:eq] + "@" + rcpt[eq+1:], true
+}
+
+//envelopeFrom returns the envelope sender for messages to rcpt, empty for
+//the sender's own address
+func (m *MailConfig) envelopeFrom(rcpt string) string {
+	if m.VERP == nil {
+		return ""
+	}
+	return m.VERP.encode(rcpt)
+}
+
+//bounceRecipientHeaders are searched in order for the VERP address a
+//bounce was delivered to
+var bounceRecipientHeaders = []string{"X-Original-To", "Delivered-To", "Envelope-To", "To"}
+
+//bounce is what a bounce message says about a recipient
+type bounce struct {
+	recipient string
+	//hard is set for a permanent failure, a delay or temporary failure
+	//says nothing about the address
+	hard   bool
+	status string
+}
+
+//parseBounce reads a bounce delivered to a VERP address. envelopeTo is
+//the address the bounce was delivered to, if known; otherwise it's taken
+//from the headers. The failure is classified from the RFC 3464 delivery
+//status notification.
+func (c *VERPConfig) parseBounce(r io.Reader, envelopeTo string) (*bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	b := &bounce{}
+	candidates := []string{envelopeTo}
+	for _, name := range bounceRecipientHeaders {
+		if addrs, err := msg.Header.AddressList(name); err == nil {
+			for _, a := range addrs {
+				candidates = append(candidates, a.Address)
+			}
+		}
+	}
+	for _, addr := range candidates {
+		if rcpt, ok := c.decode(addr); ok {
+			b.recipient = rcpt
+			break
+		}
+	}
+	if b.recipient == "" {
+		return nil, errors.New("bounce is not addressed to a VERP address")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return nil, errors.New("bounce is not a delivery status notification")
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("bounce has no delivery status")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != "message/delivery-status" {
+			continue
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		return b, b.readStatus(content)
+	}
+}
+
+//readStatus fills in the failure from the per-recipient fields of a
+//delivery status, which follow the per-message fields
+func (b *bounce) readStatus(content []byte) error {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if action := strings.ToLower(fields.Get("Action")); action != "" {
+			b.status = fields.Get("Status")
+			b.hard = action == "failed" && strings.HasPrefix(b.status, "5")
+			return nil
+		}
+		if err != nil {
+			return errors.New("delivery status has no recipient fields")
+		}
+	}
+}
+
+//bounceHandler takes a bounce message as the request body, as an MTA
+//piping the mail for VERPConfig.Domain would deliver it, e.g. with
+//`curl --data-binary @- -H "Authorization: Bearer TOKEN" URL?recipient=${recipient}`.
+//Hard bounces suppress the recipient, anything else is only logged.
+func (s *server) bounceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := &s.config.EmailConfig
+	b, err := m.VERP.parseBounce(http.MaxBytesReader(w, r.Body, s.config.MaxRequestBytes), r.URL.Query().Get("recipient"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !b.hard {
+		infoLogger.Printf("Ignoring soft bounce (status %s) for %s", b.status, b.recipient)
+		w.Write([]byte("Soft bounce ignored"))
+		return
+	}
+	added, err := m.suppressions.add(b.recipient)
+	if err != nil {
+		errorLogger.Printf("Suppressing %s: %v", b.recipient, err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	if added {
+		infoLogger.Printf("Suppressing %s after a hard bounce (status %s)", b.recipient, b.status)
+		audit("address_suppressed", "", map[string]interface{}{"address": b.recipient, "status": b.status})
+	}
+	w.Write([]byte("Recipient suppressed"))
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//warmupDayLayout is how days are written in WarmupConfig and its state
+const warmupDayLayout = "2006-01-02"
+
+//Warm-up modes, see WarmupConfig.Mode
+const (
+	WarmupReject = "reject"
+	WarmupDefer  = "defer"
+)
+
+//ErrWarmupCap is returned for sends past the cap of the day
+var ErrWarmupCap = errors.New("daily warm-up cap reached")
+
+//WarmupConfig ramps up the volume sent from a new IP: up to DailyCaps[i]
+//messages go out on the i-th day from Start, counting each recipient of
+//every transaction, archive and manager copies included. Days before Start
+//get the first cap, from the day after the last one on there is no cap.
+type WarmupConfig struct {
+	//Start is the first day, as "2006-01-02" in local time
+	Start     string `yaml:"Start"`
+	DailyCaps []int  `yaml:"DailyCaps"`
+	//Mode is "reject" (default) to fail the sends past the cap, or "defer"
+	//to hold them and pause sending until the next day. Requests keep being
+	//queued meanwhile.
+	Mode string `yaml:"Mode"`
+	//StateFile keeps the count of the day, so restarts don't reset it
+	StateFile string `yaml:"StateFile"`
+}
+
+func init() {
+	metrics.describe("warmup_daily_cap", gaugeMetric, "Messages allowed today by the warm-up schedule, 0 once it's over")
+	metrics.describe("warmup_sent_today", gaugeMetric, "Messages counted against today's warm-up cap")
+	metrics.describe("warmup_capped_sends_total", counterMetric, "Sends held or rejected by the warm-up cap")
+}
+
+//warmupState is the content of the state file
+type warmupState struct {
+	Day  string `json:"day"`
+	Sent int    `json:"sent"`
+}
+
+type warmupLimiter struct {
+	config WarmupConfig
+	start  time.Time
+	//queue is paused in defer mode once the cap is reached
+	queue requestQueue
+
+	mu    sync.Mutex
+	state warmupState
+	//resumeAt is when the queue paused for the cap is resumed
+	resumeAt time.Time
+}
+
+//load validates the schedule and reads the count of the day
+func (c *WarmupConfig) load() (*warmupLimiter, error) {
+	start, err := time.ParseInLocation(warmupDayLayout, c.Start, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Start: %w", err)
+	}
+	if len(c.DailyCaps) == 0 {
+		return nil, errors.New("warm-up needs DailyCaps")
+	}
+	for i, limit := range c.DailyCaps {
+		if limit <= 0 {
+			return nil, fmt.Errorf("the cap of day %d must be positive", i+1)
+		}
+	}
+	switch c.Mode {
+	case "", WarmupReject, WarmupDefer:
+	default:
+		return nil, fmt.Errorf("unknown warm-up mode %q", c.Mode)
+	}
+
+	l := &warmupLimiter{config: *c, start: start}
+	if c.StateFile != "" {
+		content, err := ioutil.ReadFile(c.StateFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if err = json.Unmarshal(content, &l.state); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", c.StateFile, err)
+			}
+		}
+	}
+	l.mu.Lock()
+	l.rollover(time.Now())
+	l.mu.Unlock()
+	return l, nil
+}
+
+//capOn returns the cap of the day of t, or 0 once the schedule is over
+func (l *warmupLimiter) capOn(t time.Time) int {
+	y, m, d := t.Date()
+	sy, sm, sd := l.start.Date()
+	day := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	switch {
+	case day < 0:
+		return l.config.DailyCaps[0]
+	case day >= len(l.config.DailyCaps):
+		return 0
+	}
+	return l.config.DailyCaps[day]
+}
+
+//rollover starts counting afresh if now is on another day than the count
+//and returns the cap of the day. l.mu must be held.
+func (l *warmupLimiter) rollover(now time.Time) int {
+	if today := now.Format(warmupDayLayout); l.state.Day != today {
+		l.state = warmupState{Day: today}
+	}
+	limit := l.capOn(now)
+	metrics.set("warmup_daily_cap", float64(limit))
+	metrics.set("warmup_sent_today", float64(l.state.Sent))
+	return limit
+}
+
+//take counts n messages against the cap of the day. Past it, it fails
+//with ErrWarmupCap, or in defer mode pauses the queue and waits for the
+//next day. More than a whole day's cap at once always fails. It does
+//nothing on a nil limiter, i.e. without a warm-up.
+func (l *warmupLimiter) take(n int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		now := time.Now()
+		l.mu.Lock()
+		limit := l.rollover(now)
+		sent := l.state.Sent
+		if limit == 0 || sent+n <= limit {
+			l.state.Sent += n
+			metrics.set("warmup_sent_today", float64(l.state.Sent))
+			l.save()
+			l.mu.Unlock()
+			return nil
+		}
+		metrics.inc("warmup_capped_sends_total")
+		if l.config.Mode != WarmupDefer || n > limit {
+			l.mu.Unlock()
+			return fmt.Errorf("%w: %d of %d sent today", ErrWarmupCap, sent, limit)
+		}
+		y, m, d := now.Date()
+		tomorrow := time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+		l.pauseUntil(tomorrow)
+		l.mu.Unlock()
+		time.Sleep(time.Until(tomorrow))
+	}
+}
+
+//pauseUntil pauses the queue until t, unless it's paused already,
+//possibly by an admin who then has to resume it. l.mu must be held.
+func (l *warmupLimiter) pauseUntil(t time.Time) {
+	if l.queue == nil || !l.resumeAt.Before(t) {
+		return
+	}
+	l.resumeAt = t
+	if l.queue.paused() {
+		return
+	}
+	infoLogger.Printf("Warm-up cap of the day reached, pausing sending until %s", t.Format(time.RFC3339))
+	l.queue.pause()
+	time.AfterFunc(time.Until(t), func() {
+		infoLogger.Println("Resuming sending paused for the warm-up cap")
+		l.queue.resume()
+	})
+}
+
+//save writes the count of the day to the state file. l.mu must be held.
+func (l *warmupLimiter) save() {
+	if l.config.StateFile == "" {
+		return
+	}
+	content, err := json.Marshal(l.state)
+	if err != nil {
+		errorLogger.Printf("Saving warm-up state: %v", err)
+		return
+	}
+	tmp := l.config.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err == nil {
+		err = os.Rename(tmp, l.config.StateFile)
+	}
+	if err != nil {
+		errorLogger.Printf("Saving warm-up state: %v", err)
+	}
+}
@@ -1,5 +1,19 @@
 module github.com/er888kh/ntc-docs-email-sender
 
-go 1.16
+go 1.18
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/lib/pq v1.10.9
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.16.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)